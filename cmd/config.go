@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"time"
+)
+
+type (
+	// 設定ファイルの内容。以下のようなTOMLで記述する。
+	//
+	//   [[listener]]
+	//   addr = ":8443"
+	//   cert = "cert.pem"
+	//   key  = "key.pem"
+	//   root = "/var/www"        # 静的ファイルを配信する場合
+	//
+	//   [[listener]]
+	//   addr = ":9443"
+	//   self_signed = ["localhost"]
+	//   backend = "http://127.0.0.1:3000"   # リバースプロキシとする場合
+	//   http_addr = ":80"                   # 平文のHTTP/1.1も待ち受ける場合
+	//   http_redirect = true                # HTTPSへリダイレクトする場合
+	//
+	//   [[listener]]
+	//   addr = ":8080"
+	//   h2c  = true              # TLSを用いずにHTTP/2で待ち受ける場合。証明書は不要
+	//
+	//   [timeouts]
+	//   handshake_queue = "1s"
+	//
+	//   [limits]
+	//   max_buffered_bytes = 67108864
+	//
+	//   [[limit_override]]
+	//   prefix = "/upload/"
+	//   max_body_bytes = 1073741824
+	//
+	//   [[rate_limit]]
+	//   prefix = "/api/"
+	//   requests_per_second = 10
+	config struct {
+		Listeners  []listenerConfig  `toml:"listener"`
+		Timeouts   timeoutsConfig    `toml:"timeouts"`
+		Limits     limitsConfig      `toml:"limits"`
+		RateLimits []rateLimitConfig `toml:"rate_limit"`
+		Overrides  []overrideConfig  `toml:"limit_override"`
+		Tuning     tuningConfig      `toml:"tuning"`
+		Log        logConfig         `toml:"log"`
+		Debug      debugConfig       `toml:"debug"`
+	}
+
+	// 待ち受けるアドレス毎の設定。
+	// root, backend のいずれも無ければ組み込みのハンドラーで応答する。
+	listenerConfig struct {
+		Addr          string   `toml:"addr"`
+		Cert          string   `toml:"cert"`
+		Key           string   `toml:"key"`
+		SelfSigned    []string `toml:"self_signed"` // 空でなければ自己署名証明書を生成する
+		SelfSignedDir string   `toml:"self_signed_dir"`
+		Root          string   `toml:"root"`
+		Backend       string   `toml:"backend"`
+		AllowedHosts  []string `toml:"allowed_hosts"` // 空でなければ、これら以外のホストへのリクエストを拒否する
+		H2C           bool     `toml:"h2c"`           // 真ならTLSを用いずにHTTP/2で待ち受ける
+
+		// 空でなければ、このアドレスで平文のHTTP/1.1も待ち受ける。
+		// HTTPRedirectが真ならリクエストハンドラーで応答せず、HTTPSへリダイレクトする。
+		HTTPAddr     string `toml:"http_addr"`
+		HTTPRedirect bool   `toml:"http_redirect"`
+	}
+
+	timeoutsConfig struct {
+		Handshake      time.Duration `toml:"handshake"`
+		HandshakeQueue time.Duration `toml:"handshake_queue"`
+		Idle           time.Duration `toml:"idle"`
+		Read           time.Duration `toml:"read"`
+		Write          time.Duration `toml:"write"`
+		KeepAlive      time.Duration `toml:"keepalive"`         // PINGフレームを送信するまでの無通信の時間
+		KeepAliveAck   time.Duration `toml:"keepalive_timeout"` // PINGフレームのACKを待つ時間
+		FlushDelay     time.Duration `toml:"flush_delay"`
+		Shutdown       time.Duration `toml:"shutdown"`    // 終了時に接続の完了を待つ時間。0なら無制限
+		Handler        time.Duration `toml:"handler"`     // リクエストハンドラーの実行時間の上限
+		Handler503     bool          `toml:"handler_503"` // 上限を超えた場合にRST_STREAMフレームの代わりに503を返す
+	}
+
+	limitsConfig struct {
+		MaxBufferedBytes        int64 `toml:"max_buffered_bytes"`
+		MaxConcurrentHandshakes int   `toml:"max_concurrent_handshakes"`
+		ResponseSpoolThreshold  int   `toml:"response_spool_threshold"`
+		MaxBodyBytes            int64 `toml:"max_body_bytes"`
+		MaxHeaderListSize       int   `toml:"max_header_list_size"`
+
+		// gzipにより圧縮されたリクエストボディの展開
+		DecompressRequests   bool  `toml:"decompress_requests"`
+		MaxDecompressedBytes int64 `toml:"max_decompressed_bytes"`
+
+		// コネクション毎の新たなストリームのレート制限
+		MaxStreamsPerSecond int64 `toml:"max_streams_per_second"`
+		StreamRateBurst     int   `toml:"stream_rate_burst"`
+		StreamRateGoAway    bool  `toml:"stream_rate_goaway"`
+
+		// コネクション毎のクライアントによるストリームのリセットのレート制限
+		MaxResetsPerSecond int64 `toml:"max_resets_per_second"`
+		ResetRateBurst     int   `toml:"reset_rate_burst"`
+		ResetRateGoAway    bool  `toml:"reset_rate_goaway"`
+
+		// コネクション毎の送受信の帯域幅の上限
+		MaxSendBytesPerSecond int64 `toml:"max_send_bytes_per_second"`
+		MaxRecvBytesPerSecond int64 `toml:"max_recv_bytes_per_second"`
+
+		// サーバー全体の過負荷による新たなストリーム、コネクションの拒否
+		MaxGoroutines              int   `toml:"max_goroutines"`
+		MaxHeapBytes               int64 `toml:"max_heap_bytes"`
+		MaxRunningHandlers         int   `toml:"max_running_handlers"`
+		ShedWithServiceUnavailable bool  `toml:"shed_with_503"`
+	}
+
+	// :authorityやパスのプレフィックス毎のリクエストの上限の上書き。0の項目は上書きしない
+	overrideConfig struct {
+		Host              string        `toml:"host"`
+		Prefix            string        `toml:"prefix"`
+		MaxBodyBytes      int64         `toml:"max_body_bytes"`
+		MaxHeaderListSize int           `toml:"max_header_list_size"`
+		HandlerTimeout    time.Duration `toml:"handler_timeout"`
+		HandlerTimeout503 bool          `toml:"handler_timeout_503"`
+	}
+
+	// クライアントのIPアドレス毎の、パスのプレフィックス毎のリクエストのレート制限
+	rateLimitConfig struct {
+		Prefix            string `toml:"prefix"`
+		RequestsPerSecond int64  `toml:"requests_per_second"`
+		Burst             int    `toml:"burst"`
+	}
+
+	// ログの出力形式と出力先
+	logConfig struct {
+		Format    string `toml:"format"` // text, json
+		Level     string `toml:"level"`  // debug(既定), info, error
+		AccessLog string `toml:"access_log"`
+		ErrorLog  string `toml:"error_log"`
+	}
+
+	// pprof, expvar, Prometheusのメトリクスを提供するデバッグ用のサーバーの設定。
+	// addrが空なら起動しない。
+	// corpus_dirが空でなければ、受信したヘッダーブロックとフレーム列をファジングのコーパスとして保存する。
+	// trace_framesが真なら、送受信した全てのフレームの内容をdebugレベルのログに出力する。
+	// capture_dirが空でなければ、コネクション毎に送受信したバイト列を記録する。
+	debugConfig struct {
+		Addr           string `toml:"addr"`
+		CorpusDir      string `toml:"corpus_dir"`
+		MaxCorpusBytes int64  `toml:"max_corpus_bytes"`
+		TraceFrames    bool   `toml:"trace_frames"`
+		CaptureDir     string `toml:"capture_dir"`
+	}
+
+	tuningConfig struct {
+		InitialWindowSize     int64  `toml:"initial_window_size"`
+		MaxConcurrentStreams  int64  `toml:"max_concurrent_streams"`
+		MaxFrameSize          int64  `toml:"max_frame_size"`
+		HeaderTableSize       int64  `toml:"header_table_size"`
+		DisablePush           bool   `toml:"disable_push"`
+		ReadBufferSize        int    `toml:"read_buffer_size"`
+		WriteBufferSize       int    `toml:"write_buffer_size"`
+		AdaptiveReadBuffer    bool   `toml:"adaptive_read_buffer"`
+		AdaptiveDataFrameSize bool   `toml:"adaptive_data_frame_size"`
+		AcceptWorkers         int    `toml:"accept_workers"`
+		SpoolDir              string `toml:"spool_dir"`
+
+		// 真なら一部のプロトコル違反を記録するのみで許容する
+		Lenient bool `toml:"lenient"`
+
+		// 検証の厳密さ。strict, default, relaxedのいずれかで、空ならdefault
+		Validation string `toml:"validation"`
+
+		// 送信するGOAWAYフレームのデバッグデータ。verbatim, reference, noneのいずれかで、空ならverbatim
+		GoAwayDebugData string `toml:"goaway_debug_data"`
+	}
+)
+
+// 設定ファイルが無い場合の設定
+func defaultConfig() *config {
+	return &config{Listeners: []listenerConfig{{Addr: ":8080"}}}
+}
+
+func loadConfig(path string) (*config, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := parseTOML(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	cfg := &config{}
+	if err := decodeTOML(table, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if len(cfg.Listeners) == 0 {
+		return nil, fmt.Errorf("%s: no listener is configured", path)
+	}
+	return cfg, nil
+}
+
+// 設定ファイルに記述する検証の厳密さの名前
+var validationProfiles = map[string]h2s.ValidationProfile{
+	"":        h2s.ValidationDefault,
+	"default": h2s.ValidationDefault,
+	"strict":  h2s.ValidationStrict,
+	"relaxed": h2s.ValidationRelaxed,
+}
+
+// 設定ファイルに記述するGOAWAYフレームのデバッグデータの扱いの名前。
+// verbatimはエラーの内容をそのまま、referenceは参照IDを送信し、noneは何も送信しない
+var goAwayDebugPolicies = map[string]func(code h2frame.ErrCode, reason string) string{
+	"":          nil,
+	"verbatim":  nil,
+	"reference": h2s.GoAwayReference,
+	"none":      func(h2frame.ErrCode, string) string { return "" },
+}
+
+// ログの重要度の名前と、それ以上のログを出力するh2s.LogLevelの対応
+var logLevels = map[string]h2s.LogLevel{
+	"":      h2s.LogDebug,
+	"debug": h2s.LogDebug,
+	"info":  h2s.LogInfo,
+	"error": h2s.LogError,
+}
+
+// 設定に基づきサーバーを生成する
+func (cfg *config) newServer(l *listenerConfig) (*h2s.Server, error) {
+	// h2cでは証明書を用いない
+	var cert tls.Certificate
+	if !l.H2C {
+		var err error
+		if cert, err = l.certificate(); err != nil {
+			return nil, err
+		}
+	}
+
+	validation, ok := validationProfiles[cfg.Tuning.Validation]
+	if !ok {
+		return nil, fmt.Errorf("unknown validation profile: %s", cfg.Tuning.Validation)
+	}
+
+	goAwayDebug, ok := goAwayDebugPolicies[cfg.Tuning.GoAwayDebugData]
+	if !ok {
+		return nil, fmt.Errorf("unknown goaway_debug_data: %s", cfg.Tuning.GoAwayDebugData)
+	}
+
+	level, ok := logLevels[cfg.Log.Level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level: %s", cfg.Log.Level)
+	}
+
+	sv := h2s.NewServer(cert)
+	sv.Logger = h2s.NewStdLogger(nil, level)
+	sv.Validation = validation
+	sv.GoAwayDebugData = goAwayDebug
+	sv.AllowedHosts = l.AllowedHosts
+	sv.HandshakeTimeout = cfg.Timeouts.Handshake
+	sv.HandshakeQueueTimeout = cfg.Timeouts.HandshakeQueue
+	sv.IdleTimeout = cfg.Timeouts.Idle
+	sv.ReadTimeout = cfg.Timeouts.Read
+	sv.WriteTimeout = cfg.Timeouts.Write
+	sv.KeepAliveInterval = cfg.Timeouts.KeepAlive
+	sv.KeepAliveTimeout = cfg.Timeouts.KeepAliveAck
+	sv.FlushDelay = cfg.Timeouts.FlushDelay
+	sv.MaxBufferedBytes = cfg.Limits.MaxBufferedBytes
+	sv.MaxConcurrentHandshakes = cfg.Limits.MaxConcurrentHandshakes
+	sv.ResponseSpoolThreshold = cfg.Limits.ResponseSpoolThreshold
+	sv.DecompressRequests = cfg.Limits.DecompressRequests
+	sv.MaxDecompressedBytes = cfg.Limits.MaxDecompressedBytes
+	sv.MaxStreamsPerSecond = float64(cfg.Limits.MaxStreamsPerSecond)
+	sv.StreamRateBurst = cfg.Limits.StreamRateBurst
+	sv.StreamRateGoAway = cfg.Limits.StreamRateGoAway
+	sv.MaxResetsPerSecond = float64(cfg.Limits.MaxResetsPerSecond)
+	sv.ResetRateBurst = cfg.Limits.ResetRateBurst
+	sv.ResetRateGoAway = cfg.Limits.ResetRateGoAway
+	sv.MaxSendBytesPerSecond = cfg.Limits.MaxSendBytesPerSecond
+	sv.MaxRecvBytesPerSecond = cfg.Limits.MaxRecvBytesPerSecond
+	sv.Limits = h2s.RequestLimits{
+		MaxBodyBytes:      cfg.Limits.MaxBodyBytes,
+		MaxHeaderListSize: cfg.Limits.MaxHeaderListSize,
+		HandlerTimeout:    cfg.Timeouts.Handler,
+
+		TimeoutWithServiceUnavailable: cfg.Timeouts.Handler503,
+	}
+	for _, o := range cfg.Overrides {
+		sv.LimitOverrides = append(sv.LimitOverrides, h2s.LimitOverride{
+			Host:   o.Host,
+			Prefix: o.Prefix,
+			Limits: h2s.RequestLimits{
+				MaxBodyBytes:      o.MaxBodyBytes,
+				MaxHeaderListSize: o.MaxHeaderListSize,
+				HandlerTimeout:    o.HandlerTimeout,
+
+				TimeoutWithServiceUnavailable: o.HandlerTimeout503,
+			},
+		})
+	}
+	for _, rl := range cfg.RateLimits {
+		sv.RateLimits = append(sv.RateLimits, h2s.RateLimit{
+			Prefix:            rl.Prefix,
+			RequestsPerSecond: float64(rl.RequestsPerSecond),
+			Burst:             rl.Burst,
+		})
+	}
+	sv.MaxGoroutines = cfg.Limits.MaxGoroutines
+	sv.MaxHeapBytes = cfg.Limits.MaxHeapBytes
+	sv.MaxRunningHandlers = cfg.Limits.MaxRunningHandlers
+	sv.ShedWithServiceUnavailable = cfg.Limits.ShedWithServiceUnavailable
+	sv.InitialWindowSize = uint32(cfg.Tuning.InitialWindowSize)
+	sv.MaxConcurrentStreams = uint32(cfg.Tuning.MaxConcurrentStreams)
+	sv.MaxFrameSize = uint32(cfg.Tuning.MaxFrameSize)
+	sv.HeaderTableSize = uint32(cfg.Tuning.HeaderTableSize)
+	sv.DisablePush = cfg.Tuning.DisablePush
+	sv.MaxHeaderListSize = uint32(cfg.Limits.MaxHeaderListSize) // 強制する上限をそのまま通知する
+	sv.ReadBufferSize = cfg.Tuning.ReadBufferSize
+	sv.WriteBufferSize = cfg.Tuning.WriteBufferSize
+	sv.AdaptiveReadBuffer = cfg.Tuning.AdaptiveReadBuffer
+	sv.Lenient = cfg.Tuning.Lenient
+	sv.AdaptiveDataFrameSize = cfg.Tuning.AdaptiveDataFrameSize
+	sv.AcceptWorkers = cfg.Tuning.AcceptWorkers
+	sv.SpoolDir = cfg.Tuning.SpoolDir
+	sv.CorpusDir = cfg.Debug.CorpusDir
+	sv.MaxCorpusBytes = cfg.Debug.MaxCorpusBytes
+	sv.TraceFrames = cfg.Debug.TraceFrames
+	sv.CaptureDir = cfg.Debug.CaptureDir
+	return sv, nil
+}
+
+func (l *listenerConfig) certificate() (tls.Certificate, error) {
+	if len(l.SelfSigned) > 0 {
+		return loadSelfSigned(l.SelfSigned, l.SelfSignedDir)
+	}
+
+	if l.Cert == "" || l.Key == "" {
+		return tls.Certificate{},
+			fmt.Errorf("listener %s: cert and key, or self_signed is required", l.Addr)
+	}
+	return tls.LoadX509KeyPair(l.Cert, l.Key)
+}
+
+func (l *listenerConfig) handler() (http.Handler, error) {
+	switch {
+	case l.Root != "" && l.Backend != "":
+		return nil, fmt.Errorf("listener %s: root and backend are exclusive", l.Addr)
+
+	case l.Root != "":
+		return &h2s.FileServer{Root: http.Dir(l.Root)}, nil
+
+	case l.Backend != "":
+		backend, err := url.Parse(l.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: invalid backend: %s", l.Addr, err)
+		}
+		return httputil.NewSingleHostReverseProxy(backend), nil
+	}
+
+	return http.HandlerFunc(handle), nil
+}
+
+// 設定に基づきログの出力を設定し、アクセスログの出力先を返す。
+// アクセスログを出力しない場合はnilを返す。
+func (cfg *config) setupLogs() (io.Writer, error) {
+	if err := setupErrorLog(cfg.Log.Format, cfg.Log.ErrorLog); err != nil {
+		return nil, err
+	}
+
+	if cfg.Log.AccessLog == "" {
+		return nil, nil
+	}
+	return openLogFile(cfg.Log.AccessLog)
+}
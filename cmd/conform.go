@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+type (
+	// 適合性の検査項目
+	conformCheck struct {
+		section string // RFC 9113の節番号
+		desc    string
+		run     func(c *conformConn) error
+	}
+
+	// 検査のためのコネクション。
+	// 不正なフレームを送信するため、h2clientを用いずフレームを直接読み書きする。
+	conformConn struct {
+		conn   net.Conn
+		framer *h2frame.Framer
+	}
+)
+
+// エラーコード
+const (
+	cProtocolError    = 0x01
+	cFlowControlError = 0x03
+	cStreamClosed     = 0x05
+	cFrameSizeError   = 0x06
+	cCompressionError = 0x09
+)
+
+var conformChecks = []conformCheck{
+	{"3.4", "sends invalid connection preface", func(c *conformConn) error {
+		c.conn.Write([]byte("INVALID CONNECTION PREFACE\r\n\r\n"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"4.1", "sends a frame with unknown type", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0xff, 0, 0, make([]byte, 8))
+		return c.expectPingAck()
+	}},
+
+	{"4.2", "sends a DATA frame exceeding SETTINGS_MAX_FRAME_SIZE", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x04, 1, c.requestBlock("POST"))
+		c.write(0x00, 0, 1, make([]byte, 16385))
+		return c.expectStreamError(cFrameSizeError)
+	}},
+
+	{"4.3", "sends an invalid header block fragment", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, []byte{0xff, 0xff, 0xff, 0xff})
+		return c.expectConnError(cCompressionError)
+	}},
+
+	{"5.1", "sends a DATA frame on an idle stream", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x00, 0x01, 1, []byte("test"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"5.1", "sends a DATA frame on a half closed (remote) stream", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, c.requestBlock("GET"))
+		c.write(0x00, 0x01, 1, []byte("test"))
+		return c.expectStreamError(cStreamClosed)
+	}},
+
+	{"5.1.1", "sends a stream identifier that is numerically smaller than previous", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 5, c.requestBlock("GET"))
+		c.write(0x01, 0x05, 3, c.requestBlock("GET"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"5.1.1", "sends a stream identifier that is an even number", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 2, c.requestBlock("GET"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.1", "sends a DATA frame with 0x0 stream identifier", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x00, 0x01, 0, []byte("test"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.2", "sends a HEADERS frame with 0x0 stream identifier", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 0, c.requestBlock("GET"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.3", "sends a PRIORITY frame with a length other than 5 octets", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x04, 1, c.requestBlock("POST"))
+		c.write(0x02, 0, 1, []byte{0x80, 0, 0, 0x01})
+		return c.expectStreamError(cFrameSizeError)
+	}},
+
+	{"6.4", "sends a RST_STREAM frame with a length other than 4 octets", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x04, 1, c.requestBlock("POST"))
+		c.write(0x03, 0, 1, []byte{0, 0, 0})
+		return c.expectConnError(cFrameSizeError)
+	}},
+
+	{"6.4", "sends a RST_STREAM frame on an idle stream", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x03, 0, 1, []byte{0, 0, 0, 0x08})
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.5", "sends a SETTINGS frame with ACK flag and payload", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x04, 0x01, 0, make([]byte, 6))
+		return c.expectConnError(cFrameSizeError)
+	}},
+
+	{"6.5", "sends a SETTINGS frame with a length other than a multiple of 6", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x04, 0, 0, make([]byte, 3))
+		return c.expectConnError(cFrameSizeError)
+	}},
+
+	{"6.5.2", "sends SETTINGS_ENABLE_PUSH with a value other than 0 or 1", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x04, 0, 0, []byte{0, 0x02, 0, 0, 0, 0x02})
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.5.2", "sends SETTINGS_INITIAL_WINDOW_SIZE above the maximum", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x04, 0, 0, []byte{0, 0x04, 0x80, 0, 0, 0})
+		return c.expectConnError(cFlowControlError)
+	}},
+
+	{"6.7", "sends a PING frame", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		return c.expectPingAck()
+	}},
+
+	{"6.7", "sends a PING frame with a stream identifier other than 0x0", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x06, 0, 1, make([]byte, 8))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.7", "sends a PING frame with a length other than 8", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x06, 0, 0, make([]byte, 6))
+		return c.expectConnError(cFrameSizeError)
+	}},
+
+	{"6.9", "sends a WINDOW_UPDATE frame with a flow control window increment of 0", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x08, 0, 0, make([]byte, 4))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"6.9", "sends a WINDOW_UPDATE frame with a length other than 4 octets", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x08, 0, 0, []byte{0, 0, 0x01})
+		return c.expectConnError(cFrameSizeError)
+	}},
+
+	{"6.9.1", "sends WINDOW_UPDATE frames that overflow the connection window", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x08, 0, 0, []byte{0x7f, 0xff, 0xff, 0xff})
+		c.write(0x08, 0, 0, []byte{0x7f, 0xff, 0xff, 0xff})
+		return c.expectConnError(cFlowControlError)
+	}},
+
+	{"6.9.1", "sends WINDOW_UPDATE frames that overflow the stream window", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x04, 1, c.requestBlock("POST"))
+		c.write(0x08, 0, 1, []byte{0x7f, 0xff, 0xff, 0xff})
+		c.write(0x08, 0, 1, []byte{0x7f, 0xff, 0xff, 0xff})
+		return c.expectStreamError(cFlowControlError)
+	}},
+
+	{"6.10", "sends a CONTINUATION frame without a preceding HEADERS frame", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x09, 0x04, 1, c.requestBlock("GET"))
+		return c.expectConnError(cProtocolError)
+	}},
+
+	{"8.1", "sends a GET request", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, c.requestBlock("GET"))
+		_, err := c.expect(func(f *h2frame.Frame) bool {
+			return f.Type == 0x01 && f.StreamID == 1
+		})
+		return err
+	}},
+
+	{"8.1", "sends a HEADERS frame containing trailers after DATA", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x04, 1, c.requestBlock("POST"))
+		c.write(0x00, 0, 1, []byte("test"))
+		c.write(0x01, 0x05, 1, hpack.EncodeHeaderList(hpack.HeaderList{
+			hpack.NewHeaderField("x-checksum", "abc"),
+		}))
+		_, err := c.expect(func(f *h2frame.Frame) bool {
+			return f.Type == 0x01 && f.StreamID == 1
+		})
+		return err
+	}},
+
+	{"8.1", "sends a HEADERS frame containing trailers without END_STREAM flag", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x04, 1, c.requestBlock("POST"))
+		c.write(0x00, 0, 1, []byte("test"))
+		c.write(0x01, 0x04, 1, hpack.EncodeHeaderList(hpack.HeaderList{
+			hpack.NewHeaderField("x-checksum", "abc"),
+		}))
+		return c.expectStreamError(cProtocolError)
+	}},
+
+	{"8.2", "sends a HEADERS frame that contains a field name in uppercase letters", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, c.requestBlock("GET", hpack.NewHeaderField("X-Test", "ok")))
+		return c.expectStreamError(cProtocolError)
+	}},
+
+	{"8.2.2", "sends a HEADERS frame that contains a connection-specific field", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, c.requestBlock("GET", hpack.NewHeaderField("connection", "keep-alive")))
+		return c.expectStreamError(cProtocolError)
+	}},
+
+	{"8.2.2", "sends a HEADERS frame that contains the TE field with a value other than trailers", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, c.requestBlock("GET", hpack.NewHeaderField("te", "trailers, deflate")))
+		return c.expectStreamError(cProtocolError)
+	}},
+
+	{"8.3.1", "sends a HEADERS frame without the :method pseudo-header", func(c *conformConn) error {
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		c.write(0x01, 0x05, 1, hpack.EncodeHeaderList(hpack.HeaderList{
+			hpack.NewHeaderField(":scheme", "https"),
+			hpack.NewHeaderField(":path", "/"),
+			hpack.NewHeaderField(":authority", "localhost"),
+		}))
+		return c.expectStreamError(cProtocolError)
+	}},
+}
+
+// conformサブコマンド。
+// h2specのように、起動中のサーバーに対して仕様に基づく検査を行い、
+// RFCの節毎に結果を出力する。失敗した検査があれば終了コード1で終了する。
+// アドレスを省略した場合は、このプロセス内で空いているポートにサーバーを起動して検査する。
+// -h2specフラグでh2specの実行ファイルを指定すると、組み込みの検査に加えてそれも実行する。
+func runConform(args []string) {
+	fs := flag.NewFlagSet("conform", flag.ExitOnError)
+	timeout := fs.Duration("t", time.Second, "timeout for each check")
+	insecure := fs.Bool("k", false, "skip verification of the server certificate")
+	h2spec := fs.String("h2spec", "", "also run the h2spec binary at this path and report failures by section")
+	fs.Parse(args)
+
+	var addr string
+	switch fs.NArg() {
+	case 0:
+		var err error
+		if addr, err = startConformServer(); err != nil {
+			log.Fatalf("failed to start server: %s", err)
+		}
+		*insecure = true
+		fmt.Printf("started server on %s\n\n", addr)
+	case 1:
+		addr = fs.Arg(0)
+	default:
+		log.Fatalf("usage: conform [flags] [host:port]")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("invalid address: %s", err)
+	}
+
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+		NextProtos:         []string{"h2"},
+	}
+
+	failed := 0
+	for _, check := range conformChecks {
+		err := runConformCheck(addr, config, *timeout, check)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %-6s %s\n        %s\n", check.section, check.desc, err)
+		} else {
+			fmt.Printf("PASS  %-6s %s\n", check.section, check.desc)
+		}
+	}
+
+	fmt.Printf("\n%d checks, %d passed, %d failed\n",
+		len(conformChecks), len(conformChecks)-failed, failed)
+
+	if *h2spec != "" {
+		fmt.Println()
+		n, err := runH2spec(*h2spec, addr, *timeout)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		failed += n
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func runConformCheck(
+	addr string,
+	config *tls.Config,
+	timeout time.Duration,
+	check conformCheck,
+) error {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	framer := h2frame.NewFramer(conn, conn)
+	framer.SetMaxReadFrameSize(h2frame.MaxAllowedFrameSize)
+	return check.run(&conformConn{conn: conn, framer: framer})
+}
+
+// コネクションプリフェイスとSETTINGSフレームを交換する
+func (c *conformConn) handshake() error {
+	c.conn.Write([]byte(h2frame.ClientPreface))
+	c.write(0x04, 0, 0, nil)
+
+	f, err := c.read()
+	if err != nil {
+		return fmt.Errorf("failed to read server SETTINGS: %s", err)
+	}
+	if f.Type != 0x04 || f.Flags&0x01 != 0 {
+		return fmt.Errorf("first frame from server is not SETTINGS (type=%d)", f.Type)
+	}
+
+	c.write(0x04, 0x01, 0, nil)
+	return nil
+}
+
+// 単純なリクエストのヘッダーブロックを返す。extra は疑似ヘッダーの後に加える
+func (c *conformConn) requestBlock(method string, extra ...*hpack.HeaderField) []byte {
+	return hpack.EncodeHeaderList(append(hpack.HeaderList{
+		hpack.NewHeaderField(":method", method),
+		hpack.NewHeaderField(":scheme", "https"),
+		hpack.NewHeaderField(":path", "/"),
+		hpack.NewHeaderField(":authority", "localhost"),
+	}, extra...))
+}
+
+func (c *conformConn) write(typ h2frame.Type, flags h2frame.Flags, id uint32, payload []byte) {
+	c.framer.WriteRawFrame(typ, flags, id, payload)
+}
+
+// フレームを1つ読み込む。
+// サーバーの最大フレームサイズの扱いも検査するため、受信するフレームの長さは制限しない。
+func (c *conformConn) read() (*h2frame.Frame, error) {
+	return c.framer.ReadFrame()
+}
+
+// 条件を満たすフレームを受信するまで読み進める
+func (c *conformConn) expect(match func(f *h2frame.Frame) bool) (*h2frame.Frame, error) {
+	for {
+		f, err := c.read()
+		if err != nil {
+			return nil, describeReadError(err)
+		}
+		if match(f) {
+			return f, nil
+		}
+	}
+}
+
+// PINGフレームを送信し、同じペイロードを持つACKを受信できることを検査する
+func (c *conformConn) expectPingAck() error {
+	payload := []byte("h2s-ping")
+	c.write(0x06, 0, 0, payload)
+
+	f, err := c.expect(func(f *h2frame.Frame) bool {
+		return f.Type == 0x06 && f.Flags&0x01 != 0
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(f.Payload, payload) {
+		return fmt.Errorf("PING ACK has unexpected payload")
+	}
+	return nil
+}
+
+// 指定のエラーコードのGOAWAYフレームを受信するか、
+// コネクションが閉じられることを検査する
+func (c *conformConn) expectConnError(code uint32) error {
+	for {
+		f, err := c.read()
+		if err == io.EOF || isConnReset(err) {
+			return nil
+		}
+		if err != nil {
+			return describeReadError(err)
+		}
+
+		if f.Type == 0x07 && len(f.Payload) >= 8 {
+			if got := binary.BigEndian.Uint32(f.Payload[4:]); got != code {
+				return fmt.Errorf("expected GOAWAY(code=%d), got GOAWAY(code=%d)", code, got)
+			}
+			return nil
+		}
+	}
+}
+
+// 指定のエラーコードのRST_STREAMフレームを受信するか、
+// コネクションエラーとして扱われることを検査する
+func (c *conformConn) expectStreamError(code uint32) error {
+	for {
+		f, err := c.read()
+		if err == io.EOF || isConnReset(err) {
+			return nil
+		}
+		if err != nil {
+			return describeReadError(err)
+		}
+
+		var got uint32
+		switch {
+		case f.Type == 0x03 && len(f.Payload) >= 4:
+			got = binary.BigEndian.Uint32(f.Payload)
+		case f.Type == 0x07 && len(f.Payload) >= 8:
+			got = binary.BigEndian.Uint32(f.Payload[4:])
+		default:
+			continue
+		}
+
+		if got != code {
+			return fmt.Errorf("expected error code %d, got %d (frame type=%d)", code, got, f.Type)
+		}
+		return nil
+	}
+}
+
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+func describeReadError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("timeout")
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// h2s.MetricsをPrometheusのテキスト形式で公開するための実装。
+	// カウンター、ゲージ、ヒストグラムの系列をメトリクス名とラベルの組で保持する。
+	promMetrics struct {
+		mu     sync.Mutex
+		series map[string]*promSeries
+	}
+
+	promSeries struct {
+		name    string
+		typ     string // counter, gauge, histogram
+		labels  string // {a="b",c="d"} の形式に整形したラベル
+		value   float64
+		updated time.Time
+
+		// ヒストグラムの場合のみ用いる
+		buckets []uint64 // promBucketsの各上限以下の観測値の数
+		count   uint64
+		sum     float64
+	}
+)
+
+// ヒストグラムのバケットの上限
+var promBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// コネクション毎のゲージは、この期間更新されなければ
+// コネクションが終了したものとして破棄する
+const connGaugeTTL = 5 * time.Minute
+
+var _ h2s.Metrics = (*promMetrics)(nil)
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{series: make(map[string]*promSeries)}
+}
+
+func (m *promMetrics) Add(name string, delta float64, labels h2s.Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookup(name, "counter", labels).value += delta
+}
+
+func (m *promMetrics) Set(name string, value float64, labels h2s.Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookup(name, "gauge", labels).value = value
+}
+
+func (m *promMetrics) Observe(name string, value float64, labels h2s.Labels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.lookup(name, "histogram", labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(promBuckets))
+	}
+	for i, le := range promBuckets {
+		if value <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// 系列を返す。無ければ作成する。muを獲得した上で呼び出す。
+func (m *promMetrics) lookup(name, typ string, labels h2s.Labels) *promSeries {
+	formatted := formatPromLabels(labels)
+	key := name + formatted
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &promSeries{name: name, typ: typ, labels: formatted}
+		m.series[key] = s
+	}
+
+	// コネクション毎のゲージのみ期限切れの判定に用いる
+	if _, ok := labels["conn"]; ok {
+		s.updated = time.Now()
+	}
+	return s
+}
+
+// 全ての系列をPrometheusのテキスト形式で出力する
+func (m *promMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	series := make([]*promSeries, 0, len(m.series))
+	for key, s := range m.series {
+		if !s.updated.IsZero() && time.Since(s.updated) > connGaugeTTL {
+			delete(m.series, key)
+			continue
+		}
+		copied := *s
+		copied.buckets = append([]uint64(nil), s.buckets...)
+		series = append(series, &copied)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	prev := ""
+	for _, s := range series {
+		if s.name != prev {
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.typ)
+			prev = s.name
+		}
+		s.writeTo(w)
+	}
+}
+
+func (s *promSeries) writeTo(w io.Writer) {
+	if s.typ != "histogram" {
+		fmt.Fprintf(w, "%s%s %s\n", s.name, s.labels, formatPromValue(s.value))
+		return
+	}
+
+	// ラベルは整形済みのため、leラベルを加える場合は閉じ括弧の手前に挿入する
+	withLE := func(le string) string {
+		if s.labels == "" {
+			return `{le="` + le + `"}`
+		}
+		return s.labels[:len(s.labels)-1] + `,le="` + le + `"}`
+	}
+
+	for i, le := range promBuckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n",
+			s.name, withLE(formatPromValue(le)), s.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", s.name, withLE("+Inf"), s.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", s.name, s.labels, formatPromValue(s.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", s.name, s.labels, s.count)
+}
+
+// ラベルを名前順に {a="b",c="d"} の形式に整形する。ラベルが無ければ空文字列を返す。
+func formatPromLabels(labels h2s.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatPromValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// デバッグ用のHTTP/1.1サーバーを起動する。
+// 以下を外部に公開しない内部向けのアドレスで提供する。
+//
+//	/debug/pprof/  net/http/pprofによるプロファイル
+//	/debug/vars    expvarによる変数。各サーバーのh2s.ConnStatsを含む
+//	/metrics       Prometheusのテキスト形式のメトリクス
+//	/debug/conns   接続中のコネクションとストリームの状態(h2s.ConnSnapshot)の一覧(JSON)と、以下による個別の切断
+//	               POST /debug/conns/drain?id=<ID>&reason=<理由>
+//	               POST /debug/conns/close?id=<ID>
+func serveDebug(addr string, metrics *promMetrics, servers []*runningServer) {
+	expvar.Publish("h2s_connections", expvar.Func(func() interface{} {
+		stats := make(map[string][]h2s.ConnStats)
+		for _, rs := range servers {
+			stats[rs.addr] = rs.server.ConnStats()
+		}
+		return stats
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/debug/conns", func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string][]h2s.ConnSnapshot)
+		for _, rs := range servers {
+			stats[rs.addr] = rs.server.Connections()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	mux.HandleFunc("/debug/conns/drain", connAction(servers, func(sv *h2s.Server, id uint64, r *http.Request) bool {
+		return sv.DrainConn(id, r.FormValue("reason"))
+	}))
+	mux.HandleFunc("/debug/conns/close", connAction(servers, func(sv *h2s.Server, id uint64, _ *http.Request) bool {
+		return sv.CloseConn(id)
+	}))
+
+	log.Printf("start debug server on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("failed to serve debug endpoints: %s", err)
+	}
+}
+
+// idパラメーターが示すコネクションを操作するハンドラーを返す。
+// コネクションの識別子はプロセス内で一意であるため、action が真を返すまで各サーバーに対して試みる。
+func connAction(servers []*runningServer, action func(*h2s.Server, uint64, *http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+
+		for _, rs := range servers {
+			if action(rs.server, id, r) {
+				log.Printf("%s connection %d via debug server", strings.TrimPrefix(r.URL.Path, "/debug/conns/"), id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "connection not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// フレームをデコードして出力する際の状態。
+// ヘッダーブロックはHPACKのインデックステーブルに依存するため、
+// 一方向のバイト列を先頭から順にデコードする必要がある。
+type frameDecoder struct {
+	out       io.Writer
+	table     *hpack.IndexTable
+	dumpData  bool
+	headerBuf []byte // CONTINUATIONフレームを待っている不完全なヘッダーブロック
+	offset    int64  // 入力の先頭からのバイト数
+}
+
+// decodeサブコマンド。
+// 復号したキャプチャ等から得たHTTP/2の一方向のバイト列をファイルまたは標準入力から読み込み、
+// フレーム毎にHPACKでデコードしたヘッダーを含めて出力する。
+// 先頭にクライアントのコネクションプリフェイスがあれば読み飛ばす。
+func runDecode(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	tableSize := fs.Int("table-size", 4096, "HPACK dynamic table size used by the encoder")
+	dumpData := fs.Bool("x", false, "hex dump DATA frame payloads")
+	fs.Parse(args)
+
+	in := io.Reader(os.Stdin)
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		if fs.Arg(0) != "-" {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				log.Fatalf("failed to open input: %s", err)
+			}
+			defer f.Close()
+			in = f
+		}
+	default:
+		log.Fatalf("usage: decode [flags] [file]")
+	}
+
+	d := &frameDecoder{
+		out:      os.Stdout,
+		table:    hpack.NewIndexTable(*tableSize),
+		dumpData: *dumpData,
+	}
+	if err := d.decode(bufio.NewReader(in)); err != nil {
+		log.Fatalf("failed to decode at offset %d: %s", d.offset, err)
+	}
+}
+
+func (d *frameDecoder) decode(r *bufio.Reader) error {
+	preface := h2frame.ClientPreface
+	if p, err := r.Peek(len(preface)); err == nil && string(p) == preface {
+		r.Discard(len(preface))
+		fmt.Fprintf(d.out, "[%8d] client connection preface\n", d.offset)
+		d.offset += int64(len(preface))
+	}
+
+	framer := h2frame.NewFramer(nil, r)
+	framer.SetMaxReadFrameSize(h2frame.MaxAllowedFrameSize)
+
+	for {
+		f, err := framer.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		d.print(f)
+		d.offset += h2frame.HeaderLen + int64(len(f.Payload))
+	}
+}
+
+// フレームヘッダーと、フレームタイプ毎にデコードしたペイロードを出力する
+func (d *frameDecoder) print(f *h2frame.Frame) {
+	fmt.Fprintf(d.out, "[%8d] %s\n", d.offset, f.Summary())
+
+	if err := d.printPayload(f); err != nil {
+		d.line("(invalid payload: %s)", err)
+	}
+}
+
+func (d *frameDecoder) printPayload(f *h2frame.Frame) error {
+	if f.Type == h2frame.TypeContinuation && d.headerBuf == nil {
+		return fmt.Errorf("no preceding HEADERS or PUSH_PROMISE")
+	}
+
+	lines, fragment, err := f.Describe()
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		d.line("%s", l)
+	}
+
+	switch f.Type {
+	case h2frame.TypeData:
+		p, _ := f.Unpadded()
+		if d.dumpData && len(p) > 0 {
+			for _, l := range strings.Split(strings.TrimRight(hex.Dump(p), "\n"), "\n") {
+				d.line("%s", l)
+			}
+		}
+	case h2frame.TypeHeaders, h2frame.TypePushPromise, h2frame.TypeContinuation:
+		return d.headerBlock(fragment, f.Flags.Has(h2frame.FlagEndHeaders))
+	}
+	return nil
+}
+
+// ヘッダーブロックの断片を蓄積し、完結していればデコードして出力する。
+// デコードに失敗した以降はインデックステーブルが同期しないため、
+// 以降のヘッダーは正しく出力されない可能性がある。
+func (d *frameDecoder) headerBlock(fragment []byte, end bool) error {
+	d.headerBuf = append(d.headerBuf, fragment...)
+	if !end {
+		if d.headerBuf == nil {
+			d.headerBuf = []byte{}
+		}
+		return nil
+	}
+
+	block := d.headerBuf
+	d.headerBuf = nil
+
+	headers, err := hpack.DecodeHeaderBlock(d.table, block)
+	if err != nil {
+		return fmt.Errorf("failed to decode header block: %s", err)
+	}
+	defer headers.Release()
+
+	for _, h := range headers {
+		d.line("%s: %s", h.Name(), h.Value())
+	}
+	return nil
+}
+
+func (d *frameDecoder) line(format string, a ...interface{}) {
+	fmt.Fprintf(d.out, "           "+format+"\n", a...)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// サーバーの起動時に指定できるフラグ。
+// 明示的に指定されたフラグのみ、設定ファイルの内容を上書きする。
+// listenerに関するフラグは最初のlistenerの設定を上書きする。
+type serverFlags struct {
+	fs *flag.FlagSet
+
+	addr          string
+	cert          string
+	key           string
+	selfSigned    selfSignedFlag
+	selfSignedDir string
+	httpAddr      string
+	httpRedirect  bool
+
+	windowSize       uint
+	maxStreams       uint
+	maxFrameSize     uint
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+	shutdownTimeout  time.Duration
+
+	logFormat string
+	logLevel  string
+	accessLog string
+	errorLog  string
+
+	debugAddr   string
+	corpusDir   string
+	traceFrames bool
+	captureDir  string
+}
+
+func newServerFlags(fs *flag.FlagSet) *serverFlags {
+	f := &serverFlags{fs: fs}
+
+	fs.StringVar(&f.addr, "addr", ":8080", "address to listen on")
+	fs.StringVar(&f.cert, "cert", "", "path to the certificate file")
+	fs.StringVar(&f.key, "key", "", "path to the private key file")
+	fs.Var(&f.selfSigned, "self-signed",
+		"generate a self-signed certificate (optionally for comma separated hostnames)")
+	fs.StringVar(&f.selfSignedDir, "self-signed-dir", "",
+		"write the generated certificate to the directory and reuse it on the next startup")
+	fs.StringVar(&f.httpAddr, "http-addr", "",
+		"also serve plain HTTP/1.1 on this address with the same handler (empty disables it)")
+	fs.BoolVar(&f.httpRedirect, "http-redirect", false,
+		"redirect requests on -http-addr to HTTPS instead of serving them")
+
+	fs.UintVar(&f.windowSize, "window-size", 0,
+		"initial stream window size advertised to clients (0 means the maximum)")
+	fs.UintVar(&f.maxStreams, "max-streams", 0,
+		"max concurrent streams per connection (0 means unlimited)")
+	fs.UintVar(&f.maxFrameSize, "max-frame-size", 0,
+		"max frame payload size accepted from clients (0 means 16384)")
+	fs.DurationVar(&f.idleTimeout, "idle-timeout", 0,
+		"close connections without streams after this duration (0 means never)")
+	fs.DurationVar(&f.handshakeTimeout, "handshake-timeout", 0,
+		"timeout for TLS handshakes (0 means no timeout)")
+	fs.DurationVar(&f.shutdownTimeout, "shutdown-timeout", 0,
+		"max time to drain connections on SIGTERM/SIGINT (0 means no limit)")
+
+	fs.StringVar(&f.logFormat, "log-format", "text", "log format (text or json)")
+	fs.StringVar(&f.logLevel, "log-level", "debug", "minimum level of server logs (debug, info or error)")
+	fs.StringVar(&f.accessLog, "access-log", "",
+		"path to the access log ('-' means stdout, empty disables it). reopened on SIGUSR1")
+	fs.StringVar(&f.errorLog, "error-log", "",
+		"path to the error log (empty means stderr). reopened on SIGUSR1")
+
+	fs.StringVar(&f.debugAddr, "debug-addr", "",
+		"internal address serving pprof, expvar and Prometheus metrics (empty disables it)")
+	fs.StringVar(&f.corpusDir, "corpus-dir", "",
+		"save received header blocks and frame sequences here as fuzzing corpus (empty disables it)")
+	fs.BoolVar(&f.traceFrames, "trace-frames", false,
+		"log every frame sent and received in a readable format at debug level")
+	fs.StringVar(&f.captureDir, "capture-dir", "",
+		"record raw bytes sent and received on each connection here for replay (empty disables it)")
+
+	return f
+}
+
+// 明示的に指定されたフラグを設定に反映する
+func (f *serverFlags) apply(cfg *config) {
+	first := &cfg.Listeners[0]
+
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "addr":
+			first.Addr = f.addr
+		case "cert":
+			first.Cert = f.cert
+			first.SelfSigned = nil
+		case "key":
+			first.Key = f.key
+		case "self-signed":
+			first.SelfSigned = nil
+			if f.selfSigned.enabled {
+				first.SelfSigned = f.selfSigned.hosts
+				if len(first.SelfSigned) == 0 {
+					first.SelfSigned = defaultSelfSignedHosts
+				}
+			}
+		case "self-signed-dir":
+			first.SelfSignedDir = f.selfSignedDir
+		case "http-addr":
+			first.HTTPAddr = f.httpAddr
+		case "http-redirect":
+			first.HTTPRedirect = f.httpRedirect
+		case "window-size":
+			cfg.Tuning.InitialWindowSize = int64(f.windowSize)
+		case "max-streams":
+			cfg.Tuning.MaxConcurrentStreams = int64(f.maxStreams)
+		case "max-frame-size":
+			cfg.Tuning.MaxFrameSize = int64(f.maxFrameSize)
+		case "idle-timeout":
+			cfg.Timeouts.Idle = f.idleTimeout
+		case "handshake-timeout":
+			cfg.Timeouts.Handshake = f.handshakeTimeout
+		case "shutdown-timeout":
+			cfg.Timeouts.Shutdown = f.shutdownTimeout
+		case "log-format":
+			cfg.Log.Format = f.logFormat
+		case "log-level":
+			cfg.Log.Level = f.logLevel
+		case "access-log":
+			cfg.Log.AccessLog = f.accessLog
+		case "error-log":
+			cfg.Log.ErrorLog = f.errorLog
+		case "debug-addr":
+			cfg.Debug.Addr = f.debugAddr
+		case "corpus-dir":
+			cfg.Debug.CorpusDir = f.corpusDir
+		case "trace-frames":
+			cfg.Debug.TraceFrames = f.traceFrames
+		case "capture-dir":
+			cfg.Debug.CaptureDir = f.captureDir
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// h2specが-jフラグにより出力するJUnit形式の結果のうち、集計に必要な部分
+	h2specReport struct {
+		Suites []struct {
+			Cases []h2specCase `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+
+	h2specCase struct {
+		Package   string  `xml:"package,attr"` // "http2/6.5.3"のような、仕様と節番号
+		ClassName string  `xml:"classname,attr"`
+		Failure   *string `xml:"failure"`
+		Error     *string `xml:"error"`
+		Skipped   *string `xml:"skipped"`
+	}
+)
+
+// 検査のためのサーバーを起動し、待ち受けているアドレスを返す。
+// ループバックアドレスの空いているポートで、自己署名証明書により待ち受ける。
+// サーバーはプロセスの終了まで動作し続ける。
+func startConformServer() (string, error) {
+	certPEM, keyPEM, err := generateSelfSigned([]string{"127.0.0.1"})
+	if err != nil {
+		return "", err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	go h2s.NewServer(cert).Serve(listener, http.HandlerFunc(handle))
+	return listener.Addr().String(), nil
+}
+
+// パス path のh2specを addr のサーバーに対して実行し、RFCの節毎に結果を出力する。
+// 結果はJUnit形式で一時ファイルに出力させて集計する。失敗した検査の数を返す。
+func runH2spec(path, addr string, timeout time.Duration) (int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	dir, err := os.MkdirTemp("", "h2spec")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.xml")
+
+	// h2specのタイムアウトは秒単位
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	cmd := exec.Command(path, "-h", host, "-p", port, "-t", "-k",
+		"-o", fmt.Sprint(seconds), "-j", report)
+	cmd.Stderr = os.Stderr
+
+	// 失敗した検査があれば0以外で終了するため、結果が出力されたかどうかで成否を判断する
+	runErr := cmd.Run()
+	data, err := os.ReadFile(report)
+	if err != nil {
+		if runErr != nil {
+			return 0, fmt.Errorf("failed to run h2spec: %s", runErr)
+		}
+		return 0, err
+	}
+
+	var r h2specReport
+	if err := xml.Unmarshal(data, &r); err != nil {
+		return 0, fmt.Errorf("failed to parse h2spec report: %s", err)
+	}
+
+	total, failed, skipped := 0, 0, 0
+	for _, suite := range r.Suites {
+		for _, c := range suite.Cases {
+			total++
+			switch {
+			case c.Skipped != nil:
+				skipped++
+			case c.Failure != nil || c.Error != nil:
+				failed++
+				msg := c.Failure
+				if msg == nil {
+					msg = c.Error
+				}
+				fmt.Printf("FAIL  %-14s %s\n", c.Package, c.ClassName)
+				for _, line := range strings.Split(strings.TrimSpace(*msg), "\n") {
+					fmt.Printf("        %s\n", strings.TrimSpace(line))
+				}
+			}
+		}
+	}
+
+	fmt.Printf("\nh2spec: %d cases, %d passed, %d failed, %d skipped\n",
+		total, total-failed-skipped, failed, skipped)
+	return failed, nil
+}
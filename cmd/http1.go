@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// 平文のHTTP/1.1で待ち受けるサーバーを生成する。
+// HTTP/2に対応しないクライアントや80番ポートへのアクセスのために、
+// HTTPSと同じリクエストハンドラー handler で応答するか、HTTPSへリダイレクトする。
+func newHTTP1Server(
+	l *listenerConfig,
+	handler http.Handler,
+	accessLog io.Writer,
+	json bool,
+) *http.Server {
+	if l.HTTPRedirect {
+		handler = withAccessLog(redirectToHTTPS(l.Addr), accessLog, json)
+	}
+	return &http.Server{Addr: l.HTTPAddr, Handler: handler}
+}
+
+// HTTP/1.1のサーバーを起動する。Shutdownメソッドにより終了した場合はログを出力しない。
+func serveHTTP1(sv *http.Server) {
+	log.Printf("start HTTP/1.1 server on %s", sv.Addr)
+	if err := sv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("failed to serve HTTP/1.1: %s", err)
+	}
+}
+
+// 同じホストの tlsAddr のポートへ、パスとクエリを保ったままリダイレクトする
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2client"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadサブコマンド。
+// h2loadのように、N本のコネクションそれぞれでM本のストリームを並行させて
+// リクエストを送信し続け、スループットとレイテンシーを計測する。
+func runLoad(args []string) {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	conns := fs.Int("c", 1, "number of connections")
+	streams := fs.Int("m", 1, "number of concurrent streams per connection")
+	requests := fs.Int("n", 0, "total number of requests (0 means use -d)")
+	duration := fs.Duration("d", 10*time.Second, "duration of the test")
+	insecure := fs.Bool("k", false, "skip verification of the server certificate")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("usage: load [flags] https://host:port/path")
+	}
+
+	target, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("invalid url: %s", err)
+	}
+
+	config := &tls.Config{
+		ServerName:         target.Hostname(),
+		InsecureSkipVerify: *insecure,
+	}
+
+	// -nが指定されていれば残りのリクエスト数、そうでなければ終了時刻で打ち切る
+	remain := int64(*requests)
+	deadline := time.Now().Add(*duration)
+	next := func() bool {
+		if *requests > 0 {
+			return atomic.AddInt64(&remain, -1) >= 0
+		}
+		return time.Now().Before(deadline)
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var errors int
+
+	var wg sync.WaitGroup
+	started := time.Now()
+
+	for i := 0; i < *conns; i++ {
+		conn, err := h2client.Dial(target.Host, config)
+		if err != nil {
+			log.Fatalf("failed to connect: %s", err)
+		}
+		defer conn.Close()
+
+		for j := 0; j < *streams; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				var local []time.Duration
+				localErrors := 0
+
+				for next() {
+					req, _ := http.NewRequest(http.MethodGet, target.String(), nil)
+
+					start := time.Now()
+					res, err := conn.RoundTrip(req)
+					if err != nil {
+						localErrors++
+						continue
+					}
+					io.Copy(io.Discard, res.Body)
+					local = append(local, time.Since(start))
+				}
+
+				mu.Lock()
+				latencies = append(latencies, local...)
+				errors += localErrors
+				mu.Unlock()
+			}()
+		}
+	}
+
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	fmt.Printf("requests:  %d succeeded, %d failed\n", len(latencies), errors)
+	fmt.Printf("duration:  %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("rps:       %.2f\n", float64(len(latencies))/elapsed.Seconds())
+
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+
+	fmt.Printf("latency:   min=%s p50=%s p90=%s p99=%s max=%s\n",
+		latencies[0], percentile(0.5), percentile(0.9), percentile(0.99),
+		latencies[len(latencies)-1])
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// ログの出力先のファイル。
+	// ログのローテーションの際に、同じパスのファイルを開き直せるようにする。
+	// パスが"-"なら標準出力、空なら標準エラー出力に出力し、開き直さない。
+	logFile struct {
+		mu   sync.Mutex
+		path string
+		w    io.Writer
+		f    *os.File
+	}
+
+	// logパッケージの出力を1行1つのJSONに変換するio.Writer
+	jsonLogWriter struct {
+		w io.Writer
+	}
+
+	// アクセスログを出力するミドルウェア
+	accessLogger struct {
+		handler http.Handler
+		w       io.Writer
+		json    bool
+	}
+
+	// レスポンスのステータスコードと送信したバイト数を記録するhttp.ResponseWriter
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+		bytes  int64
+	}
+)
+
+// 開き直すことのできるログファイルのリスト。ローテーションの際に用いる。
+var (
+	logFilesMu sync.Mutex
+	logFiles   []*logFile
+)
+
+func openLogFile(path string) (*logFile, error) {
+	lf := &logFile{path: path}
+	switch path {
+	case "":
+		lf.w = os.Stderr
+	case "-":
+		lf.w = os.Stdout
+	default:
+		if err := lf.reopen(); err != nil {
+			return nil, err
+		}
+
+		logFilesMu.Lock()
+		logFiles = append(logFiles, lf)
+		logFilesMu.Unlock()
+	}
+	return lf, nil
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.w.Write(p)
+}
+
+// 同じパスのファイルを開き直す。
+// 外部のツールによりファイルが移動された後に呼び出すことで、新たなファイルに出力する。
+func (lf *logFile) reopen() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f != nil {
+		lf.f.Close()
+	}
+	lf.f, lf.w = f, f
+	return nil
+}
+
+// 全てのログファイルを開き直す
+func reopenLogFiles() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+
+	for _, lf := range logFiles {
+		if err := lf.reopen(); err != nil {
+			log.Printf("failed to reopen log file %s: %s", lf.path, err)
+		}
+	}
+}
+
+// ログの出力形式と出力先を設定する。
+// format が"json"なら、logパッケージの出力を1行1つのJSONとする。
+func setupErrorLog(format, path string) error {
+	lf, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "", "text":
+		log.SetOutput(lf)
+	case "json":
+		log.SetPrefix("")
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{w: lf})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	watchLogRotation()
+	return nil
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(map[string]string{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": "info",
+		"msg":   strings.TrimRight(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// リクエストハンドラーをアクセスログを出力するミドルウェアで包む。
+// w がnilならアクセスログは出力しない。
+func withAccessLog(handler http.Handler, w io.Writer, json bool) http.Handler {
+	if w == nil {
+		return handler
+	}
+	return &accessLogger{handler: handler, w: w, json: json}
+}
+
+func (a *accessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	a.handler.ServeHTTP(rec, r)
+	elapsed := time.Since(started)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	remote := r.RemoteAddr
+	if remote == "" {
+		remote = "-"
+	}
+
+	if a.json {
+		line, _ := json.Marshal(map[string]interface{}{
+			"time":        started.Format(time.RFC3339Nano),
+			"remote_addr": remote,
+			"method":      r.Method,
+			"uri":         r.RequestURI,
+			"proto":       r.Proto,
+			"host":        r.Host,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(elapsed.Microseconds()) / 1000,
+			"user_agent":  r.UserAgent(),
+			"referer":     r.Referer(),
+		})
+		a.w.Write(append(line, '\n'))
+		return
+	}
+
+	// Combined Log Formatに処理時間を加えた形式
+	fmt.Fprintf(a.w, "%s - - [%s] %q %d %d %q %q %.3f\n",
+		remote, started.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto, rec.status, rec.bytes,
+		r.Referer(), r.UserAgent(), elapsed.Seconds())
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
@@ -1,22 +1,132 @@
 package main
 
 import (
-	"crypto/tls"
-	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"sync"
 )
 
 func main() {
 	log.SetPrefix("[h2] ")
 
-	cert, err := tls.LoadX509KeyPair(os.Args[1], os.Args[2])
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "load":
+			runLoad(os.Args[2:])
+			return
+		case "conform":
+			runConform(os.Args[2:])
+			return
+		case "decode":
+			runDecode(os.Args[2:])
+			return
+		case "get":
+			runRequest(http.MethodGet, os.Args[2:])
+			return
+		case "post":
+			runRequest(http.MethodPost, os.Args[2:])
+			return
+		}
+	}
+
+	runServer(os.Args[1:])
+}
+
+// サーバーを起動する。
+// -configフラグで設定ファイルを指定しない場合は-addrで指定したアドレスで待ち受ける。
+// 証明書と秘密鍵は-cert, -keyフラグで指定するか、-self-signedフラグにより生成する。
+// SIGTERM, SIGINTを受信すると穏やかに終了し、SIGHUPを受信すると設定を再読み込みする。
+func runServer(args []string) {
+	fs := flag.NewFlagSet("h2s", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML config file")
+	flags := newServerFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		log.Fatalf("usage: h2s [flags]. see -help for available flags")
+	}
+
+	load := func() (*config, error) {
+		cfg := defaultConfig()
+		if *configPath != "" {
+			var err error
+			if cfg, err = loadConfig(*configPath); err != nil {
+				return nil, err
+			}
+		}
+		flags.apply(cfg)
+		return cfg, nil
+	}
+
+	cfg, err := load()
+	if err != nil {
+		log.Fatalf("failed to load config: %s", err)
+	}
+
+	accessLog, err := cfg.setupLogs()
 	if err != nil {
-		log.Panicf("failed to load certification file: %s", err)
+		log.Fatalf("failed to configure logs: %s", err)
 	}
 
-	h2s.NewServer(cert).ListenAndServe(":8080", http.HandlerFunc(handle))
+	// デバッグ用のサーバーを起動する場合のみメトリクスを収集する
+	var metrics *promMetrics
+	if cfg.Debug.Addr != "" {
+		metrics = newPromMetrics()
+	}
+
+	var wg sync.WaitGroup
+	var servers []*runningServer
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+
+		sv, err := cfg.newServer(l)
+		if err != nil {
+			log.Fatalf("failed to configure server: %s", err)
+		}
+		if metrics != nil {
+			sv.Metrics = metrics
+		}
+
+		handler, err := l.handler()
+		if err != nil {
+			log.Fatalf("failed to configure handler: %s", err)
+		}
+
+		rs := &runningServer{addr: l.Addr, server: sv}
+		rs.handler.set(withAccessLog(handler, accessLog, cfg.Log.Format == "json"))
+		servers = append(servers, rs)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.H2C {
+				sv.ListenAndServeH2C(rs.addr, &rs.handler)
+			} else {
+				sv.ListenAndServe(rs.addr, &rs.handler)
+			}
+		}()
+
+		if l.HTTPAddr != "" {
+			rs.http = newHTTP1Server(l, &rs.handler, accessLog, cfg.Log.Format == "json")
+			go serveHTTP1(rs.http)
+		}
+	}
+
+	if metrics != nil {
+		go serveDebug(cfg.Debug.Addr, metrics, servers)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	os.Exit(handleSignals(servers, stopped, func() {
+		reloadServers(servers, load, accessLog)
+	}, cfg.Timeouts.Shutdown))
 }
 
 func handle(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2client"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 複数回指定可能なヘッダーのフラグ
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header must be in the form of 'Name: value'")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// get, postサブコマンド。
+// curlのように、h2clientによりリクエストを1つ送信してレスポンスを出力する。
+// method はサブコマンドに応じたメソッドの既定値であり、-Xにより変更できる。
+func runRequest(method string, args []string) {
+	fs := flag.NewFlagSet(strings.ToLower(method), flag.ExitOnError)
+	var headers headerFlags
+	fs.Var(&headers, "H", "request header in the form of 'Name: value' (repeatable)")
+	override := fs.String("X", "", "request method")
+	data := fs.String("d", "", "request body. '@file' reads a file, '@-' reads stdin")
+	output := fs.String("o", "", "write response body to the file instead of stdout")
+	include := fs.Bool("i", false, "include status line and response headers in the output")
+	insecure := fs.Bool("k", false, "skip verification of the server certificate")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("usage: %s [flags] https://host:port/path", fs.Name())
+	}
+
+	if *override != "" {
+		method = strings.ToUpper(*override)
+	}
+
+	body, err := readRequestBody(*data)
+	if err != nil {
+		log.Fatalf("failed to read request body: %s", err)
+	}
+
+	req, err := http.NewRequest(method, fs.Arg(0), bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("invalid request: %s", err)
+	}
+	for _, h := range headers {
+		kv := strings.SplitN(h, ":", 2)
+		req.Header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	transport := &h2client.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	defer transport.CloseIdleConnections()
+
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		log.Fatalf("request failed: %s", err)
+	}
+	defer res.Body.Close()
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("failed to create output file: %s", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *include {
+		fmt.Fprintf(out, "%s %s\n", res.Proto, res.Status)
+		writeHeaders(out, res.Header)
+		fmt.Fprintln(out)
+	}
+
+	if _, err := io.Copy(out, res.Body); err != nil {
+		log.Fatalf("failed to write response body: %s", err)
+	}
+
+	if *include && len(res.Trailer) > 0 {
+		fmt.Fprintln(out)
+		writeHeaders(out, res.Trailer)
+	}
+}
+
+// -dフラグの値からリクエストボディを得る
+func readRequestBody(data string) ([]byte, error) {
+	switch {
+	case data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(data[1:])
+	default:
+		return []byte(data), nil
+	}
+}
+
+// ヘッダーを名前順に出力する
+func writeHeaders(w io.Writer, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range h[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, value)
+		}
+	}
+}
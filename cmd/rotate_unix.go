@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var watchRotationOnce sync.Once
+
+// SIGUSR1を受信した際にログファイルを開き直す。
+// logrotate等によりファイルを移動した後にシグナルを送ることでローテーションできる。
+func watchLogRotation() {
+	watchRotationOnce.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		go func() {
+			for range ch {
+				reopenLogFiles()
+			}
+		}()
+	})
+}
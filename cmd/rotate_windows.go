@@ -0,0 +1,4 @@
+package main
+
+// SIGUSR1が無いため、ログファイルを開き直す契機は無い
+func watchLogRotation() {}
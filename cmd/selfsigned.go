@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 自己署名証明書の既定のホスト名
+var defaultSelfSignedHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// -self-signedフラグ。
+// 値を省略した場合は既定のホスト名、"-self-signed=a,b"の形式なら
+// 指定されたホスト名に対する自己署名証明書を生成する。
+type selfSignedFlag struct {
+	enabled bool
+	hosts   []string
+}
+
+func (f *selfSignedFlag) String() string {
+	return strings.Join(f.hosts, ",")
+}
+
+func (f *selfSignedFlag) Set(value string) error {
+	f.enabled = value != "false"
+	f.hosts = nil
+	if value != "true" && value != "false" {
+		f.hosts = strings.Split(value, ",")
+	}
+	return nil
+}
+
+// 値を省略できるよう、真偽値のフラグとして振る舞う
+func (f *selfSignedFlag) IsBoolFlag() bool {
+	return true
+}
+
+// ホスト名に対する自己署名証明書を生成する。
+// dir が空でなければ証明書と秘密鍵をそのディレクトリにcert.pem, key.pemとして書き出す。
+// 既に存在する場合は生成せずにそれを読み込む。
+func loadSelfSigned(hosts []string, dir string) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		hosts = defaultSelfSignedHosts
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if dir != "" {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			return cert, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if dir != "" {
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// ECDSA(P-256)の鍵と、それによる自己署名証明書をPEM形式で生成する
+func generateSelfSigned(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"c99-minimal-h2s"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
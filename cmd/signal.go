@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type (
+	// 起動したサーバーと、設定の再読み込みの際に差し替えるリクエストハンドラー。
+	// httpは平文のHTTP/1.1も待ち受ける場合のみ非nil。
+	runningServer struct {
+		addr    string
+		server  *h2s.Server
+		http    *http.Server
+		handler reloadableHandler
+	}
+
+	// 処理中のリクエストに影響を与えずに差し替えられるリクエストハンドラー
+	reloadableHandler struct {
+		mu sync.RWMutex
+		h  http.Handler
+	}
+)
+
+func (rh *reloadableHandler) set(h http.Handler) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	rh.h = h
+}
+
+func (rh *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.mu.RLock()
+	h := rh.h
+	rh.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// シグナルを待ち受け、プロセスの終了コードを返す。
+// SIGTERM, SIGINTを受信すると全てのサーバーを穏やかに終了させ、
+// 処理中のストリームが完了すれば0を返す。timeout が0でなければ、
+// それを過ぎても完了しない接続は強制的に閉じて1を返す。
+// 終了を待つ間に再びSIGTERM, SIGINTを受信した場合は即座に1を返す。
+// SIGHUPを受信すると reload を呼び出す。
+// 全てのサーバーが接続要求の受け入れに失敗して stopped が閉じられた場合も1を返す。
+func handleSignals(
+	servers []*runningServer,
+	stopped <-chan struct{},
+	reload func(),
+	timeout time.Duration,
+) int {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-stopped:
+			return 1
+
+		case sig := <-ch:
+			if sig == syscall.SIGHUP {
+				log.Printf("received %s, reloading config", sig)
+				reload()
+				continue
+			}
+
+			log.Printf("received %s, shutting down gracefully", sig)
+			return shutdownServers(servers, ch, timeout)
+		}
+	}
+}
+
+func shutdownServers(
+	servers []*runningServer,
+	signals <-chan os.Signal,
+	timeout time.Duration,
+) int {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var shutdowns []func(context.Context) error
+	for _, rs := range servers {
+		shutdowns = append(shutdowns, rs.server.Shutdown)
+		if rs.http != nil {
+			shutdowns = append(shutdowns, rs.http.Shutdown)
+		}
+	}
+
+	results := make(chan error, len(shutdowns))
+	for _, shutdown := range shutdowns {
+		shutdown := shutdown
+		go func() {
+			results <- shutdown(ctx)
+		}()
+	}
+
+	code := 0
+	for range shutdowns {
+		select {
+		case err := <-results:
+			if err != nil {
+				log.Printf("failed to drain connections: %s", err)
+				code = 1
+			}
+
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.Printf("received %s again, exiting immediately", sig)
+				return 1
+			}
+		}
+	}
+
+	log.Printf("shutdown completed")
+	return code
+}
+
+// 設定を読み込み直し、待ち受け中のアドレスの証明書とリクエストハンドラーを差し替える。
+// 待ち受けるアドレスの追加や削除、サーバーのオプション、ログの設定の変更は
+// 再起動するまで反映されない。読み込みに失敗した場合は元の設定のまま動作を続ける。
+func reloadServers(
+	servers []*runningServer,
+	load func() (*config, error),
+	accessLog io.Writer,
+) {
+	cfg, err := load()
+	if err != nil {
+		log.Printf("failed to reload config: %s", err)
+		return
+	}
+
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+
+		var rs *runningServer
+		for _, s := range servers {
+			if s.addr == l.Addr {
+				rs = s
+			}
+		}
+		if rs == nil {
+			log.Printf("listener %s is not running. restart to add it", l.Addr)
+			continue
+		}
+
+		// h2cでは証明書を用いない
+		var cert *tls.Certificate
+		if !l.H2C {
+			c, err := l.certificate()
+			if err != nil {
+				log.Printf("failed to reload certificate: %s", err)
+				continue
+			}
+			cert = &c
+		}
+
+		handler, err := l.handler()
+		if err != nil {
+			log.Printf("failed to reload handler: %s", err)
+			continue
+		}
+
+		if cert != nil {
+			rs.server.SetCertificate(*cert)
+		}
+		rs.handler.set(withAccessLog(handler, accessLog, cfg.Log.Format == "json"))
+		log.Printf("reloaded listener %s", l.Addr)
+	}
+}
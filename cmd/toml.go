@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// パースしたTOMLのテーブル
+type tomlTable = map[string]interface{}
+
+// 設定ファイルのためのTOMLのサブセットのパーサー。
+// 外部のパッケージに依存しないよう、以下のみを扱う。
+//
+//   - key = value の形式のキーと値。キーにドットは使えない
+//   - [table], [table.sub] の形式のテーブル
+//   - [[array]] の形式のテーブルの配列
+//   - 基本文字列、リテラル文字列、整数、真偽値と、それらの1行の配列
+//
+// 値はtomlTableを節とする木構造として返す。
+func parseTOML(src string) (tomlTable, error) {
+	root := tomlTable{}
+	current := root
+
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, fmt.Errorf("line %d: invalid array of tables", n+1)
+			}
+			current, err = appendTOMLTable(root, line[2:len(line)-2])
+
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid table", n+1)
+			}
+			current, err = lookupTOMLTable(root, line[1:len(line)-1])
+
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %d: expected key = value", n+1)
+			}
+
+			key := strings.TrimSpace(kv[0])
+			if _, ok := current[key]; ok {
+				return nil, fmt.Errorf("line %d: duplicated key %q", n+1, key)
+			}
+			current[key], err = parseTOMLValue(strings.TrimSpace(kv[1]))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+	}
+
+	return root, nil
+}
+
+// 文字列の外にある#以降をコメントとして取り除く
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// ドット区切りの名前のテーブルを、無ければ作成した上で返す。
+// 途中にテーブルの配列があれば、その最後の要素を辿る。
+func lookupTOMLTable(root tomlTable, name string) (tomlTable, error) {
+	t := root
+	for _, key := range strings.Split(name, ".") {
+		key = strings.TrimSpace(key)
+		switch v := t[key].(type) {
+		case nil:
+			sub := tomlTable{}
+			t[key] = sub
+			t = sub
+		case tomlTable:
+			t = v
+		case []tomlTable:
+			t = v[len(v)-1]
+		default:
+			return nil, fmt.Errorf("%q is not a table", name)
+		}
+	}
+	return t, nil
+}
+
+// テーブルの配列に新たなテーブルを追加して返す
+func appendTOMLTable(root tomlTable, name string) (tomlTable, error) {
+	parent := root
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		var err error
+		if parent, err = lookupTOMLTable(root, name[:i]); err != nil {
+			return nil, err
+		}
+		name = name[i+1:]
+	}
+
+	name = strings.TrimSpace(name)
+	sub := tomlTable{}
+	switch v := parent[name].(type) {
+	case nil:
+		parent[name] = []tomlTable{sub}
+	case []tomlTable:
+		parent[name] = append(v, sub)
+	default:
+		return nil, fmt.Errorf("%q is not an array of tables", name)
+	}
+	return sub, nil
+}
+
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+
+	case strings.HasPrefix(s, `"`):
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return strconv.Unquote(s)
+
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return s[1 : len(s)-1], nil
+
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		var values []interface{}
+		for _, elem := range splitTOMLArray(s[1 : len(s)-1]) {
+			v, err := parseTOMLValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	i, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	return i, nil
+}
+
+// 配列の要素を文字列中のカンマを考慮して分割する
+func splitTOMLArray(s string) []string {
+	var elems []string
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			elems = append(elems, s[start:i])
+			start = i + 1
+		}
+	}
+	elems = append(elems, s[start:])
+
+	trimmed := elems[:0]
+	for _, elem := range elems {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			trimmed = append(trimmed, elem)
+		}
+	}
+	return trimmed
+}
+
+// パースしたテーブルを構造体に格納する。
+// フィールドはtomlタグの名前のキーに対応させ、time.Durationは
+// time.ParseDurationの形式の文字列から変換する。未知のキーはエラーとする。
+func decodeTOML(t tomlTable, dst interface{}) error {
+	return decodeTOMLValue(t, reflect.ValueOf(dst).Elem(), "")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func decodeTOMLValue(src interface{}, dst reflect.Value, path string) error {
+	mismatch := func() error {
+		return fmt.Errorf("%s: unexpected value %v", path, src)
+	}
+
+	if dst.Type() == durationType {
+		s, ok := src.(string)
+		if !ok {
+			return mismatch()
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		dst.SetInt(int64(d))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.String:
+		s, ok := src.(string)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetString(s)
+
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		i, ok := src.(int64)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetInt(i)
+
+	case reflect.Slice:
+		var elems []interface{}
+		switch v := src.(type) {
+		case []interface{}:
+			elems = v
+		case []tomlTable:
+			for _, t := range v {
+				elems = append(elems, t)
+			}
+		default:
+			return mismatch()
+		}
+
+		slice := reflect.MakeSlice(dst.Type(), len(elems), len(elems))
+		for i, elem := range elems {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			if err := decodeTOMLValue(elem, slice.Index(i), elemPath); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+
+	case reflect.Struct:
+		t, ok := src.(tomlTable)
+		if !ok {
+			return mismatch()
+		}
+
+		fields := make(map[string]reflect.Value)
+		for i := 0; i < dst.NumField(); i++ {
+			if name := dst.Type().Field(i).Tag.Get("toml"); name != "" {
+				fields[name] = dst.Field(i)
+			}
+		}
+
+		for key, value := range t {
+			field, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("%s: unknown key %q", path, key)
+			}
+			if err := decodeTOMLValue(value, field, strings.TrimPrefix(path+"."+key, ".")); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("%s: unsupported field type %s", path, dst.Type())
+	}
+
+	return nil
+}
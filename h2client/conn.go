@@ -0,0 +1,699 @@
+// HTTP/2のクライアント実装。
+// サーバーの動作確認や負荷試験のための最小限の実装であり、
+// 1つのConnが1つのコネクション上で複数のリクエストを並行して処理する。
+// net/httpのクライアントから利用する場合はTransportを用いる。
+package h2client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// HTTP/2のコネクションを表す構造体
+	Conn struct {
+		conn net.Conn
+		br   *bufio.Reader
+
+		// フレームの書き込みの排他制御。
+		// ストリームIDは昇順に使用する必要があるため、
+		// IDの払い出しからHEADERSフレームの送信までをこれにより保護する。
+		wmu sync.Mutex
+		bw  *bufio.Writer
+
+		framer *h2frame.Framer // br からの読み込みと bw への書き込みを行う
+
+		mu           sync.Mutex
+		nextID       uint32
+		streams      map[uint32]*stream
+		err          error        // コネクションが利用できなくなった原因
+		goAway       *GoAwayError // GOAWAYフレームを受信していれば非nil。以降は新たなストリームを開始しない
+		maxFrameSize int          // サーバーが受信可能なフレームのペイロードの最大値
+
+		// 送信側のフロー制御。
+		// window はコネクションのウィンドウサイズ、initialWindow はサーバーが
+		// SETTINGSフレームで通知したストリームのウィンドウサイズの初期値。
+		// いずれかのウィンドウサイズが増加した場合はwindowCondにより通知する。
+		window        int64
+		initialWindow int64
+		windowCond    *sync.Cond
+
+		// レスポンスヘッダーのデコードに用いるインデックステーブル。
+		// readLoopからのみ参照する。
+		table *hpack.IndexTable
+	}
+
+	// 処理中のリクエストを表す構造体
+	stream struct {
+		status   int
+		header   http.Header
+		trailer  http.Header
+		body     bytes.Buffer
+		gotFinal bool          // 最終レスポンスのヘッダーを受信していれば真
+		done     chan struct{} // レスポンスの受信完了時にcloseされる
+		err      error
+		window   int64 // 送信側のストリームのウィンドウサイズ
+	}
+)
+
+// 接続が既に失われている場合等に返すエラー
+var ErrConnClosed = errors.New("h2client: connection closed")
+
+// サーバーからRST_STREAMフレームによりストリームを閉じられた場合に返すエラー
+type StreamError struct {
+	Code uint32 // RST_STREAMフレームのエラーコード
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("h2client: stream reset(code=%d)", e.Code)
+}
+
+// サーバーがGOAWAYフレームにより処理しないことを通知したリクエストのエラー。
+// リクエストはサーバーで処理されていないため、新たなコネクションで再送できる。
+type GoAwayError struct {
+	LastStreamID uint32 // GOAWAYフレームの最終ストリームID
+	Code         uint32 // GOAWAYフレームのエラーコード
+}
+
+func (e *GoAwayError) Error() string {
+	return fmt.Sprintf("h2client: request not processed by GOAWAY(code=%d, last stream=%d)",
+		e.Code, e.LastStreamID)
+}
+
+// TLSによりサーバーに接続し、HTTP/2のコネクションを確立する。
+// config がnilの場合は既定の設定を用いる。ALPNによる"h2"の合意は必須とする。
+func Dial(addr string, config *tls.Config) (*Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.NextProtos = []string{"h2"}
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		conn.Close()
+		return nil, fmt.Errorf("h2client: negotiated protocol is %q", p)
+	}
+
+	return NewConn(conn)
+}
+
+// 確立済みの接続上でHTTP/2のコネクションを開始する。
+// コネクションプリフェイスとSETTINGSフレームを送信し、フレームの受信を開始する。
+func NewConn(conn net.Conn) (*Conn, error) {
+	c := &Conn{
+		conn:         conn,
+		br:           bufio.NewReader(conn),
+		bw:           bufio.NewWriter(conn),
+		nextID:       1,
+		streams:      make(map[uint32]*stream),
+		maxFrameSize: maxFrameSize,
+		table:        hpack.NewIndexTable(4096),
+
+		window:        initialWindowSize,
+		initialWindow: initialWindowSize,
+	}
+	c.windowCond = sync.NewCond(&c.mu)
+	c.framer = h2frame.NewFramer(c.bw, c.br)
+
+	c.bw.Write(clientPreface)
+	if err := c.writeFrames(&frame{typ: settingsFrame}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	return c, nil
+}
+
+// コネクションを閉じる。処理中のリクエストはエラーとなる。
+func (c *Conn) Close() error {
+	c.fail(ErrConnClosed)
+	return c.conn.Close()
+}
+
+// 新たなリクエストに利用できるなら真を返す
+func (c *Conn) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil && c.goAway == nil
+}
+
+// HTTPリクエストを送信し、レスポンスを受信する。
+// レスポンスボディは全て受信してから返す。
+func (c *Conn) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	s := &stream{done: make(chan struct{})}
+	block := hpack.EncodeHeaderList(requestHeaders(req, len(body)))
+
+	id, err := c.startStream(s, block, len(body) == 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// リクエストボディの送信はウィンドウサイズの回復を待つ場合があるため、
+	// レスポンスの受信やキャンセルと並行して行う
+	if len(body) > 0 {
+		go func() {
+			if err := c.writeData(id, s, body); err != nil {
+				c.finish(id, err)
+			}
+		}()
+	}
+
+	select {
+	case <-s.done:
+	case <-req.Context().Done():
+		c.resetStream(id)
+		return nil, req.Context().Err()
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(s.status) + " " + http.StatusText(s.status),
+		StatusCode:    s.status,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        s.header,
+		Trailer:       s.trailer,
+		Body:          io.NopCloser(&s.body),
+		ContentLength: contentLength(req, s),
+		Request:       req,
+	}, nil
+}
+
+// レスポンスのContentLengthを返す。
+// HEADリクエストのレスポンスはボディを持たないため、net/httpと同様に
+// content-lengthヘッダーの値とし、ヘッダーが無いか不正であれば不明を表す-1とする。
+func contentLength(req *http.Request, s *stream) int64 {
+	if req.Method != http.MethodHead {
+		return int64(s.body.Len())
+	}
+
+	if cl := s.header.Get("content-length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return -1
+}
+
+// リクエストのヘッダーリストを構築する
+func requestHeaders(req *http.Request, bodyLen int) hpack.HeaderList {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	headers := hpack.HeaderList{
+		hpack.NewHeaderField(":method", method),
+		hpack.NewHeaderField(":scheme", scheme),
+		hpack.NewHeaderField(":authority", host),
+		hpack.NewHeaderField(":path", req.URL.RequestURI()),
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "host", "connection", "keep-alive", "transfer-encoding",
+			"upgrade", "proxy-connection":
+			continue
+		}
+
+		for _, value := range values {
+			headers = append(headers, hpack.NewHeaderField(name, value))
+		}
+	}
+
+	if bodyLen > 0 && req.Header.Get("content-length") == "" {
+		headers = append(headers,
+			hpack.NewHeaderField("content-length", strconv.Itoa(bodyLen)))
+	}
+
+	return headers
+}
+
+// ストリームIDを払い出し、ヘッダーブロックを送信する
+func (c *Conn) startStream(
+	s *stream,
+	block []byte,
+	endStream bool,
+) (uint32, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, c.err
+	}
+	if c.goAway != nil {
+		c.mu.Unlock()
+		return 0, c.goAway
+	}
+	id := c.nextID
+	c.nextID += 2
+	s.window = c.initialWindow
+	c.streams[id] = s
+	chunkSize := c.maxFrameSize
+	c.mu.Unlock()
+
+	// ヘッダーブロックが最大フレームサイズを超える場合はCONTINUATIONフレームで分割する
+	var frames []*frame
+	for typ := uint8(headersFrame); ; typ = continuationFrame {
+		f := &frame{typ: typ, streamID: id}
+		if len(block) > chunkSize {
+			f.payload, block = block[:chunkSize], block[chunkSize:]
+		} else {
+			f.payload, block = block, nil
+			f.flags |= eohBit
+		}
+		frames = append(frames, f)
+
+		if block == nil {
+			break
+		}
+	}
+
+	if endStream {
+		frames[0].flags |= eosBit
+	}
+
+	return id, c.writeFramesLocked(frames...)
+}
+
+// リクエストボディをDATAフレームとして送信する。
+// コネクションとストリームのウィンドウサイズが許す範囲で送信し、
+// 不足している場合はWINDOW_UPDATEフレームによる回復を待つ。
+// 送信の途中でストリームが終了した場合は残りを送信せずに処理を返す。
+func (c *Conn) writeData(id uint32, s *stream, body []byte) error {
+	for len(body) > 0 {
+		n, err := c.reserveWindow(id, s, len(body))
+		if err != nil || n == 0 {
+			return err
+		}
+
+		f := &frame{typ: dataFrame, streamID: id, payload: body[:n]}
+		if body = body[n:]; len(body) == 0 {
+			f.flags = eosBit
+		}
+
+		if err := c.writeFrames(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 最大 n バイトのDATAフレームを送信できるまで待ち、
+// 送信できるバイト数をウィンドウサイズから差し引いた上で返す。
+// ストリームが既に終了していれば0を返す。
+func (c *Conn) reserveWindow(id uint32, s *stream, n int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.streams[id] != s {
+			return 0, nil
+		}
+		if c.window > 0 && s.window > 0 {
+			break
+		}
+		c.windowCond.Wait()
+	}
+
+	avail := c.window
+	if s.window < avail {
+		avail = s.window
+	}
+	if int64(c.maxFrameSize) < avail {
+		avail = int64(c.maxFrameSize)
+	}
+	if int64(n) < avail {
+		avail = int64(n)
+	}
+
+	c.window -= avail
+	s.window -= avail
+	return int(avail), nil
+}
+
+// ストリームをRST_STREAMフレーム(CANCEL)によりキャンセルする
+func (c *Conn) resetStream(id uint32) {
+	c.mu.Lock()
+	delete(c.streams, id)
+	c.windowCond.Broadcast()
+	c.mu.Unlock()
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, 0x08)
+	c.writeFrames(&frame{typ: rstStreamFrame, streamID: id, payload: payload})
+}
+
+// フレームを送信する
+func (c *Conn) writeFrames(frames ...*frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFramesLocked(frames...)
+}
+
+// wmuを獲得した状態でフレームを送信する
+func (c *Conn) writeFramesLocked(frames ...*frame) error {
+	for _, f := range frames {
+		if err := writeFrame(c.framer, f); err != nil {
+			c.fail(err)
+			return err
+		}
+	}
+
+	if err := c.bw.Flush(); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// コネクションを利用不可能とし、処理中の全てのリクエストをエラーとする
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	for id, s := range c.streams {
+		s.err = err
+		close(s.done)
+		delete(c.streams, id)
+	}
+	c.windowCond.Broadcast()
+}
+
+// 処理中のストリームを取得する
+func (c *Conn) stream(id uint32) *stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+// ストリームのレスポンスの受信を完了させる
+func (c *Conn) finish(id uint32, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.streams[id]; ok {
+		s.err = err
+		close(s.done)
+		delete(c.streams, id)
+		c.windowCond.Broadcast()
+	}
+	c.closeIfDrained()
+}
+
+// GOAWAYフレームの受信により、新たなストリームの開始を止める。
+// 最終ストリームIDより大きいIDのストリームはサーバーに処理されないため、再送可能なエラーとする。
+// それ以下のストリームはレスポンスの受信を続ける。
+func (c *Conn) goingAway(e *GoAwayError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.goAway = e
+	for id, s := range c.streams {
+		if id > e.LastStreamID {
+			s.err = e
+			close(s.done)
+			delete(c.streams, id)
+		}
+	}
+	c.windowCond.Broadcast()
+	c.closeIfDrained()
+}
+
+// GOAWAYフレームの受信後、処理中のストリームが無くなっていれば接続を閉じる。
+// muを獲得した上で呼び出す。
+func (c *Conn) closeIfDrained() {
+	if c.goAway != nil && c.err == nil && len(c.streams) == 0 {
+		c.conn.Close()
+	}
+}
+
+// フレームを継続的に受信し、各ストリームに振り分ける
+func (c *Conn) readLoop() {
+	var headerBlock []byte // 受信中のヘッダーブロック
+	var headerFrame *frame // ヘッダーブロックを開始したHEADERSフレーム
+
+	for {
+		f, err := readFrame(c.framer)
+		if err != nil {
+			c.fail(err)
+			c.conn.Close()
+			return
+		}
+
+		switch f.typ {
+		case headersFrame, continuationFrame:
+			if f.typ == headersFrame {
+				headerFrame, headerBlock = f, nil
+			} else if headerFrame == nil || headerFrame.streamID != f.streamID {
+				c.fail(fmt.Errorf("h2client: unexpected CONTINUATION"))
+				c.conn.Close()
+				return
+			}
+
+			headerBlock = append(headerBlock, f.payload...)
+			if f.flags&eohBit == 0 {
+				continue
+			}
+
+			headers, err := hpack.DecodeHeaderBlock(c.table, headerBlock)
+			if err != nil {
+				c.fail(err)
+				c.conn.Close()
+				return
+			}
+
+			c.handleHeaders(headerFrame, headers)
+			headerFrame, headerBlock = nil, nil
+
+		case dataFrame:
+			if s := c.stream(f.streamID); s != nil {
+				s.body.Write(f.payload)
+			}
+
+			// レスポンスを受信し終えていれば、WINDOW_UPDATEフレームの送信より先に完了させる。
+			// サーバーが最後のレスポンスの送信後に接続を閉じていると、送信に失敗して
+			// 受信済みのレスポンスまでエラーとなってしまうため
+			if f.flags&eosBit > 0 {
+				c.finish(f.streamID, nil)
+			}
+
+			// 受信したDATAフレームの分だけ、コネクションとストリームの
+			// ウィンドウサイズを即座に回復させる
+			if len(f.payload) > 0 {
+				c.writeWindowUpdate(0, len(f.payload))
+				if f.flags&eosBit == 0 {
+					c.writeWindowUpdate(f.streamID, len(f.payload))
+				}
+			}
+
+		case rstStreamFrame:
+			code := uint32(0)
+			if len(f.payload) >= 4 {
+				code = binary.BigEndian.Uint32(f.payload)
+			}
+			c.finish(f.streamID, &StreamError{Code: code})
+
+		case settingsFrame:
+			if f.flags&ackBit > 0 {
+				continue
+			}
+
+			for i := 0; i+6 <= len(f.payload); i += 6 {
+				typ := binary.BigEndian.Uint16(f.payload[i:])
+				value := binary.BigEndian.Uint32(f.payload[i+2:])
+				switch typ {
+				case initialWindowSizeSetting:
+					c.changeInitialWindow(int64(value))
+				case maxFrameSizeSetting:
+					c.mu.Lock()
+					c.maxFrameSize = int(value)
+					c.mu.Unlock()
+				}
+			}
+			c.writeFrames(&frame{typ: settingsFrame, flags: ackBit})
+
+		case windowUpdateFrame:
+			if len(f.payload) != 4 {
+				c.fail(fmt.Errorf("h2client: invalid WINDOW_UPDATE"))
+				c.conn.Close()
+				return
+			}
+
+			incr := int64(binary.BigEndian.Uint32(f.payload) & 0x7FFFFFFF)
+			if err := c.incrWindow(f.streamID, incr); err != nil {
+				c.fail(err)
+				c.conn.Close()
+				return
+			}
+
+		case pingFrame:
+			if f.flags&ackBit == 0 {
+				c.writeFrames(&frame{
+					typ:     pingFrame,
+					flags:   ackBit,
+					payload: f.payload,
+				})
+			}
+
+		case goAwayFrame:
+			if len(f.payload) < 8 {
+				c.fail(fmt.Errorf("h2client: invalid GOAWAY"))
+				c.conn.Close()
+				return
+			}
+
+			c.goingAway(&GoAwayError{
+				LastStreamID: binary.BigEndian.Uint32(f.payload) & 0x7FFFFFFF,
+				Code:         binary.BigEndian.Uint32(f.payload[4:]),
+			})
+		}
+	}
+}
+
+// デコードしたヘッダーリストをストリームのレスポンスヘッダー、
+// または最終レスポンスの後であればトレーラーとして保存する
+func (c *Conn) handleHeaders(f *frame, headers hpack.HeaderList) {
+	s := c.stream(f.streamID)
+	if s == nil {
+		return
+	}
+
+	if s.gotFinal {
+		s.trailer = make(http.Header)
+		for _, hf := range headers {
+			s.trailer.Add(hf.Name(), hf.Value())
+		}
+	} else {
+		status := headers.Get(":status")
+		if status == nil {
+			c.finish(f.streamID, fmt.Errorf("h2client: missing :status"))
+			return
+		}
+
+		// 1xxの暫定レスポンスは読み捨て、最終レスポンスを待つ
+		code, err := strconv.Atoi(status.Value())
+		if err != nil || code < 100 {
+			c.finish(f.streamID, fmt.Errorf("h2client: invalid :status"))
+			return
+		}
+		if code < 200 {
+			return
+		}
+
+		s.status = code
+		s.gotFinal = true
+		s.header = make(http.Header)
+		for _, hf := range headers {
+			if !strings.HasPrefix(hf.Name(), ":") {
+				s.header.Add(hf.Name(), hf.Value())
+			}
+		}
+	}
+
+	if f.flags&eosBit > 0 {
+		c.finish(f.streamID, nil)
+	}
+}
+
+// サーバーから受信したWINDOW_UPDATEフレームによりウィンドウサイズを増加させる。
+// 増加させた結果が最大値を超える場合はエラーを返す。
+func (c *Conn) incrWindow(id uint32, incr int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	window := &c.window
+	if id != 0 {
+		s, ok := c.streams[id]
+		if !ok {
+			return nil
+		}
+		window = &s.window
+	}
+
+	if *window+incr > maxWindowSize {
+		return fmt.Errorf("h2client: window size overflow(stream=%d)", id)
+	}
+
+	*window += incr
+	c.windowCond.Broadcast()
+	return nil
+}
+
+// SETTINGSフレームによるウィンドウサイズの初期値の変更を
+// 処理中の全てのストリームのウィンドウサイズに反映させる
+func (c *Conn) changeInitialWindow(value int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delta := value - c.initialWindow
+	c.initialWindow = value
+	for _, s := range c.streams {
+		s.window += delta
+	}
+	c.windowCond.Broadcast()
+}
+
+// WINDOW_UPDATEフレームを送信する
+func (c *Conn) writeWindowUpdate(id uint32, incr int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(incr))
+	c.writeFrames(&frame{
+		typ:      windowUpdateFrame,
+		streamID: id,
+		payload:  payload,
+	})
+}
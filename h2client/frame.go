@@ -0,0 +1,72 @@
+package h2client
+
+import "github.com/murakmii/c99-minimal-h2s/h2frame"
+
+// フレームを表す構造体。
+// 読み書きはh2frameパッケージにより行い、このパッケージでは受信したフレームの解釈のみを行う。
+type frame struct {
+	typ      uint8
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+const (
+	// フレームタイプを表す定数
+	dataFrame         = 0x00
+	headersFrame      = 0x01
+	rstStreamFrame    = 0x03
+	settingsFrame     = 0x04
+	pingFrame         = 0x06
+	goAwayFrame       = 0x07
+	windowUpdateFrame = 0x08
+	continuationFrame = 0x09
+
+	// フラグの各ビット
+	eosBit      = 0x01
+	ackBit      = eosBit
+	eohBit      = 0x04
+	paddedBit   = 0x08
+	priorityBit = 0x20
+
+	// 設定の種別
+	initialWindowSizeSetting = 0x04
+	maxFrameSizeSetting      = 0x05
+
+	// フロー制御のウィンドウサイズの初期値と最大値
+	initialWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+
+	// 受信するフレームのペイロードの最大値。SETTINGSフレームでは通知しないため初期値。
+	maxFrameSize = h2frame.DefaultMaxFrameSize
+)
+
+var clientPreface = []byte(h2frame.ClientPreface)
+
+// フレームを読み込む。
+// パディングや優先度の情報は取り除いた上で返す。
+// ペイロードは次の読み込みまでしか有効でない。
+func readFrame(fr *h2frame.Framer) (*frame, error) {
+	hf, err := fr.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		typ:      uint8(hf.Type),
+		flags:    uint8(hf.Flags),
+		streamID: hf.StreamID,
+	}
+
+	if f.typ == dataFrame || f.typ == headersFrame {
+		f.payload, err = hf.HeaderBlockFragment()
+	} else {
+		f.payload = hf.Payload
+	}
+	return f, err
+}
+
+// フレームを書き出す
+func writeFrame(fr *h2frame.Framer, f *frame) error {
+	return fr.WriteRawFrame(h2frame.Type(f.typ), h2frame.Flags(f.flags), f.streamID, f.payload)
+}
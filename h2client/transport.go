@@ -0,0 +1,128 @@
+package h2client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// http.RoundTripperインターフェイスを満たす構造体。
+// 接続先毎に1つのConnを確立し、以降のリクエストではそれを再利用する。
+// http.Client.Transportに設定することで、net/httpのクライアントから利用できる。
+type Transport struct {
+	// TLSの設定。nilの場合は既定の設定を用いる。
+	TLSClientConfig *tls.Config
+
+	// nilでなければ、TLSによる接続の代わりにこれにより接続する。
+	// 返す接続はHTTP/2をそのまま送受信できる状態でなければならない。
+	DialConn func(addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// RoundTripメソッドの実装。
+// 接続先のConnが無いか、GOAWAYフレームの受信等により既に利用できなくなっていれば新たに確立する。
+// サーバーがGOAWAYフレームにより処理しないことを通知したリクエストは、新たなConnで1度だけ再送する。
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("h2client: unsupported scheme %q", req.URL.Scheme)
+	}
+
+	c, err := t.conn(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.RoundTrip(req)
+	var goAway *GoAwayError
+	if !errors.As(err, &goAway) {
+		return res, err
+	}
+
+	retry, ok := rewind(req)
+	if !ok {
+		return nil, err
+	}
+	if c, err = t.conn(req.URL.Host); err != nil {
+		return nil, err
+	}
+	return c.RoundTrip(retry)
+}
+
+// 再送のため、リクエストボディを読み直せるリクエストの複製を返す。
+// リクエストボディを読み直せなければ偽を返す。
+func rewind(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	return retry, true
+}
+
+// 接続先に対応するConnを返す
+func (t *Transport) conn(host string) (*Conn, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "443")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.conns[addr]; ok {
+		if c.usable() {
+			return c, nil
+		}
+		delete(t.conns, addr)
+	}
+
+	c, err := t.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.conns == nil {
+		t.conns = make(map[string]*Conn)
+	}
+	t.conns[addr] = c
+	return c, nil
+}
+
+func (t *Transport) dial(addr string) (*Conn, error) {
+	if t.DialConn == nil {
+		return Dial(addr, t.TLSClientConfig)
+	}
+
+	conn, err := t.DialConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn)
+}
+
+// 確立済みの全てのConnを閉じる。
+// http.Client.CloseIdleConnectionsから呼び出される。
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for addr, c := range t.conns {
+		c.Close()
+		delete(t.conns, addr)
+	}
+}
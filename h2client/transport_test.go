@@ -0,0 +1,100 @@
+package h2client
+
+import (
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// 接続 conn 上で最小限のHTTP/2サーバーとして振る舞い、
+// リクエストのHEADERSフレームを受信する度に respond を呼び出す
+func serveFake(conn net.Conn, respond func(fr *h2frame.Framer, id uint32)) {
+	defer conn.Close()
+
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return
+	}
+
+	fr := h2frame.NewFramer(conn, conn)
+	if fr.WriteSettings() != nil {
+		return
+	}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		if f.Type == h2frame.TypeHeaders {
+			respond(fr, f.StreamID)
+		}
+	}
+}
+
+// 互いに接続されたTCPの接続を返す。
+// net.Pipeと異なり書き込みがバッファリングされるため、双方が同時に書き込んでもブロックしない。
+func loopback() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := l.Accept()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// GOAWAYフレームにより処理されなかったリクエストは、新たなコネクションで再送されること
+func TestTransportRetriesAfterGoAway(t *testing.T) {
+	dialed := 0
+	tr := &Transport{
+		DialConn: func(string) (net.Conn, error) {
+			dialed++
+			client, server, err := loopback()
+			if err != nil {
+				return nil, err
+			}
+			first := dialed == 1
+			go serveFake(server, func(fr *h2frame.Framer, id uint32) {
+				if first {
+					fr.WriteGoAway(0, h2frame.ErrCodeNo, nil)
+					return
+				}
+				block := hpack.EncodeHeaderList(hpack.HeaderList{hpack.NewHeaderField(":status", "200")})
+				fr.WriteHeaders(id, false, true, block)
+				fr.WriteData(id, true, []byte("retried"))
+			})
+			return client, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "retried" {
+		t.Errorf("body is %q, want %q", body, "retried")
+	}
+	if dialed != 2 {
+		t.Errorf("dialed %d connections, want 2", dialed)
+	}
+}
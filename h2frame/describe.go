@@ -0,0 +1,139 @@
+package h2frame
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// フレームヘッダーをnghttp2の出力に倣った1行の文字列として返す
+func (f *Frame) Summary() string {
+	return fmt.Sprintf("%s frame <length=%d, flags=0x%02x, stream_id=%d>",
+		f.Type, len(f.Payload), uint8(f.Flags), f.StreamID)
+}
+
+// ペイロードをフレームタイプ毎にデコードし、人が読める形式の行として返す。
+// HEADERS, PUSH_PROMISE, CONTINUATIONフレームのヘッダーブロックの断片はHPACKの状態に依存するため、
+// デコードせずに fragment として返す。呼び出し側はEND_HEADERSフラグまで蓄積してデコードする。
+// DATAフレームのペイロードは長さのみを表す。
+func (f *Frame) Describe() (lines []string, fragment []byte, err error) {
+	line := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+	p := f.Payload
+
+	switch f.Type {
+	case TypeData:
+		p, err := f.Unpadded()
+		if err != nil {
+			return nil, nil, err
+		}
+		line("(data=%d bytes, end_stream=%t)", len(p), f.Flags.Has(FlagEndStream))
+
+	case TypeHeaders:
+		p, err := f.Unpadded()
+		if err != nil {
+			return nil, nil, err
+		}
+		if f.Flags.Has(FlagPriority) {
+			if len(p) < 5 {
+				return nil, nil, ErrInvalidPriority
+			}
+			lines = append(lines, describePriority(p[:5]))
+			p = p[5:]
+		}
+		line("(end_stream=%t, end_headers=%t)",
+			f.Flags.Has(FlagEndStream), f.Flags.Has(FlagEndHeaders))
+		return lines, p, nil
+
+	case TypePriority:
+		if len(p) != 5 {
+			return nil, nil, ErrInvalidLength
+		}
+		lines = append(lines, describePriority(p))
+
+	case TypeRSTStream:
+		code, err := f.RSTStreamCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		line("(error_code=%s)", code.Describe())
+
+	case TypeSettings:
+		settings, err := f.Settings()
+		if err != nil {
+			return nil, nil, err
+		}
+		if f.Flags.Has(FlagAck) {
+			line("; ACK")
+		}
+		for _, s := range settings {
+			line("[SETTINGS_%s:%d]", withCode(s.ID, uint32(s.ID)), s.Val)
+		}
+
+	case TypePushPromise:
+		p, err := f.Unpadded()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(p) < 4 {
+			return nil, nil, ErrInvalidLength
+		}
+		line("(promised_stream_id=%d)", binary.BigEndian.Uint32(p)&0x7FFFFFFF)
+		return lines, p[4:], nil
+
+	case TypePing:
+		if len(p) != 8 {
+			return nil, nil, ErrInvalidLength
+		}
+		line("(opaque_data=%s, ack=%t)", hex.EncodeToString(p), f.Flags.Has(FlagAck))
+
+	case TypeGoAway:
+		last, code, debug, err := f.GoAway()
+		if err != nil {
+			return nil, nil, err
+		}
+		line("(last_stream_id=%d, error_code=%s, debug_data=%q)", last, code.Describe(), debug)
+
+	case TypeWindowUpdate:
+		incr, err := f.WindowIncrement()
+		if err != nil {
+			return nil, nil, err
+		}
+		line("(window_size_increment=%d)", incr)
+
+	case TypeContinuation:
+		line("(end_headers=%t)", f.Flags.Has(FlagEndHeaders))
+		return lines, p, nil
+
+	case TypePriorityUpdate:
+		if len(p) < 4 {
+			return nil, nil, ErrInvalidLength
+		}
+		line("(prioritized_stream_id=%d, priority_field_value=%q)",
+			binary.BigEndian.Uint32(p)&0x7FFFFFFF, p[4:])
+	}
+
+	return lines, nil, nil
+}
+
+// エラーコードの名前に値を付加して返す。未知であれば名前に値が含まれる
+func (c ErrCode) Describe() string {
+	return withCode(c, uint32(c))
+}
+
+func describePriority(p []byte) string {
+	dep := binary.BigEndian.Uint32(p)
+	return fmt.Sprintf("(dep_stream_id=%d, weight=%d, exclusive=%t)",
+		dep&0x7FFFFFFF, int(p[4])+1, dep&0x80000000 != 0)
+}
+
+// 既知の名前であれば、その値を付加して返す。未知であれば名前に値が含まれる
+func withCode(name fmt.Stringer, code uint32) string {
+	s := name.String()
+	if strings.HasPrefix(s, "UNKNOWN") {
+		return s
+	}
+	return fmt.Sprintf("%s(0x%02x)", s, code)
+}
@@ -0,0 +1,214 @@
+// HTTP/2のフレームの読み書きを行うパッケージ。
+// サーバー(h2s)、クライアント(h2client)、cmdの各種ツールで共有する。
+// 不正なフレームも送信できるよう、書き込み時にはペイロードの内容を検証しない。
+package h2frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+type (
+	Type      uint8  // フレームタイプ
+	Flags     uint8  // フラグ
+	ErrCode   uint32 // RST_STREAM, GOAWAYフレームのエラーコード
+	SettingID uint16 // SETTINGSフレームの設定の種別
+
+	// SETTINGSフレームの設定1つ分
+	Setting struct {
+		ID  SettingID
+		Val uint32
+	}
+
+	// フレームを表す構造体。
+	// Payloadはパディングや優先度の情報を含む、受信したままのペイロードである。
+	Frame struct {
+		Type     Type
+		Flags    Flags
+		StreamID uint32
+		Payload  []byte
+	}
+)
+
+const (
+	TypeData         Type = 0x00
+	TypeHeaders      Type = 0x01
+	TypePriority     Type = 0x02
+	TypeRSTStream    Type = 0x03
+	TypeSettings     Type = 0x04
+	TypePushPromise  Type = 0x05
+	TypePing         Type = 0x06
+	TypeGoAway       Type = 0x07
+	TypeWindowUpdate Type = 0x08
+	TypeContinuation Type = 0x09
+
+	TypePriorityUpdate Type = 0x10 // RFC 9218
+)
+
+const (
+	FlagEndStream  Flags = 0x01
+	FlagAck        Flags = 0x01
+	FlagEndHeaders Flags = 0x04
+	FlagPadded     Flags = 0x08
+	FlagPriority   Flags = 0x20
+)
+
+const (
+	ErrCodeNo                 ErrCode = 0x00
+	ErrCodeProtocol           ErrCode = 0x01
+	ErrCodeInternal           ErrCode = 0x02
+	ErrCodeFlowControl        ErrCode = 0x03
+	ErrCodeSettingsTimeout    ErrCode = 0x04
+	ErrCodeStreamClosed       ErrCode = 0x05
+	ErrCodeFrameSize          ErrCode = 0x06
+	ErrCodeRefusedStream      ErrCode = 0x07
+	ErrCodeCancel             ErrCode = 0x08
+	ErrCodeCompression        ErrCode = 0x09
+	ErrCodeConnect            ErrCode = 0x0a
+	ErrCodeEnhanceYourCalm    ErrCode = 0x0b
+	ErrCodeInadequateSecurity ErrCode = 0x0c
+	ErrCodeHTTP11Required     ErrCode = 0x0d
+)
+
+const (
+	SettingHeaderTableSize      SettingID = 0x01
+	SettingEnablePush           SettingID = 0x02
+	SettingMaxConcurrentStreams SettingID = 0x03
+	SettingInitialWindowSize    SettingID = 0x04
+	SettingMaxFrameSize         SettingID = 0x05
+	SettingMaxHeaderListSize    SettingID = 0x06
+
+	SettingNoRFC7540Priorities SettingID = 0x09 // RFC 9218
+)
+
+var (
+	typeNames = []string{
+		"DATA", "HEADERS", "PRIORITY", "RST_STREAM", "SETTINGS",
+		"PUSH_PROMISE", "PING", "GOAWAY", "WINDOW_UPDATE", "CONTINUATION",
+	}
+
+	errCodeNames = []string{
+		"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+		"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+		"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+		"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+	}
+
+	settingNames = map[SettingID]string{
+		SettingHeaderTableSize:      "HEADER_TABLE_SIZE",
+		SettingEnablePush:           "ENABLE_PUSH",
+		SettingMaxConcurrentStreams: "MAX_CONCURRENT_STREAMS",
+		SettingInitialWindowSize:    "INITIAL_WINDOW_SIZE",
+		SettingMaxFrameSize:         "MAX_FRAME_SIZE",
+		SettingMaxHeaderListSize:    "MAX_HEADER_LIST_SIZE",
+		SettingNoRFC7540Priorities:  "NO_RFC7540_PRIORITIES",
+	}
+)
+
+// ペイロードの長さや内容が不正な場合に返すエラー
+var (
+	ErrInvalidPadding  = errors.New("h2frame: invalid padding")
+	ErrInvalidPriority = errors.New("h2frame: invalid priority")
+	ErrInvalidLength   = errors.New("h2frame: invalid payload length")
+)
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	if t == TypePriorityUpdate {
+		return "PRIORITY_UPDATE"
+	}
+	return fmt.Sprintf("UNKNOWN(0x%02x)", uint8(t))
+}
+
+func (c ErrCode) String() string {
+	if int(c) < len(errCodeNames) {
+		return errCodeNames[c]
+	}
+	return fmt.Sprintf("UNKNOWN(0x%02x)", uint32(c))
+}
+
+func (id SettingID) String() string {
+	if name, ok := settingNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(0x%02x)", uint16(id))
+}
+
+// 全てのビットが立っていれば真を返す
+func (f Flags) Has(v Flags) bool {
+	return f&v == v
+}
+
+// DATA, HEADERS, PUSH_PROMISEフレームのパディングを取り除いたペイロードを返す
+func (f *Frame) Unpadded() ([]byte, error) {
+	if !f.Flags.Has(FlagPadded) ||
+		(f.Type != TypeData && f.Type != TypeHeaders && f.Type != TypePushPromise) {
+		return f.Payload, nil
+	}
+
+	if len(f.Payload) == 0 || int(f.Payload[0]) >= len(f.Payload) {
+		return nil, ErrInvalidPadding
+	}
+	return f.Payload[1 : len(f.Payload)-int(f.Payload[0])], nil
+}
+
+// HEADERSフレームのパディングと優先度の情報を取り除き、ヘッダーブロックの断片を返す。
+// CONTINUATIONフレームならペイロードをそのまま返す。
+func (f *Frame) HeaderBlockFragment() ([]byte, error) {
+	p, err := f.Unpadded()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Type == TypeHeaders && f.Flags.Has(FlagPriority) {
+		if len(p) < 5 {
+			return nil, ErrInvalidPriority
+		}
+		p = p[5:]
+	}
+	return p, nil
+}
+
+// SETTINGSフレームの設定を返す
+func (f *Frame) Settings() ([]Setting, error) {
+	if len(f.Payload)%6 != 0 {
+		return nil, ErrInvalidLength
+	}
+
+	settings := make([]Setting, 0, len(f.Payload)/6)
+	for p := f.Payload; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(p)),
+			Val: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+// RST_STREAMフレームのエラーコードを返す
+func (f *Frame) RSTStreamCode() (ErrCode, error) {
+	if len(f.Payload) != 4 {
+		return 0, ErrInvalidLength
+	}
+	return ErrCode(binary.BigEndian.Uint32(f.Payload)), nil
+}
+
+// GOAWAYフレームの最終ストリームID、エラーコード、デバッグデータを返す
+func (f *Frame) GoAway() (uint32, ErrCode, []byte, error) {
+	if len(f.Payload) < 8 {
+		return 0, 0, nil, ErrInvalidLength
+	}
+	return binary.BigEndian.Uint32(f.Payload) & 0x7FFFFFFF,
+		ErrCode(binary.BigEndian.Uint32(f.Payload[4:])), f.Payload[8:], nil
+}
+
+// WINDOW_UPDATEフレームのウィンドウサイズの増分を返す
+func (f *Frame) WindowIncrement() (uint32, error) {
+	if len(f.Payload) != 4 {
+		return 0, ErrInvalidLength
+	}
+	return binary.BigEndian.Uint32(f.Payload) & 0x7FFFFFFF, nil
+}
@@ -0,0 +1,215 @@
+package h2frame
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// フレームヘッダーの長さ
+	HeaderLen = 9
+
+	// SETTINGS_MAX_FRAME_SIZEの初期値と、設定可能な最大値
+	DefaultMaxFrameSize = 16384
+	MaxAllowedFrameSize = 1<<24 - 1
+
+	// クライアントが最初に送信するコネクションプリフェイス
+	ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+)
+
+// 受信したフレームのペイロード長が上限を超えている場合に返すエラー。
+// HTTP/2ではFRAME_SIZE_ERRORとして扱う。
+type FrameSizeError struct {
+	Len int
+	Max int
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("h2frame: too large payload(%d bytes, max %d bytes)", e.Len, e.Max)
+}
+
+// フレームを読み書きする構造体。
+// 読み込みに用いるバッファはフレーム毎に再利用するため、
+// ReadFrameメソッドが返したフレームのペイロードは次の呼び出しまでしか有効でない。
+// 書き込みはフレーム毎に出力先へ書き出すのみで、バッファリングは呼び出し側で行う。
+// 読み込みと書き込みはそれぞれ別のゴルーチンから並行して行えるが、
+// 複数のゴルーチンからの書き込みの排他制御は呼び出し側で行う。
+type Framer struct {
+	r       io.Reader
+	w       io.Writer
+	maxRead int
+
+	rheader []byte
+	rbuf    []byte
+	wheader []byte
+}
+
+// 出力先 w と読み込み先 r を指定してFramerを生成する。
+// 読み書きの一方のみを行う場合、他方はnilで構わない。
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{
+		r:       r,
+		w:       w,
+		maxRead: DefaultMaxFrameSize,
+		rheader: make([]byte, HeaderLen),
+		wheader: make([]byte, HeaderLen),
+	}
+}
+
+// 受信するフレームのペイロード長の上限を設定する。既定値はDefaultMaxFrameSize。
+func (fr *Framer) SetMaxReadFrameSize(n int) {
+	if n > MaxAllowedFrameSize {
+		n = MaxAllowedFrameSize
+	}
+	fr.maxRead = n
+}
+
+// 読み込みに用いるバッファの容量が size を超えていれば解放する。
+// 大きなフレームを受信した後にメモリ使用量を抑えるために用いる。
+func (fr *Framer) ShrinkReadBuffer(size int) {
+	if cap(fr.rbuf) > size {
+		fr.rbuf = nil
+	}
+}
+
+// フレームを1つ読み込む。まずヘッダーを読み込み、
+// そこから得られたペイロード長を元にペイロードを追加で読み込む。
+// ペイロード長が上限を超える場合は*FrameSizeErrorを返す。
+// ストリームIDの予約ビットは無視する。
+func (fr *Framer) ReadFrame() (*Frame, error) {
+	header := fr.rheader
+	if _, err := io.ReadFull(fr.r, header); err != nil {
+		return nil, err
+	}
+
+	f := &Frame{
+		Type:     Type(header[3]),
+		Flags:    Flags(header[4]),
+		StreamID: binary.BigEndian.Uint32(header[5:]) & 0x7FFFFFFF,
+	}
+
+	pLen := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	if pLen > fr.maxRead {
+		return nil, &FrameSizeError{Len: pLen, Max: fr.maxRead}
+	}
+
+	// バッファが不足する場合のみ拡張する
+	if cap(fr.rbuf) < pLen {
+		fr.rbuf = make([]byte, pLen)
+	}
+
+	f.Payload = fr.rbuf[:pLen]
+	if _, err := io.ReadFull(fr.r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// 任意のフレームを書き出す。内容は検証しない。
+func (fr *Framer) WriteRawFrame(t Type, flags Flags, streamID uint32, payload []byte) error {
+	pLen := len(payload)
+	header := fr.wheader
+
+	header[0] = byte((pLen >> 16) & 0xFF)
+	header[1] = byte((pLen >> 8) & 0xFF)
+	header[2] = byte(pLen & 0xFF)
+	header[3] = byte(t)
+	header[4] = byte(flags)
+	binary.BigEndian.PutUint32(header[5:], streamID)
+
+	if _, err := fr.w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := fr.w.Write(payload)
+	return err
+}
+
+func (fr *Framer) WriteData(streamID uint32, endStream bool, data []byte) error {
+	return fr.WriteRawFrame(TypeData, endStreamFlag(endStream), streamID, data)
+}
+
+// HEADERSフレームを書き出す。
+// ヘッダーブロックが最大フレームサイズを超える場合の分割は呼び出し側で行い、
+// 後続はWriteContinuationメソッドにより書き出す。
+func (fr *Framer) WriteHeaders(streamID uint32, endStream, endHeaders bool, block []byte) error {
+	flags := endStreamFlag(endStream)
+	if endHeaders {
+		flags |= FlagEndHeaders
+	}
+	return fr.WriteRawFrame(TypeHeaders, flags, streamID, block)
+}
+
+func (fr *Framer) WriteContinuation(streamID uint32, endHeaders bool, block []byte) error {
+	var flags Flags
+	if endHeaders {
+		flags = FlagEndHeaders
+	}
+	return fr.WriteRawFrame(TypeContinuation, flags, streamID, block)
+}
+
+func (fr *Framer) WritePriority(streamID, dependency uint32, exclusive bool, weight uint8) error {
+	payload := make([]byte, 5)
+	if exclusive {
+		dependency |= 0x80000000
+	}
+	binary.BigEndian.PutUint32(payload, dependency)
+	payload[4] = weight
+	return fr.WriteRawFrame(TypePriority, 0, streamID, payload)
+}
+
+func (fr *Framer) WriteRSTStream(streamID uint32, code ErrCode) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(code))
+	return fr.WriteRawFrame(TypeRSTStream, 0, streamID, payload)
+}
+
+func (fr *Framer) WriteSettings(settings ...Setting) error {
+	return fr.WriteRawFrame(TypeSettings, 0, 0, EncodeSettings(settings))
+}
+
+func (fr *Framer) WriteSettingsAck() error {
+	return fr.WriteRawFrame(TypeSettings, FlagAck, 0, nil)
+}
+
+func (fr *Framer) WritePing(ack bool, data [8]byte) error {
+	var flags Flags
+	if ack {
+		flags = FlagAck
+	}
+	return fr.WriteRawFrame(TypePing, flags, 0, data[:])
+}
+
+func (fr *Framer) WriteGoAway(lastStreamID uint32, code ErrCode, debugData []byte) error {
+	payload := make([]byte, 8, 8+len(debugData))
+	binary.BigEndian.PutUint32(payload, lastStreamID)
+	binary.BigEndian.PutUint32(payload[4:], uint32(code))
+	return fr.WriteRawFrame(TypeGoAway, 0, 0, append(payload, debugData...))
+}
+
+func (fr *Framer) WriteWindowUpdate(streamID, increment uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	return fr.WriteRawFrame(TypeWindowUpdate, 0, streamID, payload)
+}
+
+// SETTINGSフレームのペイロードを生成する
+func EncodeSettings(settings []Setting) []byte {
+	payload := make([]byte, 6*len(settings))
+	for i, s := range settings {
+		binary.BigEndian.PutUint16(payload[6*i:], uint16(s.ID))
+		binary.BigEndian.PutUint32(payload[6*i+2:], s.Val)
+	}
+	return payload
+}
+
+func endStreamFlag(endStream bool) Flags {
+	if endStream {
+		return FlagEndStream
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package h2s
+
+import "time"
+
+type (
+	// ストリームの処理の概要。ストリーム毎のリクエストハンドラーの終了後、Server.AccessLogに渡す
+	AccessLogEntry struct {
+		RemoteAddr string
+		StreamID   uint32
+		Method     string
+		Path       string // :path疑似ヘッダーの値。CONNECTメソッドなら:authorityの値
+		Authority  string
+		Status     int // 送信したステータスコード。レスポンスを送信しなかった場合は0
+
+		// 受信したリクエストボディと、リクエストハンドラーが書き込んだレスポンスボディのバイト数
+		BytesRead    int64
+		BytesWritten int64
+
+		Start       time.Time     // リクエストハンドラーの起動を指示した時刻
+		Duration    time.Duration // Startから、レスポンスの送信を終えるかストリームが閉じられるまでの時間
+		Termination Termination
+	}
+
+	// ストリームが終了した理由
+	Termination string
+)
+
+const (
+	TerminationNormal  Termination = "normal"  // レスポンスを送信して終了した
+	TerminationReset   Termination = "reset"   // RST_STREAMフレームによりストリームが閉じられた
+	TerminationGoAway  Termination = "goaway"  // レスポンスを送信し終える前にコネクションが閉じられた
+	TerminationPanic   Termination = "panic"   // リクエストハンドラーがパニックにより中断した
+	TerminationTimeout Termination = "timeout" // リクエストハンドラーが実行時間の上限を超えた
+)
+
+// レスポンスの送信を終えた時点で、Server.Tracerのスパンを終了させ、Server.AccessLogを呼び出す。
+// last が非nilなら、それがピアへ送信されるか接続が閉じられた時点を送信の終了とする。
+// err はレスポンスを送信しなかった理由であり、termination と共に通知する。
+func (mp *multiplexer) finishStream(res *responseWriter, last *frame, termination Termination, err error) {
+	span := res.span
+	accessLog := mp.server.AccessLog
+	if span == nil && accessLog == nil {
+		return
+	}
+
+	entry := AccessLogEntry{
+		RemoteAddr:   mp.conn.nc.RemoteAddr().String(),
+		StreamID:     uint32(res.id),
+		Method:       res.method,
+		Path:         res.path,
+		Authority:    res.authority,
+		BytesRead:    res.bytesRead,
+		BytesWritten: res.bytesWritten,
+		Start:        res.dispatched,
+		Termination:  termination,
+	}
+	if res.tunnel != nil {
+		entry.BytesRead += res.tunnel.received()
+	}
+	if err == nil {
+		entry.Status = res.statusCode
+	}
+
+	finish := func() {
+		if span != nil {
+			span.End(entry.Status, err)
+		}
+		if accessLog != nil {
+			entry.Duration = mp.server.clock().Now().Sub(entry.Start)
+			accessLog(entry)
+		}
+	}
+
+	if last == nil {
+		finish()
+		return
+	}
+
+	written := make(chan struct{})
+	last.written = written
+	done := mp.writer.done
+	go func() {
+		select {
+		case <-written:
+			if last.discarded {
+				entry.Termination = TerminationGoAway
+			}
+		case <-done:
+			entry.Termination = TerminationGoAway
+		}
+		finish()
+	}()
+}
@@ -0,0 +1,104 @@
+package h2s
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Server.CaptureDirによる、コネクション毎に送受信したバイト列の記録。
+// 受信したバイト列はコネクションプリフェイスから始まり、h2stest.Server.Replayメソッドにより
+// 同じ順序でサーバーに与え直すことができる。いずれもcmdのdecodeサブコマンドでデコードできる。
+// 書き込みに失敗した方向は、ログを出力して以降は記録しない。
+type capture struct {
+	logger logger
+
+	mu   sync.Mutex
+	recv *os.File
+	send *os.File
+}
+
+// 受信、送信したバイト列を記録するファイル名の接尾辞
+const (
+	captureRecvSuffix = ".recv"
+	captureSendSuffix = ".send"
+)
+
+// コネクション cs のバイト列を記録するcaptureを生成する。
+// Server.CaptureDirが空か、ファイルを作成できなければnilを返す。
+func newCapture(server *Server, logger logger, cs *connState) *capture {
+	dir := server.CaptureDir
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.error("failed to create capture directory: %s", err)
+		return nil
+	}
+
+	// 接続の開始時刻とコネクションの識別子により、再起動を跨いでも一意なファイル名とする
+	base := filepath.Join(dir, fmt.Sprintf("%s-%d", cs.since.Format("20060102-150405"), cs.id))
+	recv, err := os.Create(base + captureRecvSuffix)
+	if err != nil {
+		logger.error("failed to create capture: %s", err)
+		return nil
+	}
+	send, err := os.Create(base + captureSendSuffix)
+	if err != nil {
+		logger.error("failed to create capture: %s", err)
+		recv.Close()
+		os.Remove(recv.Name())
+		return nil
+	}
+
+	logger.debug("capture connection to %s.{recv,send}", base)
+	return &capture{logger: logger, recv: recv, send: send}
+}
+
+// 受信したバイト列を記録する。nilのcaptureに対しては何もしない
+func (c *capture) received(b []byte) {
+	if c != nil && len(b) > 0 {
+		c.mu.Lock()
+		c.recv = c.write(c.recv, b)
+		c.mu.Unlock()
+	}
+}
+
+// 送信したバイト列を記録する。nilのcaptureに対しては何もしない
+func (c *capture) sent(b []byte) {
+	if c != nil && len(b) > 0 {
+		c.mu.Lock()
+		c.send = c.write(c.send, b)
+		c.mu.Unlock()
+	}
+}
+
+// f に b を書き込む。失敗すればファイルを閉じてnilを返す
+func (c *capture) write(f *os.File, b []byte) *os.File {
+	if f == nil {
+		return nil
+	}
+	if _, err := f.Write(b); err != nil {
+		c.logger.error("failed to write capture: %s", err)
+		f.Close()
+		return nil
+	}
+	return f
+}
+
+// 記録を終える。以降に送受信したバイト列は記録しない
+func (c *capture) close() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range []*os.File{c.recv, c.send} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	c.recv, c.send = nil, nil
+}
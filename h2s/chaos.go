@@ -0,0 +1,220 @@
+package h2s
+
+import (
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 送信するフレームに意図的に障害を発生させる設定。
+// クライアント実装の堅牢性を検査するために、以下のようにServer.Interceptorに設定して用いる。
+//
+//	sv.Interceptor = (&h2s.Chaos{DelayProbability: 0.1, MaxDelay: 50 * time.Millisecond}).Interceptor
+//
+// 各確率は0から1の範囲で、フレーム毎に独立して判定する。
+// 遅延、順序の入れ替え、ストリームのリセットはHTTP/2として正当な範囲で行うが、
+// 切り詰めと破損はクライアントから見て不正なレスポンスやプロトコルエラーとなり得る。
+type Chaos struct {
+	// 乱数のシード。0なら時刻を用いる。
+	// 0以外ならコネクション毎に、受け入れた順に異なるが再現可能なシードを用いる。
+	Seed int64
+
+	// フレームの送信前にMaxDelayまでのランダムな時間だけ待機する確率。
+	// 待機中は後続のフレームの送信も遅延する。
+	DelayProbability float64
+	MaxDelay         time.Duration
+
+	// 遅延に用いるClock。nilならtimeパッケージを用いる
+	Clock Clock
+
+	// DATAフレームの送信を保留し、他のストリームのフレームの後に送信する確率。
+	// 同じストリームのフレームの順序や、ヘッダーブロックの連続性は保たれる。
+	ReorderProbability float64
+
+	// DATAフレームのペイロードの末尾を切り詰める確率。
+	// フロー制御に影響しないよう、取り除いた分はパディングとする。
+	TruncateProbability float64
+
+	// フレームのペイロードの1バイトをランダムな値に書き換える確率
+	CorruptProbability float64
+
+	// DATAフレームの代わりにRST_STREAMフレームを送信し、ストリームをリセットする確率。
+	// 以降、そのストリームのDATAフレームは送信せず、その分のウィンドウサイズは戻す。
+	// トレーラーのヘッダーブロックはHPACKの状態を同期させるため送信する。
+	ResetProbability float64
+
+	conns int64 // 生成したFrameInterceptorの数
+}
+
+// フレームの送信を保留、破棄するFrameInterceptor。
+// writerコンポーネントはバッファを送信する前に保留中のフレームを書き出し、
+// 破棄されたDATAフレームの分のウィンドウサイズを戻す。
+type shapingInterceptor interface {
+	FrameInterceptor
+
+	// 保留中のフレームがあれば真を返す
+	holding() bool
+
+	// 保留中のフレームを返し、保留を解除する
+	release() []*h2frame.Frame
+
+	// 前回の呼び出し以降に、与えられたDATAフレームを破棄した場合はそのペイロード長を返す。
+	// ピアはこれをフロー制御において計上しないため、コネクションのウィンドウサイズに戻す必要がある。
+	discarded() int
+}
+
+// Chaosによりフレームに障害を発生させるFrameInterceptor
+type chaosInterceptor struct {
+	c             *Chaos
+	rand          *rand.Rand
+	held          *h2frame.Frame      // 順序を入れ替えるため保留中のDATAフレーム
+	inHeaderBlock bool                // ヘッダーブロックの途中なら真
+	reset         map[uint32]struct{} // リセットしたストリーム
+	dropped       int                 // 破棄したDATAフレームのペイロード長の合計
+}
+
+var _ shapingInterceptor = (*chaosInterceptor)(nil)
+
+// コネクションに対するFrameInterceptorを生成する。Server.Interceptorに設定して用いる。
+func (c *Chaos) Interceptor(net.Conn) FrameInterceptor {
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	seed += atomic.AddInt64(&c.conns, 1)
+
+	return &chaosInterceptor{
+		c:     c,
+		rand:  rand.New(rand.NewSource(seed)),
+		reset: make(map[uint32]struct{}),
+	}
+}
+
+func (ci *chaosInterceptor) InterceptRead(f *h2frame.Frame) []*h2frame.Frame {
+	return []*h2frame.Frame{f}
+}
+
+func (ci *chaosInterceptor) InterceptWrite(f *h2frame.Frame) []*h2frame.Frame {
+	if ci.roll(ci.c.DelayProbability) && ci.c.MaxDelay > 0 {
+		ci.sleep(time.Duration(ci.rand.Int63n(int64(ci.c.MaxDelay))))
+	}
+
+	if f.Type == h2frame.TypeData {
+		if _, ok := ci.reset[f.StreamID]; ok {
+			ci.dropped += len(f.Payload)
+			return ci.release()
+		}
+
+		if ci.roll(ci.c.ResetProbability) {
+			ci.reset[f.StreamID] = struct{}{}
+			ci.dropped += len(f.Payload)
+			return append(ci.release(), chaosResetFrame(f.StreamID))
+		}
+	}
+
+	if f.Type == h2frame.TypeData && len(f.Payload) > 0 && ci.roll(ci.c.TruncateProbability) {
+		f.Payload = ci.truncate(f.Payload)
+		f.Flags |= h2frame.FlagPadded
+	}
+
+	// ペイロードはwriterコンポーネントが再利用し得るため、書き換える場合は複製する
+
+	if len(f.Payload) > 0 && ci.roll(ci.c.CorruptProbability) {
+		f.Payload = append([]byte(nil), f.Payload...)
+		f.Payload[ci.rand.Intn(len(f.Payload))] = byte(ci.rand.Intn(256))
+	}
+
+	return ci.reorder(f)
+}
+
+// DATAフレームのペイロードの末尾の最大256バイトを取り除き、パディングに置き換える。
+// フロー制御においてはパディングも計上されるため、ペイロード長は変えない。
+func (ci *chaosInterceptor) truncate(data []byte) []byte {
+	cut := 256
+	if len(data) < cut {
+		cut = len(data)
+	}
+	cut = 1 + ci.rand.Intn(cut)
+
+	p := make([]byte, len(data))
+	p[0] = byte(cut - 1)
+	copy(p[1:], data[:len(data)-cut])
+	return p
+}
+
+// 保留中のフレームと f を、順序を入れ替えられる場合は入れ替えて返す。
+// f がDATAフレームであれば保留する場合がある。
+func (ci *chaosInterceptor) reorder(f *h2frame.Frame) []*h2frame.Frame {
+	if f.Type == h2frame.TypeHeaders || f.Type == h2frame.TypeContinuation {
+		ci.inHeaderBlock = !f.Flags.Has(h2frame.FlagEndHeaders)
+	}
+
+	if ci.held == nil {
+		if f.Type == h2frame.TypeData && ci.roll(ci.c.ReorderProbability) {
+			ci.held = &h2frame.Frame{
+				Type:     f.Type,
+				Flags:    f.Flags,
+				StreamID: f.StreamID,
+				Payload:  append([]byte(nil), f.Payload...),
+			}
+			return nil
+		}
+		return []*h2frame.Frame{f}
+	}
+
+	// 同じストリームやコネクションに対するフレームは、保留中のフレームより後に送信する
+	if f.StreamID == 0 || f.StreamID == ci.held.StreamID {
+		return append(ci.release(), f)
+	}
+
+	// ヘッダーブロックの途中には他のフレームを挟めないため、完結するまで保留する
+	if ci.inHeaderBlock {
+		return []*h2frame.Frame{f}
+	}
+	return append([]*h2frame.Frame{f}, ci.release()...)
+}
+
+func (ci *chaosInterceptor) discarded() int {
+	n := ci.dropped
+	ci.dropped = 0
+	return n
+}
+
+func (ci *chaosInterceptor) holding() bool {
+	return ci.held != nil
+}
+
+func (ci *chaosInterceptor) release() []*h2frame.Frame {
+	if ci.held == nil {
+		return nil
+	}
+
+	held := ci.held
+	ci.held = nil
+	return []*h2frame.Frame{held}
+}
+
+// d だけ待機する
+func (ci *chaosInterceptor) sleep(d time.Duration) {
+	clock := ci.c.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	<-clock.NewTimer(d).C()
+}
+
+// 確率 p で真を返す
+func (ci *chaosInterceptor) roll(p float64) bool {
+	return p > 0 && ci.rand.Float64() < p
+}
+
+// ストリームをリセットするRST_STREAMフレームを生成する
+func chaosResetFrame(id uint32) *h2frame.Frame {
+	return &h2frame.Frame{
+		Type:     h2frame.TypeRSTStream,
+		StreamID: id,
+		Payload:  []byte{0, 0, 0, byte(h2frame.ErrCodeInternal)},
+	}
+}
@@ -0,0 +1,61 @@
+package h2s
+
+import "time"
+
+type (
+	// 時刻の取得とタイマーの生成を抽象化するインターフェイス。
+	// Server.Clockに設定すると、タイムアウトや送信の遅延等の時間に基づく処理はこれを用いる。
+	// テストで時刻を任意に進めるために用いる。
+	Clock interface {
+		Now() time.Time
+
+		// time.NewTimer, time.AfterFuncに相当するタイマーを生成する
+		NewTimer(d time.Duration) Timer
+		AfterFunc(d time.Duration, f func()) Timer
+	}
+
+	// Clockが生成するタイマー
+	Timer interface {
+		// 発火時に時刻が送信されるチャネル。AfterFuncにより生成した場合はnil
+		C() <-chan time.Time
+
+		// タイマーを停止する。発火前に停止できた場合は真を返す
+		Stop() bool
+
+		// 現在時刻から d の経過後に発火するよう再設定する
+		Reset(d time.Duration) bool
+	}
+
+	// timeパッケージによるClock。Server.Clockが未設定の場合に用いる。
+	realClock struct{}
+
+	realTimer struct {
+		*time.Timer
+	}
+)
+
+var _ Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// 時刻の取得等に用いるClockを返す。未設定ならtimeパッケージを用いる。
+func (sv *Server) clock() Clock {
+	if sv.Clock == nil {
+		return realClock{}
+	}
+	return sv.Clock
+}
@@ -0,0 +1,68 @@
+package h2s
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// リクエストを受信したコネクションを、リクエストハンドラーやミドルウェアから操作するための値。
+// ConnFromContext関数によりリクエストのコンテキストから取得する。
+type Conn struct {
+	mp     *multiplexer
+	nc     net.Conn
+	cancel context.CancelFunc
+}
+
+// コンテキストにConnを保持するためのキー
+type connContextKey struct{}
+
+// リクエストのコンテキストから、そのリクエストを受信したコネクションを返す。
+// このパッケージのサーバーが受信したリクエストでなければnilを返す。
+func ConnFromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connContextKey{}).(*Conn)
+	return c
+}
+
+// コネクションを穏やかに終了させる。
+// reason をデバッグデータとするGOAWAYフレームを送信して新たなストリームを拒否させ、
+// このメソッドを呼び出したリクエストを含む処理中のストリームが全て完了した後に接続を閉じる。
+// セッションの偏りの是正や認証の失効により、クライアントに再接続させるために用いる。
+// 既に終了の途中であれば何もしない。
+func (c *Conn) Drain(reason string) {
+	c.mp.drain(reason)
+}
+
+// クライアントがSETTINGSフレームにより通知した現在の設定を返す
+func (c *Conn) PeerSettings() PeerSettings {
+	c.mp.mu.Lock()
+	defer c.mp.mu.Unlock()
+	return c.mp.peerSettings
+}
+
+// コネクションがGOAWAYフレームにより閉じられていれば、その内容を*ConnectionErrorとして返す。
+// サーバーが送信したものとクライアントから受信したもののうち、先のものを返す。
+// リクエストのコンテキストが終了した後に、その理由を確認するために用いる。
+// GOAWAYフレームを送受信せずに閉じられた場合や、まだ閉じられていない場合はnilを返す。
+func (c *Conn) Err() error {
+	if e := c.mp.writer.connError(); e != nil {
+		return e
+	}
+	return nil
+}
+
+// コネクションを直ちに閉じる。
+// コネクションのコンテキストを終了させるため、処理中のリクエストのコンテキストも終了し、
+// リクエストハンドラーの終了を待たずにコネクションの各コンポーネントが終了する。
+// レスポンスを送信し終えていないストリームはそのまま中断される。
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.nc.Close()
+}
+
+// コネクションのコンテキストから派生させ、Connを保持させたコンテキストを持つリクエストと、
+// そのコンテキストを終了させる関数を返す。ストリームが閉じられた場合に呼び出す。
+func (c *Conn) withContext(req *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithValue(c.mp.ctx, connContextKey{}, c))
+	return req.WithContext(ctx), cancel
+}
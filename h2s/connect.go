@@ -0,0 +1,115 @@
+package h2s
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// CONNECTメソッドのストリームによるトンネル。
+//
+// 通常のリクエストと異なり、CONNECTメソッドのリクエストハンドラーはHEADERSフレームを受信した時点で起動する。
+// クライアントから受信したDATAフレームのペイロードはリクエストボディ(このトンネル)から順に読み出せ、
+// クライアントがEND_STREAMフラグによりストリームを閉じるとio.EOFを返す。
+// リクエストハンドラーがhttp.ResponseWriterに書き込んだ内容は、Flushメソッドを呼び出した場合と同様に直ちに送信する。
+// リクエストハンドラーの終了はトンネルの終了としてEND_STREAMフラグにより伝え、
+// クライアントがRST_STREAMフレームによりストリームを閉じた場合は、読み書きがStreamErrorを返す。
+type tunnel struct {
+	mem *connMemory
+
+	// 受信したがまだ読み出されていないペイロードと、読み出しの終端を表すエラー。
+	// multiplexerコンポーネントが追加し、リクエストハンドラーが読み出すためmuにより保護する。
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	err    error
+	closed bool  // Closeメソッドが呼び出された
+	total  int64 // 受信したペイロードの合計バイト数
+}
+
+var _ io.ReadCloser = (*tunnel)(nil)
+
+// リクエストハンドラーがリクエストボディを閉じた後の読み出しが返すエラー
+var errTunnelClosed = errors.New("h2s: read on closed tunnel")
+
+// トンネルを生成する。受信したペイロードは mem により計上する。
+// ctx はリクエストのコンテキストであり、それが終了した時点で読み出しを終端させる。
+func newTunnel(ctx context.Context, mem *connMemory) *tunnel {
+	t := &tunnel{mem: mem}
+	t.cond = sync.NewCond(&t.mu)
+
+	go func() {
+		<-ctx.Done()
+		t.finish(ctx.Err())
+	}()
+	return t
+}
+
+// クライアントから受信したペイロードを追加する。
+// ペイロードは読み込みバッファを参照しているため複製して保持する。
+func (t *tunnel) push(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || t.err != nil {
+		return
+	}
+	t.buf = append(t.buf, p...)
+	t.total += int64(len(p))
+	t.mem.add(len(p))
+	t.cond.Broadcast()
+}
+
+// 読み出しの終端を設定する。最初に設定したもののみ有効。
+// 未読のペイロードは、それを読み出した後に err を返す。
+func (t *tunnel) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+	t.cond.Broadcast()
+}
+
+// リクエストボディとしての読み出し
+func (t *tunnel) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.buf) == 0 && t.err == nil && !t.closed {
+		t.cond.Wait()
+	}
+
+	switch {
+	case t.closed:
+		return 0, errTunnelClosed
+	case len(t.buf) == 0:
+		return 0, t.err
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	t.mem.add(-n)
+	return n, nil
+}
+
+// 未読のペイロードを破棄し、以降受信したペイロードも破棄する
+func (t *tunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	t.mem.add(-len(t.buf))
+	t.buf = nil
+	t.cond.Broadcast()
+	return nil
+}
+
+// 受信したペイロードの合計バイト数を返す
+func (t *tunnel) received() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
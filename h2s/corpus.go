@@ -0,0 +1,116 @@
+package h2s
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 受信したヘッダーブロックとフレーム列を、ファジングのコーパスとして保存する構造体。
+// 内容のSHA-1をファイル名とし、同じ内容は1度だけ保存する。
+// 保存した合計サイズが上限に達した以降は何も保存しない。
+type corpus struct {
+	dir string
+	max int64
+	log Logger
+
+	mu   sync.Mutex
+	size int64
+	seen map[[sha1.Size]byte]struct{}
+}
+
+const (
+	// コーパスの種別毎のサブディレクトリ名
+	corpusHPACK  = "hpack"  // HPACKのデコーダーのためのヘッダーブロック
+	corpusFrames = "frames" // フレームのパーサーのためのフレーム列
+
+	// コーパスの1ファイルあたりのサイズの上限。
+	// フレーム列はこれを超えないフレームまでを保存する。
+	maxCorpusEntrySize = 64 << 10
+
+	// Server.MaxCorpusBytesの既定値
+	defaultMaxCorpusBytes = 64 << 20
+)
+
+// dir 以下にコーパスを保存するcorpusを生成する。
+// ディレクトリを作成できなければログを出力してnilを返し、コーパスは保存しない。
+func newCorpus(dir string, max int64, log Logger) *corpus {
+	for _, kind := range []string{corpusHPACK, corpusFrames} {
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0755); err != nil {
+			log.Error("failed to create corpus directory: %s", err)
+			return nil
+		}
+	}
+
+	if max <= 0 {
+		max = defaultMaxCorpusBytes
+	}
+	return &corpus{dir: dir, max: max, log: log, seen: make(map[[sha1.Size]byte]struct{})}
+}
+
+// data を種別 kind のコーパスとして保存する。
+// nilのcorpusに対しては何もしないため、呼び出し側でコーパスの有無を確認する必要は無い。
+func (c *corpus) save(kind string, data []byte) {
+	if c == nil || len(data) == 0 || len(data) > maxCorpusEntrySize {
+		return
+	}
+
+	sum := sha1.Sum(data)
+
+	c.mu.Lock()
+	if _, ok := c.seen[sum]; ok || c.size+int64(len(data)) > c.max {
+		c.mu.Unlock()
+		return
+	}
+	c.seen[sum] = struct{}{}
+	c.size += int64(len(data))
+	c.mu.Unlock()
+
+	path := filepath.Join(c.dir, kind, hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		c.log.Error("failed to save corpus: %s", err)
+	}
+}
+
+// コネクション毎に受信したフレーム列を記録する構造体。
+// フレームは受信したままの形式で、コネクションプリフェイスを除いて記録する。
+type corpusRecorder struct {
+	corpus *corpus
+	buf    bytes.Buffer
+	framer *h2frame.Framer
+	full   bool
+}
+
+func (c *corpus) newRecorder() *corpusRecorder {
+	if c == nil {
+		return nil
+	}
+
+	r := &corpusRecorder{corpus: c}
+	r.framer = h2frame.NewFramer(&r.buf, nil)
+	return r
+}
+
+// フレームを記録する。記録済みのフレーム列と合わせて上限を超える場合、以降は記録しない。
+func (r *corpusRecorder) record(f *h2frame.Frame) {
+	if r == nil || r.full {
+		return
+	}
+
+	if r.buf.Len()+h2frame.HeaderLen+len(f.Payload) > maxCorpusEntrySize {
+		r.full = true
+		return
+	}
+	r.framer.WriteRawFrame(f.Type, f.Flags, f.StreamID, f.Payload)
+}
+
+// 記録したフレーム列を保存する
+func (r *corpusRecorder) close() {
+	if r != nil {
+		r.corpus.save(corpusFrames, r.buf.Bytes())
+	}
+}
@@ -0,0 +1,72 @@
+package h2s
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Server.MaxDecompressedBytesの既定値
+const defaultMaxDecompressedBytes = 32 << 20
+
+// 展開後のリクエストボディが上限を超えた場合に、リクエストボディの読み込みが返すエラー
+var ErrDecompressedBodyTooLarge = errors.New("h2s: decompressed request body too large")
+
+// gzipにより圧縮されたリクエストボディを展開しながら読み込むio.ReadCloser。
+// gzipのヘッダーは最初の読み込み時に解釈する。
+type gzipBody struct {
+	src    io.ReadCloser
+	zr     *gzip.Reader
+	remain int64 // 展開後のサイズの残りの上限
+	err    error
+}
+
+// content-encodingヘッダーがgzipであれば、リクエストボディを展開しながら読み込むよう差し替える。
+// 展開後のサイズは分からないため、content-lengthヘッダーは取り除く。
+func decompressRequest(req *http.Request, max int64) {
+	if !strings.EqualFold(strings.TrimSpace(req.Header.Get("Content-Encoding")), "gzip") {
+		return
+	}
+
+	if max <= 0 {
+		max = defaultMaxDecompressedBytes
+	}
+
+	req.Body = &gzipBody{src: req.Body, remain: max}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if b.zr == nil {
+		if b.zr, b.err = gzip.NewReader(b.src); b.err != nil {
+			return 0, b.err
+		}
+	}
+
+	// 上限を超えたことを検出するため、上限より1バイト多く読み込めるようにする
+	if int64(len(p)) > b.remain+1 {
+		p = p[:b.remain+1]
+	}
+
+	n, err := b.zr.Read(p)
+	if int64(n) > b.remain {
+		n, err = int(b.remain), ErrDecompressedBodyTooLarge
+	}
+	b.remain -= int64(n)
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	return b.src.Close()
+}
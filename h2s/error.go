@@ -1,28 +1,67 @@
 package h2s
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
 )
 
 type (
-	errorCode uint32
+	// エラーコードはh2frameパッケージの型を用い、パッケージ外へ公開するエラーにもそのまま持たせる
+	errorCode = h2frame.ErrCode
 
 	h2Error struct {
 		code errorCode
 		msg  string
 	}
+
+	// ストリームがエラーにより閉じられたことを表すエラー。
+	// クライアントからRST_STREAMフレームによりストリームを閉じられた後の
+	// http.ResponseWriterへの書き込みが返す。
+	StreamError struct {
+		StreamID uint32
+		Code     h2frame.ErrCode
+		Reason   string
+	}
+
+	// GOAWAYフレームによりコネクションが閉じられたことを表すエラー。
+	// サーバーとクライアントのいずれが送信したものかは問わない。Conn.Errメソッドが返す。
+	ConnectionError struct {
+		LastStreamID uint32 // GOAWAYフレームが示す最後に処理したストリームID
+		Code         h2frame.ErrCode
+		Reason       string // GOAWAYフレームのデバッグデータ
+		FromPeer     bool   // 真ならクライアントが送信したGOAWAYフレーム
+	}
+
+	// TLSハンドシェイクの失敗を表すエラー。Server.OnConnectionErrorに渡す
+	HandshakeError struct {
+		Err error
+	}
+
+	// HTTP/2の送受信の途中で、下層の接続の読み書きが失敗したことを表すエラー。
+	// ピアとの接続が失われた場合や、タイムアウトした場合に生じる。Server.OnConnectionErrorに渡す
+	TransportError struct {
+		Op  string // 失敗した操作(read, write, keepalive)
+		Err error
+	}
 )
 
 var _ error = (*h2Error)(nil)
 
 const (
+	noError           errorCode = 0x00 // エラーではない、正常な終了
 	protocolError     errorCode = 0x01 // 様々なケースで用いられる汎用エラーコード
 	internalError     errorCode = 0x02 // 予期せぬ内部エラー
 	flowControlError  errorCode = 0x03 // フロー制御関連のエラー
 	streamClosedError errorCode = 0x05 // ストリーム単位での不正なフレームの送信
 	frameSizeError    errorCode = 0x06 // フレームサイズが不正
-	compressionError  errorCode = 0x07 // ヘッダーの圧縮、つまりHPACK関連のエラー
+	refusedStream     errorCode = 0x07 // ストリームを処理せずに拒否した
+	cancelError       errorCode = 0x08 // ストリームが不要になった
+	compressionError  errorCode = 0x09 // ヘッダーの圧縮、つまりHPACK関連のエラー
+	enhanceYourCalm   errorCode = 0x0b // 過剰な負荷を生じさせるピアへの警告
 )
 
 // エラーコードを伴うエラーを生じさせる必要がある場合は今後この関数を用いる
@@ -34,6 +73,73 @@ func (e *h2Error) Error() string {
 	return e.msg
 }
 
+// ストリーム id に対するStreamErrorに変換する
+func (e *h2Error) streamError(id streamID) *StreamError {
+	return &StreamError{StreamID: uint32(id), Code: e.code, Reason: e.msg}
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("h2s: stream error(stream=%d, code=%s): %s", e.StreamID, e.Code, e.Reason)
+}
+
+// errors.Isにより、エラーコードが一致するStreamErrorと等しいとみなす。
+// target のStreamIDが0でなければ、ストリームIDも一致する必要がある。
+//
+//	errors.Is(err, &h2s.StreamError{Code: h2frame.ErrCodeCancel})
+func (e *StreamError) Is(target error) bool {
+	t, ok := target.(*StreamError)
+	return ok && t.Code == e.Code && (t.StreamID == 0 || t.StreamID == e.StreamID)
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("h2s: connection error(last stream=%d, code=%s): %s",
+		e.LastStreamID, e.Code, e.Reason)
+}
+
+// errors.Isにより、エラーコードが一致するConnectionErrorと等しいとみなす
+func (e *ConnectionError) Is(target error) bool {
+	t, ok := target.(*ConnectionError)
+	return ok && t.Code == e.Code
+}
+
+func (e *HandshakeError) Error() string {
+	return "h2s: handshake error: " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("h2s: transport error(op=%s): %s", e.Op, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// キープアライブのPINGフレームに応答が無いことを表すエラー。TransportErrorのErrとする
+var errKeepAliveTimeout = errors.New("h2s: keepalive timeout")
+
+// GOAWAYフレームのペイロードをConnectionErrorとしてデコードする
+func decodeGoAway(payload []byte) *ConnectionError {
+	return &ConnectionError{
+		LastStreamID: binary.BigEndian.Uint32(payload) & 0x7FFFFFFF,
+		Code:         h2frame.ErrCode(binary.BigEndian.Uint32(payload[4:])),
+		Reason:       string(payload[8:]),
+	}
+}
+
+// Server.GoAwayDebugDataに設定し、GOAWAYフレームのデバッグデータをランダムな参照IDに置き換える。
+// 本来の内容は参照IDと共にログに出力されるため、クライアントから報告された参照IDによりログと突き合わせられる。
+func GoAwayReference(code h2frame.ErrCode, reason string) string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return "ref=" + hex.EncodeToString(id[:])
+}
+
 // エラーからGOAWAYフレームを生成する
 func buildGoAwayFrame(e error) *frame {
 	// エラーがh2Errorでない場合はエラーコードが不明なので、内部エラーとしておく
@@ -0,0 +1,87 @@
+package h2s
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Rootのファイルを配信するリクエストハンドラー。
+// ETagとIf-None-Match、Last-ModifiedとIf-Modified-Since、Rangeによる部分的な取得に対応する。
+// これらの条件の判定とレスポンスの生成はhttp.ServeContentによる。
+//
+// レスポンスボディはServer.ResponseSpoolThresholdを超えると一時ファイルに退避され、
+// フロー制御に従って少しずつ送信されるため、大きなファイルをメモリ上に保持しない。
+// なお、このパッケージはサーバープッシュや103 Early Hintsを送信しないため、
+// 関連するファイルはLinkヘッダーによりクライアントに先読みを促す。
+type FileServer struct {
+	Root http.FileSystem
+
+	// 非nilなら、配信するファイルのパスを与えて呼び出し、
+	// 返されたパスを"Link: <path>; rel=preload"としてレスポンスヘッダーに加える
+	Preload func(name string) []string
+}
+
+var _ http.Handler = (*FileServer)(nil)
+
+// ディレクトリへのリクエストに対して配信するファイルの名前
+const indexFile = "index.html"
+
+func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	f, err := fs.Root.Open(name)
+	if err != nil {
+		fileError(w, err)
+		return
+	}
+	defer func() { f.Close() }()
+
+	stat, err := f.Stat()
+	if err != nil {
+		fileError(w, err)
+		return
+	}
+
+	// ディレクトリはその中のindexFileを配信する。一覧は返さない
+	if stat.IsDir() {
+		f.Close()
+		name = path.Join(name, indexFile)
+		if f, err = fs.Root.Open(name); err != nil {
+			fileError(w, err)
+			return
+		}
+		if stat, err = f.Stat(); err != nil || stat.IsDir() {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()))
+	if fs.Preload != nil {
+		for _, link := range fs.Preload(name) {
+			w.Header().Add("Link", "<"+link+">; rel=preload")
+		}
+	}
+
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
+
+// ファイルを開けなかった場合のレスポンスを返す。
+// 内部のパスを漏らさないよう、エラーの内容は返さない。
+func fileError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
@@ -1,7 +1,10 @@
 package h2s
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
 	"io"
 )
 
@@ -16,6 +19,17 @@ type (
 		flags    flags
 		streamID streamID
 		payload  []byte
+
+		// 非nilなら、writerコンポーネントがこのフレームを
+		// 送信(または破棄)した時点でcloseされる。
+		// 接続が閉じられていたため破棄した場合は、closeする前にdiscardedを真とする。
+		written   chan struct{}
+		discarded bool
+
+		// GOAWAYフレームの場合のみ意味を持つ。真なら送信後も接続を閉じず、
+		// ペイロードに設定済みの最終ストリームIDを書き換えない。
+		// 処理中のストリームを完了させつつ新たなストリームを拒否するために用いる。
+		graceful bool
 	}
 )
 
@@ -32,6 +46,9 @@ const (
 	windowUpdateFrame frameType = 0x08
 	continuationFrame frameType = 0x09
 
+	// RFC 9218で定義されるフレームタイプ
+	priorityUpdateFrame frameType = 0x10
+
 	// フラグの各ビット
 	eosBit      = 0x01
 	ackBit      = eosBit
@@ -40,6 +57,14 @@ const (
 	priorityBit = 0x20
 )
 
+// writerコンポーネントによる送信の完了を通知する
+func (f *frame) markWritten() {
+	if f.written != nil {
+		close(f.written)
+		f.written = nil
+	}
+}
+
 // ストリームを閉じ得るなら真を返す
 func (f *frame) isStreamCloser() bool {
 	return ((f.typ == dataFrame || f.typ == headersFrame) &&
@@ -67,6 +92,105 @@ func (f flags) priority() bool {
 	return f&priorityBit > 0
 }
 
+// フレームの読み込みを行う構造体。
+// フレームの解釈はh2frame.Framerにより行い、ペイロードの読み込み先のバッファはフレーム毎に再利用する。
+// そのため読み込んだフレームのペイロードは次のフレームを読み込むまでしか有効でない。
+// それ以降も保持する必要がある場合はcloneメソッドにより複製すること。
+type frameReader struct {
+	src    io.Reader     // 元の読み込み先
+	r      *bufio.Reader // srcをバッファしたもの
+	framer *h2frame.Framer
+
+	// 非nilなら受信したフレームを与え、返されたフレームを順に読み込んだものとする。
+	// pendingはまだ返していないフレーム。
+	interceptor FrameInterceptor
+	pending     []*h2frame.Frame
+
+	// 非nilなら受信したフレームを、FrameInterceptorによる介入の前に与えて呼び出す
+	observe func(FrameHeader)
+
+	// 非nilなら受信したフレームを、FrameInterceptorによる介入の前にログに出力する
+	tracer *frameTracer
+
+	// 非nilなら受信したフレームをコーパスとして記録する
+	recorder *corpusRecorder
+
+	// 真ならパディングが全て0であることを検証する
+	zeroPadding bool
+
+	// 読み込みバッファのサイズを適応的に変更する場合の上限と、
+	// そのための観測値。adaptiveが偽ならバッファのサイズは固定。
+	adaptive bool
+	maxSize  int
+	frames   int // 現在の観測期間に読み込んだフレームの数
+	largest  int // 現在の観測期間に読み込んだフレームの最大サイズ
+}
+
+const (
+	minAdaptiveBufferSize = 512 // 適応的に変更する読み込みバッファのサイズの下限
+	adaptInterval         = 64  // バッファのサイズを見直す間隔(フレーム数)
+)
+
+// 読み込み先 r とバッファのサイズ size を指定してframeReaderを生成する。
+// adaptive が真の場合、バッファは小さなサイズから始まり、
+// 観測したフレームのサイズに応じて size を上限に拡張、縮小する。
+func newFrameReader(r io.Reader, size int, adaptive bool) *frameReader {
+	fr := &frameReader{
+		src:      r,
+		adaptive: adaptive,
+		maxSize:  size,
+	}
+
+	if adaptive && size > minAdaptiveBufferSize {
+		size = minAdaptiveBufferSize
+	}
+	fr.r = bufio.NewReaderSize(r, size)
+
+	// バッファはadaptメソッドにより入れ替わるため、Framerには自身を読み込み先として与える
+	fr.framer = h2frame.NewFramer(nil, fr)
+	return fr
+}
+
+// 現在のバッファから読み込む
+func (fr *frameReader) Read(p []byte) (int, error) {
+	return fr.r.Read(p)
+}
+
+// 読み込んだフレームのサイズを観測し、必要であればバッファのサイズを変更する。
+// 大きなフレームを観測した場合は即座に拡張し、
+// 一定の期間小さなフレームしか観測しなかった場合は縮小する。
+// バッファの入れ替えは未読のデータが無い場合のみ行う。
+func (fr *frameReader) adapt(size int) {
+	if !fr.adaptive {
+		return
+	}
+
+	if size > fr.largest {
+		fr.largest = size
+	}
+	fr.frames++
+
+	target := minAdaptiveBufferSize
+	for target < fr.largest && target < fr.maxSize {
+		target <<= 1
+	}
+	if target > fr.maxSize {
+		target = fr.maxSize
+	}
+
+	grow := target > fr.r.Size()
+	shrink := fr.frames >= adaptInterval && target < fr.r.Size()
+	if (grow || shrink) && fr.r.Buffered() == 0 {
+		fr.r = bufio.NewReaderSize(fr.src, target)
+	}
+
+	if fr.frames >= adaptInterval {
+		// ペイロード用のバッファも観測した最大サイズに比べ過大なら解放する
+		fr.framer.ShrinkReadBuffer(fr.largest * 2)
+		fr.frames, fr.largest = 0, 0
+	}
+}
+
 // 読み込み先からのフレームの読み込み。まずヘッダーを読み込み、
 // そこから得られたペイロード長を元にペイロードを追加で読み込む。
 //
@@ -74,73 +198,167 @@ func (f flags) priority() bool {
 // 引数として与えられたそれをペイロード長が超える場合はエラーとする。
 // この時のエラーはFRAME_SIZE_ERRORであることと規定されているため、
 // newError関数によりこれを表現するエラーを生成して返す。
-func readFrame(r io.Reader, maxFrameSize int) (*frame, error) {
-	header := make([]byte, 9)
-	if _, err := io.ReadFull(r, header); err != nil {
+func (fr *frameReader) readFrame(maxFrameSize int) (*frame, error) {
+	fr.framer.SetMaxReadFrameSize(maxFrameSize)
+
+	hf, err := fr.nextFrame()
+	if err != nil {
+		var sizeErr *h2frame.FrameSizeError
+		if errors.As(err, &sizeErr) {
+			return nil, newError(frameSizeError, "too large payload(%d bytes)", sizeErr.Len)
+		}
 		return nil, err
 	}
 
 	f := &frame{
-		typ:      frameType(header[3]),
-		flags:    flags(header[4]),
-		streamID: streamID(binary.BigEndian.Uint32(header[5:])),
+		typ:      frameType(hf.Type),
+		flags:    flags(hf.Flags),
+		streamID: streamID(hf.StreamID),
+		payload:  hf.Payload,
 	}
 
-	pLen := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
-	if pLen > maxFrameSize {
-		return nil,
-			newError(frameSizeError, "too large payload(%d bytes)", pLen)
+	if err := checkFrameLayout(f); err != nil {
+		return nil, err
 	}
+	return normalizeFrame(f, fr.zeroPadding)
+}
 
-	f.payload = make([]byte, pLen)
-	if _, err := io.ReadFull(r, f.payload); err != nil {
-		return nil, err
+// 次のフレームを返す。FrameInterceptorが設定されていれば、
+// それが返したフレームが無くなった時点で次のフレームを受信する。
+func (fr *frameReader) nextFrame() (*h2frame.Frame, error) {
+	for len(fr.pending) == 0 {
+		hf, err := fr.framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		fr.adapt(h2frame.HeaderLen + len(hf.Payload))
+		fr.recorder.record(hf)
+		if fr.observe != nil {
+			fr.observe(headerOf(hf))
+		}
+		fr.tracer.trace(hf)
+
+		if fr.interceptor == nil {
+			return hf, nil
+		}
+		fr.pending = fr.interceptor.InterceptRead(hf)
 	}
 
-	return normalizeFrame(f), nil
+	hf := fr.pending[0]
+	fr.pending = fr.pending[1:]
+	return hf, nil
+}
+
+// フレームの概要を返す
+func headerOf(hf *h2frame.Frame) FrameHeader {
+	return FrameHeader{Type: hf.Type, Flags: hf.Flags, StreamID: hf.StreamID, Length: len(hf.Payload)}
+}
+
+// ペイロードを複製したフレームを返す。
+// frameReaderが読み込んだフレームを、次のフレームの読み込み以降も保持する場合に用いる。
+func (f *frame) clone() *frame {
+	c := *f
+	c.payload = append([]byte(nil), f.payload...)
+	return &c
 }
 
-func normalizeFrame(f *frame) *frame {
+// フレームタイプ毎に規定されたペイロード長とストリームIDを検証する。
+// 不正であればコネクションエラーとなるエラーを返す。
+// ペイロード長が固定のフレームは、以降の処理でその長さを前提にデコードできる。
+// PRIORITYフレームのペイロード長の誤りはストリームエラーであるため、readerコンポーネントで扱う。
+func checkFrameLayout(f *frame) *h2Error {
+	switch f.typ {
+	case dataFrame, headersFrame, priorityFrame:
+		if f.streamID == 0 {
+			return newError(protocolError, "frame %d received on stream 0", f.typ)
+		}
+
+	case rstStreamFrame:
+		// ストリーム0のRST_STREAMフレームはServer.Lenientにより許容し得るため、multiplexerコンポーネントで扱う
+		if len(f.payload) != 4 {
+			return newError(frameSizeError, "invalid RST_STREAM length(%d)", len(f.payload))
+		}
+
+	case settingsFrame:
+		if f.streamID != 0 {
+			return newError(protocolError, "SETTINGS frame received on stream %d", f.streamID)
+		}
+		if f.flags.ack() && len(f.payload) != 0 {
+			return newError(frameSizeError, "SETTINGS ACK with payload")
+		}
+		if len(f.payload)%6 != 0 {
+			return newError(frameSizeError, "invalid SETTINGS length(%d)", len(f.payload))
+		}
+
+	case pingFrame:
+		if f.streamID != 0 {
+			return newError(protocolError, "PING frame received on stream %d", f.streamID)
+		}
+		if len(f.payload) != 8 {
+			return newError(frameSizeError, "invalid PING length(%d)", len(f.payload))
+		}
+
+	case goAwayFrame:
+		if f.streamID != 0 {
+			return newError(protocolError, "GOAWAY frame received on stream %d", f.streamID)
+		}
+		if len(f.payload) < 8 {
+			return newError(frameSizeError, "invalid GOAWAY length(%d)", len(f.payload))
+		}
+
+	case windowUpdateFrame:
+		if len(f.payload) != 4 {
+			return newError(frameSizeError, "invalid WINDOW_UPDATE length(%d)", len(f.payload))
+		}
+	}
+	return nil
+}
+
+// パディングや優先度の情報を取り除く。
+// パディング長等がペイロードに収まらない場合はPROTOCOL_ERRORとする。
+// zeroPad が真なら、パディングが0以外を含む場合もPROTOCOL_ERRORとする。
+func normalizeFrame(f *frame, zeroPad bool) (*frame, error) {
 	if f.typ != dataFrame && f.typ != headersFrame {
-		return f
+		return f, nil
 	}
 
 	pLen := len(f.payload)
 
 	if f.flags.padded() {
+		if pLen == 0 || int(f.payload[0]) >= pLen {
+			return nil, newError(protocolError, "invalid padding")
+		}
+		if zeroPad && !zeroPadding(f.payload[pLen-int(f.payload[0]):]) {
+			return nil, newError(protocolError, "non-zero padding")
+		}
 		f.flags &= ^flags(paddedBit)
 		f.payload = f.payload[1 : pLen-int(f.payload[0])]
 	}
 
 	if f.typ == headersFrame && f.flags.priority() {
+		if len(f.payload) < 5 {
+			return nil, newError(frameSizeError, "invalid priority")
+		}
 		f.flags &= ^flags(priorityBit)
 		f.payload = f.payload[5:]
 	}
 
-	return f
+	return f, nil
 }
 
-// 与えられた出力先にフレームを書き出す
-func (f *frame) encodeTo(w io.Writer) error {
-	pLen := len(f.payload)
-	header := make([]byte, 9)
-
-	header[0] = byte((pLen >> 16) & 0xFF)
-	header[1] = byte((pLen >> 8) & 0xFF)
-	header[2] = byte(pLen & 0xFF)
-	header[3] = byte(f.typ)
-	header[4] = byte(f.flags)
-	binary.BigEndian.PutUint32(header[5:], uint32(f.streamID))
-
-	if _, err := w.Write(header); err != nil {
-		return err
-	}
+// Framerによりフレームを書き出す
+func (f *frame) writeTo(fr *h2frame.Framer) error {
+	return fr.WriteRawFrame(h2frame.Type(f.typ), h2frame.Flags(f.flags), uint32(f.streamID), f.payload)
+}
 
-	if _, err := w.Write(f.payload); err != nil {
-		return err
+// h2frame.Frameに変換する。ペイロードは複製しない。
+func (f *frame) export() *h2frame.Frame {
+	return &h2frame.Frame{
+		Type:     h2frame.Type(f.typ),
+		Flags:    h2frame.Flags(f.flags),
+		StreamID: uint32(f.streamID),
+		Payload:  f.payload,
 	}
-
-	return nil
 }
 
 type (
@@ -161,6 +379,9 @@ const (
 	initialWindowSizeSetting settingsParamType = 0x04
 	maxFrameSizeSetting      settingsParamType = 0x05
 	maxHeaderListSizeSetting settingsParamType = 0x06
+
+	// RFC 9218で定義される、RFC 7540の優先度を用いないことを表す設定
+	noRFC7540PrioritiesSetting settingsParamType = 0x09
 )
 
 func newSettingsParam(
@@ -0,0 +1,68 @@
+package h2s
+
+import (
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+)
+
+// Server.TraceFramesによる、送受信したフレームのログ出力。
+// nghttp2やcurlの出力に倣い、フレームヘッダーに続けてフレームタイプ毎にデコードした内容を出力する。
+// ヘッダーブロックはEND_HEADERSフラグまで蓄積し、HPACKによりデコードしたヘッダーリストを出力する。
+// 受信と送信のそれぞれで、インデックステーブルを独立して保持する。
+type frameTracer struct {
+	logger    logger
+	direction string // "recv" または "send"
+	table     *hpack.IndexTable
+	headerBuf []byte
+
+	// ヘッダーブロックのデコードに失敗した以降は、インデックステーブルの状態が
+	// ピアと一致しないため、ヘッダーリストを出力しない
+	broken bool
+}
+
+// Server.TraceFramesが偽ならnilを返す。
+// tableSize は direction 側のヘッダーブロックのデコードに用いるインデックステーブルのサイズの上限。
+func newFrameTracer(server *Server, logger logger, direction string, tableSize int) *frameTracer {
+	if !server.TraceFrames {
+		return nil
+	}
+	return &frameTracer{logger: logger, direction: direction, table: hpack.NewIndexTable(tableSize)}
+}
+
+// フレームの内容をログに出力する。nilのframeTracerに対しては何もしない
+func (ft *frameTracer) trace(hf *h2frame.Frame) {
+	if ft == nil {
+		return
+	}
+
+	ft.logger.debug("%s %s", ft.direction, hf.Summary())
+	lines, fragment, err := hf.Describe()
+	if err != nil {
+		ft.logger.debug("          (invalid payload: %s)", err)
+		return
+	}
+	for _, line := range lines {
+		ft.logger.debug("          %s", line)
+	}
+
+	if fragment == nil || ft.broken {
+		return
+	}
+	ft.headerBuf = append(ft.headerBuf, fragment...)
+	if !hf.Flags.Has(h2frame.FlagEndHeaders) {
+		return
+	}
+
+	block := ft.headerBuf
+	ft.headerBuf = nil
+	list, err := hpack.DecodeHeaderBlock(ft.table, block)
+	if err != nil {
+		ft.broken = true
+		ft.logger.debug("          (failed to decode header block: %s)", err)
+		return
+	}
+	defer list.Release()
+	for _, field := range list {
+		ft.logger.debug("          %s: %s", field.Name(), field.Value())
+	}
+}
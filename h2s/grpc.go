@@ -0,0 +1,48 @@
+package h2s
+
+import (
+	"net/http"
+	"strings"
+)
+
+// gRPCのリクエストを grpcServer に、それ以外を other に振り分けるリクエストハンドラーを返す。
+// 同じポートでgRPCと通常のHTTPを提供するために用いる。other がnilなら
+// gRPC以外のリクエストには415 Unsupported Media Typeを返す。
+//
+// grpcServer にはgrpc-goの*grpc.Serverを与えることを想定している。
+// *grpc.ServerはServeHTTPメソッドによりhttp.Handlerを満たし、
+// HTTP/2のリクエスト、トレーラー、http.Flusherを要求するが、このパッケージはいずれも満たす。
+//
+//	gs := grpc.NewServer()
+//	pb.RegisterGreeterServer(gs, &greeter{})
+//
+//	sv := h2s.NewServer(cert)
+//	sv.ListenAndServe(":8443", h2s.GRPCHandler(gs, http.FileServer(http.Dir("."))))
+//
+// ただし、このパッケージはリクエストボディを全て受信してからリクエストハンドラーを起動する。
+// レスポンスは*grpc.Serverがメッセージ毎にFlushメソッドを呼び出すため逐次送信される。そのため、
+// Unary RPC、クライアントストリーミングRPC、サーバーストリーミングRPCはそのまま動作するが、
+// クライアントが応答を待ってから次のメッセージを送信する双方向ストリーミングRPCは完了しない。
+func GRPCHandler(grpcServer, other http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPCRequest(r) {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+
+		if other == nil {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		other.ServeHTTP(w, r)
+	})
+}
+
+// gRPCのリクエストであれば真を返す。
+// Content-Typeはapplication/grpc, application/grpc+proto等が用いられる。
+func isGRPCRequest(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return r.ProtoMajor == 2 && r.Method == http.MethodPost &&
+		(ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") ||
+			strings.HasPrefix(ct, "application/grpc;"))
+}
@@ -0,0 +1,48 @@
+package h2s
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// リクエストの:authority(またはhostヘッダー)がServer.AllowedHostsに含まれていれば真を返す。
+// AllowedHostsが空なら常に真を返す。ポートは無視し、大文字と小文字は区別しない。
+func (sv *Server) allowedHost(host string) bool {
+	if len(sv.AllowedHosts) == 0 {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+
+	for _, allowed := range sv.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+
+		// "*.example.com"はexample.comのサブドメインに一致し、example.com自体には一致しない
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Server.AllowedHostsに含まれないホストへのリクエストに対して、リクエストハンドラーの代わりに用いるハンドラー。
+// このサーバーが応答すべきでないリクエストであることを421 Misdirected Requestにより通知する。
+// ホストが指定されていなければ400 Bad Requestとする。
+var misdirectedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+})
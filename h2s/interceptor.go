@@ -0,0 +1,54 @@
+package h2s
+
+import (
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"net"
+)
+
+// コネクション上で送受信するフレームに介入するインターフェイス。
+// Server.Interceptorによりコネクション毎に生成する。
+// フレームの内容の確認や書き換え、破棄、追加を行えるため、
+// プロトコルの検査ツール等でサーバーの挙動を変更する場合に用いる。
+//
+// InterceptReadはreaderコンポーネントのゴルーチンから、
+// InterceptWriteはwriterコンポーネントのゴルーチンから呼び出されるため、
+// 両者が状態を共有する場合は排他制御を行うこと。
+type FrameInterceptor interface {
+	// 受信したフレームを与えて呼び出す。返したフレームを順に受信したものとして処理する。
+	// 空を返せばフレームを破棄したことになる。
+	// 与えたフレームのペイロードは次の受信までしか有効でない。
+	InterceptRead(f *h2frame.Frame) []*h2frame.Frame
+
+	// 送信するフレームを与えて呼び出す。返したフレームを順に送信する。
+	// 空を返せばフレームを送信しない。ウィンドウサイズ等の内部状態は
+	// 与えたフレームを送信したものとして更新される。
+	InterceptWrite(f *h2frame.Frame) []*h2frame.Frame
+}
+
+// 送受信したフレームの概要。Server.OnFrameRead, Server.OnFrameWriteに渡す
+type FrameHeader struct {
+	Type     h2frame.Type
+	Flags    h2frame.Flags
+	StreamID uint32
+	Length   int // ペイロード長
+}
+
+// コネクションに対するFrameInterceptorを生成する。未設定ならnilを返す。
+func (sv *Server) interceptor(conn net.Conn) FrameInterceptor {
+	if sv.Interceptor == nil {
+		return nil
+	}
+	return sv.Interceptor(conn)
+}
+
+// リモートアドレス remote のコネクションで、受信、送信したフレームを
+// Server.OnFrameRead, Server.OnFrameWriteに通知する関数を返す。それぞれ未設定ならnilを返す。
+func (sv *Server) frameObservers(remote string) (read, write func(FrameHeader)) {
+	if fn := sv.OnFrameRead; fn != nil {
+		read = func(h FrameHeader) { fn(remote, h) }
+	}
+	if fn := sv.OnFrameWrite; fn != nil {
+		write = func(h FrameHeader) { fn(remote, h) }
+	}
+	return read, write
+}
@@ -0,0 +1,161 @@
+package h2s
+
+import "sort"
+
+type (
+	// コネクションの使用状況に、ストリーム毎の状態とフロー制御の状態を加えたスナップショット。
+	// フロー制御による送信の停滞等を、サーバーを止めずに調査するために用いる。
+	ConnSnapshot struct {
+		ConnStats
+
+		// コネクションレベルの送信ウィンドウサイズと、送信を待機しているDATAフレームの合計バイト数
+		SendWindow       int64
+		PendingDataBytes int64
+
+		ActiveStreams []StreamSnapshot // メモリ上のストリームと、DATAフレームの送信を待機しているストリーム。ストリームIDの昇順
+	}
+
+	// ストリーム毎の状態
+	StreamSnapshot struct {
+		ID    uint32
+		State string // idle, reserved(local), reserved(remote), open, half-closed(local), half-closed(remote), closed
+
+		// リクエストハンドラーを実行中なら真
+		HandlerRunning bool
+
+		// ストリームレベルの送信ウィンドウサイズと、それにより送信を待機しているDATAフレーム
+		SendWindow        int64
+		PendingDataFrames int
+		PendingDataBytes  int64
+	}
+
+	// writerコンポーネントが保持するフロー制御の状態の複製
+	writerSnapshot struct {
+		initWindow int64
+		windows    map[streamID]int64
+		pending    map[streamID]*StreamSnapshot // 送信を待機しているDATAフレームのみを数える
+	}
+)
+
+func (s streamState) String() string {
+	switch s {
+	case idleStream:
+		return "idle"
+	case reservedLocalStream:
+		return "reserved(local)"
+	case reservedRemoteStream:
+		return "reserved(remote)"
+	case openStream:
+		return "open"
+	case halfClosedLocalStream:
+		return "half-closed(local)"
+	case halfClosedRemoteStream:
+		return "half-closed(remote)"
+	default:
+		return "closed"
+	}
+}
+
+// 接続中の全コネクションのスナップショットを返す。
+// ConnStatsメソッドと異なり、各コネクションのwriterコンポーネントの応答を待つため相応のコストを要する。
+// ListenAndServeメソッドとは別のゴルーチンから呼び出すことができる。
+func (sv *Server) Connections() []ConnSnapshot {
+	conns := sv.trackedConns()
+	snapshots := make([]ConnSnapshot, 0, len(conns))
+	for _, cs := range conns {
+		snapshots = append(snapshots, cs.snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots
+}
+
+func (cs *connState) snapshot() ConnSnapshot {
+	snap := ConnSnapshot{ConnStats: cs.stats()}
+	streams := make(map[streamID]*StreamSnapshot)
+
+	mp := cs.multiplexer
+	mp.mu.Lock()
+	mp.streams.forEach(func(id streamID, s *stream) {
+		streams[id] = &StreamSnapshot{
+			ID:             uint32(id),
+			State:          s.state.String(),
+			HandlerRunning: s.res != nil,
+		}
+	})
+	mp.mu.Unlock()
+
+	// writerコンポーネントが終了していれば、フロー制御の状態は含めない
+	if ws := cs.writer.snapshot(); ws != nil {
+		snap.SendWindow = ws.windows[0]
+		for id, p := range ws.pending {
+			snap.PendingDataBytes += p.PendingDataBytes
+
+			// multiplexerコンポーネントが既に閉じたストリームも、DATAフレームの送信を待っていれば含める
+			s, ok := streams[id]
+			if !ok {
+				s = &StreamSnapshot{ID: uint32(id), State: closedStream.String()}
+				streams[id] = s
+			}
+			s.PendingDataFrames = p.PendingDataFrames
+			s.PendingDataBytes = p.PendingDataBytes
+		}
+
+		for id, s := range streams {
+			// ウィンドウサイズを変更していないストリームは初期ウィンドウサイズのまま
+			if window, ok := ws.windows[id]; ok {
+				s.SendWindow = window
+			} else {
+				s.SendWindow = ws.initWindow
+			}
+		}
+	}
+
+	snap.ActiveStreams = make([]StreamSnapshot, 0, len(streams))
+	for _, s := range streams {
+		snap.ActiveStreams = append(snap.ActiveStreams, *s)
+	}
+	sort.Slice(snap.ActiveStreams, func(i, j int) bool { return snap.ActiveStreams[i].ID < snap.ActiveStreams[j].ID })
+	return snap
+}
+
+// フロー制御の状態の複製をwriterコンポーネントに要求する。終了していればnilを返す
+func (w *writer) snapshot() *writerSnapshot {
+	reply := make(chan *writerSnapshot, 1)
+	select {
+	case w.inspect <- reply:
+	case <-w.done:
+		return nil
+	}
+
+	select {
+	case ws := <-reply:
+		return ws
+	case <-w.done:
+		return nil
+	}
+}
+
+// フロー制御の状態を複製する。writerコンポーネントのゴルーチンから呼び出す
+func (w *writer) takeSnapshot() *writerSnapshot {
+	ws := &writerSnapshot{
+		initWindow: w.initWindow,
+		windows:    make(map[streamID]int64, len(w.streamsWindow)),
+		pending:    make(map[streamID]*StreamSnapshot),
+	}
+	for id, window := range w.streamsWindow {
+		ws.windows[id] = window
+	}
+	for _, data := range w.pendingData {
+		if data.typ != dataFrame {
+			continue
+		}
+		p, ok := ws.pending[data.streamID]
+		if !ok {
+			p = &StreamSnapshot{}
+			ws.pending[data.streamID] = p
+		}
+		p.PendingDataFrames++
+		p.PendingDataBytes += int64(len(data.payload))
+	}
+	return ws
+}
@@ -0,0 +1,146 @@
+package h2s
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PINGフレームによるキープアライブ。
+// クライアントからKeepAliveIntervalの間フレームを受信しなければPINGフレームを送信し、
+// それからKeepAliveTimeoutの間ACKを含め何も受信しなければ、ピアが失われたものとしてコネクションを閉じる。
+// NAT等により応答しなくなったピアのコネクションとゴルーチンが残り続けることを防ぐ。
+type keepAlive struct {
+	lastRead int64 // 最後にフレームを受信した時刻(UnixNano)。sync/atomicによりアクセスする
+
+	clock    Clock
+	interval time.Duration
+	timeout  time.Duration
+	logger   logger
+	metrics  Metrics
+	writer   *writer
+
+	mu      sync.Mutex
+	timer   Timer
+	sent    time.Time // ACKを待っているPINGフレームの送信時刻。待っていなければゼロ値
+	payload [8]byte   // ACKを待っているPINGフレームのペイロード
+	seq     uint64
+	stopped bool
+}
+
+// KeepAliveIntervalが設定されていなければnilを返す
+func newKeepAlive(server *Server, logger logger, writer *writer) *keepAlive {
+	if server.KeepAliveInterval <= 0 {
+		return nil
+	}
+
+	ka := &keepAlive{
+		clock:    server.clock(),
+		interval: server.KeepAliveInterval,
+		timeout:  server.KeepAliveTimeout,
+		logger:   logger,
+		metrics:  server.metrics(),
+		writer:   writer,
+	}
+	if ka.timeout <= 0 {
+		ka.timeout = ka.interval
+	}
+
+	ka.received()
+
+	ka.mu.Lock()
+	ka.timer = ka.clock.AfterFunc(ka.interval, ka.fire)
+	ka.mu.Unlock()
+	return ka
+}
+
+// フレームの受信を記録する。readerコンポーネントがフレームを受信する度に呼び出す
+func (ka *keepAlive) received() {
+	if ka == nil {
+		return
+	}
+	atomic.StoreInt64(&ka.lastRead, ka.clock.Now().UnixNano())
+}
+
+// PINGフレームのACKを受信した場合に呼び出す。
+// 送信したPINGフレームに対するものであれば、ACKの待機を終えて往復時間を記録する。
+func (ka *keepAlive) acked(payload []byte) {
+	if ka == nil {
+		return
+	}
+
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if ka.sent.IsZero() || !bytes.Equal(payload, ka.payload[:]) {
+		return
+	}
+
+	rtt := ka.clock.Now().Sub(ka.sent)
+	atomic.StoreInt64(&ka.writer.rtt, int64(rtt))
+	ka.metrics.Observe("h2s_ping_rtt_seconds", rtt.Seconds(), nil)
+	ka.sent = time.Time{}
+}
+
+// タイマーを停止する。コネクションの終了時に呼び出す
+func (ka *keepAlive) stop() {
+	if ka == nil {
+		return
+	}
+
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	ka.stopped = true
+	ka.timer.Stop()
+}
+
+// タイマーの発火時の処理。
+// PINGフレームの送信後に何も受信していなければコネクションを閉じる。
+// そうでなければ、最後の受信からKeepAliveIntervalが経過していればPINGフレームを送信し、
+// 経過していなければ残りの時間の経過後に改めて判定する。
+// writerコンポーネントへの送信は待機し得るため、muを解放してから行う。
+func (ka *keepAlive) fire() {
+	if ping := ka.next(); ping != nil {
+		ka.writer.write(ping)
+	}
+}
+
+// 送信すべきPINGフレームがあればそれを返す
+func (ka *keepAlive) next() *frame {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if ka.stopped {
+		return nil
+	}
+
+	now := ka.clock.Now()
+	lastRead := time.Unix(0, atomic.LoadInt64(&ka.lastRead))
+
+	if !ka.sent.IsZero() {
+		if lastRead.Before(ka.sent) {
+			ka.logger.info("keepalive timeout")
+			ka.metrics.Add("h2s_keepalive_timeouts_total", 1, nil)
+			ka.stopped = true
+			ka.writer.reportError(&TransportError{Op: "keepalive", Err: errKeepAliveTimeout})
+			ka.writer.shutdown()
+			return nil
+		}
+		// ACKは未着だが他のフレームを受信しているため、ピアは応答している
+		ka.sent = time.Time{}
+	}
+
+	if idle := now.Sub(lastRead); idle < ka.interval {
+		ka.timer.Reset(ka.interval - idle)
+		return nil
+	}
+
+	ka.seq++
+	binary.BigEndian.PutUint64(ka.payload[:], ka.seq)
+	ka.sent = now
+	ka.timer.Reset(ka.timeout)
+	return &frame{typ: pingFrame, payload: append([]byte(nil), ka.payload[:]...)}
+}
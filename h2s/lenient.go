@@ -0,0 +1,15 @@
+package h2s
+
+// プロトコル違反を記録する。Server.Lenientが真なら真を返し、
+// 呼び出し側は違反したフレームを無視して処理を継続する。
+// 無視しても接続の状態(HPACKの動的テーブルやフロー制御)が
+// クライアントと食い違わない違反に対してのみ呼び出す。
+func (sv *Server) tolerate(logger logger, err *h2Error) bool {
+	if !sv.Lenient {
+		return false
+	}
+
+	logger.info("tolerated protocol violation: %s", err)
+	sv.metrics().Add("h2s_tolerated_violations_total", 1, nil)
+	return true
+}
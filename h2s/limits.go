@@ -0,0 +1,149 @@
+package h2s
+
+import (
+	"context"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// リクエスト毎に適用する上限。0の項目には上限を設けない。
+	RequestLimits struct {
+		// リクエストボディのサイズの上限(バイト)。
+		// content-lengthヘッダーか受信したリクエストボディが超えた場合、
+		// リクエストハンドラーを呼び出さずに413 Content Too Largeを返す。
+		MaxBodyBytes int64
+
+		// RFC 7541の計算方法によるリクエストヘッダーのサイズの上限(バイト)。
+		// 超えた場合、リクエストハンドラーを呼び出さずに431 Request Header Fields Too Largeを返す。
+		MaxHeaderListSize int
+
+		// リクエストハンドラーの実行時間の上限。
+		// 超えた場合、リクエストのコンテキストを終了させ、リクエストハンドラーの終了を待たずに
+		// RST_STREAM(CANCEL)によりストリームを閉じる。以降、リクエストハンドラーの書き込みはエラーとなり、
+		// そのストリームは並行するストリームや実行中のリクエストハンドラーの数に含めない。
+		// TimeoutWithServiceUnavailableが真なら、レスポンスヘッダーを未送信の場合に
+		// RST_STREAMフレームの代わりに503 Service Unavailableを返す。
+		HandlerTimeout                time.Duration
+		TimeoutWithServiceUnavailable bool
+	}
+
+	// リクエストハンドラーの実行時間の上限の管理。
+	// responseWriterはプールにより再利用されるため、タイマーはこれを介してリクエストハンドラーの終了を判定する。
+	// 各フィールドはmultiplexerコンポーネントのmuを獲得して参照する。
+	handlerDeadline struct {
+		timer     Timer
+		finished  bool // リクエストハンドラーが上限内に終了した
+		reclaimed bool // 上限を超えたためストリームを閉じた
+	}
+
+	// :authorityやパスのプレフィックス毎にRequestLimitsを上書きする設定。
+	// Server.LimitOverridesに設定する。
+	LimitOverride struct {
+		// 上書きを適用するリクエストの:authority(ポートを除く)とパスのプレフィックス。
+		// 空ならあらゆるリクエストに一致する。
+		// 複数の設定に一致する場合、Hostが一致するものを優先し、その中で最も長いPrefixのものを適用する。
+		Host   string
+		Prefix string
+
+		// 0以外の項目のみServer.Limitsの値を上書きする
+		Limits RequestLimits
+	}
+)
+
+// o の0以外の項目により上書きしたRequestLimitsを返す
+func (l RequestLimits) merge(o RequestLimits) RequestLimits {
+	if o.MaxBodyBytes != 0 {
+		l.MaxBodyBytes = o.MaxBodyBytes
+	}
+	if o.MaxHeaderListSize != 0 {
+		l.MaxHeaderListSize = o.MaxHeaderListSize
+	}
+	if o.HandlerTimeout != 0 {
+		l.HandlerTimeout = o.HandlerTimeout
+	}
+	if o.TimeoutWithServiceUnavailable {
+		l.TimeoutWithServiceUnavailable = true
+	}
+	return l
+}
+
+// リクエストヘッダーが上限を超えていれば、返すべきステータスコードを返す。超えていなければ0を返す。
+func (l RequestLimits) checkHeaders(headers hpack.HeaderList) int {
+	if l.MaxHeaderListSize > 0 {
+		size := 0
+		for _, hf := range headers {
+			size += hf.Size()
+		}
+		if size > l.MaxHeaderListSize {
+			return http.StatusRequestHeaderFieldsTooLarge
+		}
+	}
+
+	if l.MaxBodyBytes > 0 {
+		if cl := headers.Get("content-length"); cl != nil {
+			if n, err := strconv.ParseInt(cl.Value(), 10, 64); err == nil && n > l.MaxBodyBytes {
+				return http.StatusRequestEntityTooLarge
+			}
+		}
+	}
+	return 0
+}
+
+// HandlerTimeoutが設定されていれば、それを期限とするコンテキストを持つリクエストを返す
+func (l RequestLimits) withTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	if l.HandlerTimeout <= 0 {
+		return req, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), l.HandlerTimeout)
+	return req.WithContext(ctx), cancel
+}
+
+// リクエストヘッダーの:authorityとパスに対して適用するRequestLimitsを返す
+func (sv *Server) requestLimits(headers hpack.HeaderList) RequestLimits {
+	if len(sv.LimitOverrides) == 0 {
+		return sv.Limits
+	}
+
+	var host, path string
+	if hf := headers.Get(":authority"); hf != nil {
+		host = hf.Value()
+	} else if hf := headers.Get("host"); hf != nil {
+		host = hf.Value()
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hf := headers.Get(":path"); hf != nil {
+		path = hf.Value()
+	}
+
+	best := -1
+	for i, o := range sv.LimitOverrides {
+		if (o.Host != "" && !strings.EqualFold(o.Host, host)) || !strings.HasPrefix(path, o.Prefix) {
+			continue
+		}
+
+		if best < 0 || moreSpecific(o, sv.LimitOverrides[best]) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return sv.Limits
+	}
+	return sv.Limits.merge(sv.LimitOverrides[best].Limits)
+}
+
+// a が b より優先して適用されるなら真を返す
+func moreSpecific(a, b LimitOverride) bool {
+	if (a.Host != "") != (b.Host != "") {
+		return a.Host != ""
+	}
+	return len(a.Prefix) > len(b.Prefix)
+}
@@ -0,0 +1,107 @@
+package h2s
+
+import (
+	"log"
+	"strings"
+)
+
+type (
+	// ログの出力先。Server.Loggerに設定すると、各コンポーネントはこれにログを出力する。
+	// format, a はfmt.Printfと同様の書式と引数であり、末尾に改行は含まない。
+	// コネクションの各ゴルーチンから並行して呼び出される。
+	Logger interface {
+		// フレームの送受信やストリームの処理等、コネクションの動作を追跡するためのログ
+		Debug(format string, a ...interface{})
+
+		// クライアントの切断やプロトコル違反、タイムアウト等、運用上把握しておくべき事象
+		Info(format string, a ...interface{})
+
+		// リクエストハンドラーのパニックや待ち受けの失敗等、サーバー側の異常
+		Error(format string, a ...interface{})
+	}
+
+	// ログの重要度
+	LogLevel int
+
+	// logパッケージの*log.Loggerに出力するLogger
+	stdLogger struct {
+		l   *log.Logger
+		min LogLevel
+	}
+
+	// 何も出力しないLogger。Server.Loggerが未設定の場合に用いる
+	nopLogger struct{}
+
+	// コネクション毎のログの出力。
+	// 出力する内容の先頭に、リモートアドレス等のコネクションを識別するタグを付与する。
+	logger struct {
+		l   Logger
+		tag string // 書式中に埋め込むため、'%'はエスケープしておく
+	}
+)
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+var (
+	_ Logger = (*stdLogger)(nil)
+	_ Logger = nopLogger{}
+)
+
+// l に重要度が min 以上のログを出力するLoggerを生成する。l がnilならlog.Default()に出力する
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l, min: min}
+}
+
+func (s *stdLogger) Debug(format string, a ...interface{}) {
+	s.print(LogDebug, format, a)
+}
+
+func (s *stdLogger) Info(format string, a ...interface{}) {
+	s.print(LogInfo, format, a)
+}
+
+func (s *stdLogger) Error(format string, a ...interface{}) {
+	s.print(LogError, format, a)
+}
+
+func (s *stdLogger) print(level LogLevel, format string, a []interface{}) {
+	if level >= s.min {
+		s.l.Printf(format+"\n", a...)
+	}
+}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// ログの出力先を返す。未設定なら何も出力しないLoggerを返す。
+func (sv *Server) log() Logger {
+	if sv.Logger == nil {
+		return nopLogger{}
+	}
+	return sv.Logger
+}
+
+// tag を付与してログを出力するloggerを生成する
+func (sv *Server) newLogger(tag string) logger {
+	return logger{l: sv.log(), tag: strings.ReplaceAll(tag, "%", "%%") + " "}
+}
+
+func (lg logger) debug(format string, a ...interface{}) {
+	lg.l.Debug(lg.tag+format, a...)
+}
+
+func (lg logger) info(format string, a ...interface{}) {
+	lg.l.Info(lg.tag+format, a...)
+}
+
+func (lg logger) error(format string, a ...interface{}) {
+	lg.l.Error(lg.tag+format, a...)
+}
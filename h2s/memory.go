@@ -0,0 +1,94 @@
+package h2s
+
+import "sync"
+
+type (
+	// サーバー全体でバッファしているバイト数を管理する構造体。
+	// 上限を超過した場合、最も多くバッファしているコネクションに対して
+	// GOAWAYフレームの送信による切断を指示する。
+	memoryBudget struct {
+		mu      sync.Mutex
+		metrics Metrics
+		limit   int64 // 上限。0以下なら無制限
+		total   int64
+		conns   map[*connMemory]struct{}
+	}
+
+	// コネクション毎にバッファしているバイト数。
+	// リクエストボディ、送信を待機しているDATAフレーム、
+	// 不完全なヘッダーブロックのサイズの合計を表す。
+	connMemory struct {
+		budget     *memoryBudget
+		used       int64
+		pressured  bool   // 既に切断を指示していれば真
+		onPressure func() // 切断の指示。ブロックしてはならない
+	}
+)
+
+func newMemoryBudget(limit int64, metrics Metrics) *memoryBudget {
+	return &memoryBudget{
+		metrics: metrics,
+		limit:   limit,
+		conns:   make(map[*connMemory]struct{}),
+	}
+}
+
+// コネクションを管理対象に加える
+func (b *memoryBudget) newConn(onPressure func()) *connMemory {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := &connMemory{budget: b, onPressure: onPressure}
+	b.conns[m] = struct{}{}
+	return m
+}
+
+// コネクションがバッファしているバイト数を n だけ増減させる。
+// 増加させた結果上限を超過した場合は、
+// 最も多くバッファしているコネクションに切断を指示する。
+func (m *connMemory) add(n int) {
+	b := m.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m.used += int64(n)
+	b.total += int64(n)
+	b.metrics.Set("h2s_buffered_bytes", float64(b.total), nil)
+
+	if n <= 0 || b.limit <= 0 || b.total <= b.limit {
+		return
+	}
+
+	var heaviest *connMemory
+	for c := range b.conns {
+		if !c.pressured && (heaviest == nil || c.used > heaviest.used) {
+			heaviest = c
+		}
+	}
+
+	if heaviest != nil {
+		heaviest.pressured = true
+		heaviest.onPressure()
+		b.metrics.Add("h2s_memory_pressure_goaway_total", 1, nil)
+	}
+}
+
+// コネクションがバッファしているバイト数を返す
+func (m *connMemory) bytes() int64 {
+	b := m.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return m.used
+}
+
+// コネクションを管理対象から外し、バッファしていたバイト数を解放する
+func (m *connMemory) close() {
+	b := m.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.total -= m.used
+	m.used = 0
+	delete(b.conns, m)
+	b.metrics.Set("h2s_buffered_bytes", float64(b.total), nil)
+}
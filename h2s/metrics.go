@@ -0,0 +1,49 @@
+package h2s
+
+import "github.com/murakmii/c99-minimal-h2s/hpack"
+
+type (
+	// メトリクスの送出先を表すインターフェイス。
+	// Server.Metricsに設定すると、各コンポーネントが計測値をこれに通知する。
+	// 複数のコネクションのゴルーチンから並行して呼び出される点に注意。
+	Metrics interface {
+		// カウンターに値を加算する
+		Add(name string, delta float64, labels Labels)
+
+		// ゲージに値を設定する
+		Set(name string, value float64, labels Labels)
+
+		// ヒストグラム等に観測値を記録する
+		Observe(name string, value float64, labels Labels)
+	}
+
+	// メトリクスに付与するラベル
+	Labels map[string]string
+
+	// 何もしないMetrics。Server.Metricsが未設定の場合に用いる。
+	nopMetrics struct{}
+)
+
+var _ Metrics = nopMetrics{}
+
+func (nopMetrics) Add(string, float64, Labels)     {}
+func (nopMetrics) Set(string, float64, Labels)     {}
+func (nopMetrics) Observe(string, float64, Labels) {}
+
+// HPACKのインデックステーブルの利用状況をメトリクスとして通知する。
+// カウンターは前回通知時の利用状況 prev との差分を加算する。
+func reportTableStats(m Metrics, prev, cur hpack.TableStats) {
+	if cur.MaxTableSize > 0 {
+		m.Observe("h2s_hpack_table_fill_ratio",
+			float64(cur.TableSize)/float64(cur.MaxTableSize), nil)
+	}
+
+	m.Add("h2s_hpack_evictions_total",
+		float64(cur.Evictions-prev.Evictions), nil)
+	m.Add("h2s_hpack_fields_total",
+		float64(cur.Indexed-prev.Indexed),
+		Labels{"direction": "decode", "repr": "indexed"})
+	m.Add("h2s_hpack_fields_total",
+		float64(cur.Literal-prev.Literal),
+		Labels{"direction": "decode", "repr": "literal"})
+}
@@ -1,11 +1,21 @@
 package h2s
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"io"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -13,45 +23,165 @@ type (
 	streamState uint8
 
 	stream struct {
-		state   streamState
-		headers hpack.HeaderList
-		body    []*frame
+		state    streamState
+		headers  hpack.HeaderList
+		trailers hpack.HeaderList // リクエストボディの後に受信したHEADERSフレームによるトレーラー
+		body     []byte
+		shed     bool // 過負荷により、リクエストハンドラーの代わりに503を返すなら真
+		limits   RequestLimits
+		res      *responseWriter // 実行中のリクエストハンドラーのレスポンス
+		tunnel   *tunnel         // CONNECTメソッドのリクエストなら非nil
 	}
 
+	// ストリームを保持するコレクション。
+	// 複数のゴルーチンから並行してアクセスされても競合しにくいよう、
+	// ストリームIDによりシャードに分割して保持する。
 	streamCollection struct {
+		shards [streamShards]streamShard
+		maxID  uint32 // sync/atomicによりアクセスする
+
+		slabMu sync.Mutex
+		slab   streamSlab
+
+		// メモリ上から削除した、最近閉じたストリーム
+		clock    Clock
+		recentMu sync.Mutex
+		recent   recentlyClosed
+	}
+
+	streamShard struct {
+		mu      sync.RWMutex
 		entries map[streamID]*stream
-		maxID   streamID
 	}
 )
 
-// idle, open, half closed(remote), closedの4状態を扱う
+// streamCollectionのシャードの数
+const streamShards = 16
+
+// ストリームIDの最大値
+const maxStreamID = 1<<31 - 1
+
+const (
+	// drainメソッドが終了の予告と共に送信するPINGフレームのペイロード
+	drainPingPayload = "h2sdrain"
+
+	// 終了の予告から、新たなストリームの拒否を開始するまでの時間の上限
+	drainGrace = time.Second
+)
+
+// リクエストボディのために事前に確保する容量の上限
+const maxBodyPrealloc = 1 << 20
+
+// RFC 9113 5.1節の7状態を扱う。
+// サーバーはプッシュを行わず、クライアントもプッシュを行えないため、
+// reserved(local), reserved(remote)状態に遷移することは現状無い
 const (
 	idleStream streamState = iota
+	reservedLocalStream
+	reservedRemoteStream
 	openStream
+	halfClosedLocalStream
 	halfClosedRemoteStream
 	closedStream
 )
 
+// ストリームの状態を遷移させるイベント
+type streamEvent uint8
+
+const (
+	recvHeaders     streamEvent = iota // HEADERSフレームの受信
+	sendHeaders                        // HEADERSフレームの送信
+	recvPushPromise                    // PUSH_PROMISEフレームの受信
+	sendPushPromise                    // PUSH_PROMISEフレームの送信
+	recvEndStream                      // END_STREAMフラグを伴うフレームの受信
+	sendEndStream                      // END_STREAMフラグを伴うフレームの送信
+	recvReset                          // RST_STREAMフレームの受信
+	sendReset                          // RST_STREAMフレームの送信
+)
+
+// イベント ev による遷移先の状態を返す。
+// 状態を変えないイベントであれば、現在の状態をそのまま返す。
+// イベントを生じさせるフレームを受信可能かどうかは、canAcceptメソッドにより事前に判定しておくこと
+func (st streamState) next(ev streamEvent) streamState {
+	if ev == recvReset || ev == sendReset {
+		return closedStream
+	}
+
+	switch st {
+	case idleStream:
+		switch ev {
+		case recvHeaders, sendHeaders:
+			return openStream
+		case recvPushPromise:
+			return reservedRemoteStream
+		case sendPushPromise:
+			return reservedLocalStream
+		}
+
+	case reservedLocalStream:
+		if ev == sendHeaders {
+			return halfClosedRemoteStream
+		}
+
+	case reservedRemoteStream:
+		if ev == recvHeaders {
+			return halfClosedLocalStream
+		}
+
+	case openStream:
+		switch ev {
+		case recvEndStream:
+			return halfClosedRemoteStream
+		case sendEndStream:
+			return halfClosedLocalStream
+		}
+
+	case halfClosedLocalStream:
+		if ev == recvEndStream {
+			return closedStream
+		}
+
+	case halfClosedRemoteStream:
+		if ev == sendEndStream {
+			return closedStream
+		}
+	}
+
+	return st
+}
+
 // ある状態のストリームが、与えられたフレームを受信可能かどうかを判定する
 func (s *stream) canAccept(f *frame) *h2Error {
 	switch s.state {
 	case idleStream:
-		if f.typ != headersFrame {
+		if f.typ != headersFrame && f.typ != priorityFrame {
 			return newError(protocolError,
 				"idle stream received frame %d", f.typ)
 		}
 
-	case openStream:
+	case reservedLocalStream:
+		if f.typ != windowUpdateFrame && f.typ != rstStreamFrame && f.typ != priorityFrame {
+			return newError(protocolError,
+				"reserved(local) stream received frame %d", f.typ)
+		}
+
+	case reservedRemoteStream:
+		if f.typ != headersFrame && f.typ != rstStreamFrame && f.typ != priorityFrame {
+			return newError(protocolError,
+				"reserved(remote) stream received frame %d", f.typ)
+		}
+
+	case openStream, halfClosedLocalStream:
 		return nil
 
 	case halfClosedRemoteStream:
-		if f.typ != windowUpdateFrame && f.typ != rstStreamFrame {
+		if f.typ != windowUpdateFrame && f.typ != rstStreamFrame && f.typ != priorityFrame {
 			return newError(streamClosedError,
 				"half closed(remote) stream received frame %d", f.typ)
 		}
 
 	case closedStream:
-		if f.typ != windowUpdateFrame && f.typ != rstStreamFrame {
+		if f.typ != windowUpdateFrame && f.typ != rstStreamFrame && f.typ != priorityFrame {
 			return newError(streamClosedError,
 				"closed stream received frame %d", f.typ)
 		}
@@ -60,10 +190,19 @@ func (s *stream) canAccept(f *frame) *h2Error {
 	return nil
 }
 
-func newStreamCollection() *streamCollection {
-	return &streamCollection{
-		entries: make(map[streamID]*stream), maxID: 0,
+func newStreamCollection(clock Clock) *streamCollection {
+	c := &streamCollection{clock: clock}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[streamID]*stream)
 	}
+	return c
+}
+
+// ストリームIDに対応するシャードを返す。
+// クライアントが開始するストリームのIDは奇数であるため、
+// 最下位ビットを除いた値によりシャードを決定する。
+func (c *streamCollection) shard(id streamID) *streamShard {
+	return &c.shards[(id>>1)%streamShards]
 }
 
 // 全ストリーム中から指定IDのストリームを取得する。
@@ -71,262 +210,1278 @@ func newStreamCollection() *streamCollection {
 // ストリームのIDより大きければ擬似的にidle状態のストリームを返し、
 // そうでないなら実際にメモリ上に存在するストリームか、
 // 擬似的にclosed状態のストリームを返す。
+// idle状態のストリームは以降保存されることが多いためスラブから確保するが、
+// closed状態のストリームは保存されないため単にヒープに確保する。
 func (c *streamCollection) get(id streamID) *stream {
-	if id <= c.maxID {
-		s, ok := c.entries[id]
+	if id <= streamID(atomic.LoadUint32(&c.maxID)) {
+		sh := c.shard(id)
+		sh.mu.RLock()
+		s, ok := sh.entries[id]
+		sh.mu.RUnlock()
+
 		if !ok {
 			s = &stream{state: closedStream}
 		}
 		return s
 	}
-	return &stream{state: idleStream}
+
+	c.slabMu.Lock()
+	defer c.slabMu.Unlock()
+	return c.slab.newStream(idleStream)
 }
 
 // ストリームをメモリ上に保存
 func (c *streamCollection) save(id streamID, s *stream) {
-	c.entries[id] = s
-	if c.maxID < id {
-		c.maxID = id
+	sh := c.shard(id)
+	sh.mu.Lock()
+	sh.entries[id] = s
+	sh.mu.Unlock()
+
+	for {
+		maxID := atomic.LoadUint32(&c.maxID)
+		if uint32(id) <= maxID ||
+			atomic.CompareAndSwapUint32(&c.maxID, maxID, uint32(id)) {
+			return
+		}
 	}
 }
 
+// getメソッドにより得た、保存していないidle状態のストリームをスラブに返却する
+func (c *streamCollection) release(s *stream) {
+	c.slabMu.Lock()
+	c.slab.release(s)
+	c.slabMu.Unlock()
+}
+
 // ストリームをclosed状態とする。
 // closed状態のストリームを実際にメモリ上に保持しておく必要はないため、
-// deleteにより削除しておく
+// deleteにより削除し、スラブに返却しておく
 func (c *streamCollection) close(id streamID) {
-	delete(c.entries, id)
+	sh := c.shard(id)
+	sh.mu.Lock()
+	s, ok := sh.entries[id]
+	delete(sh.entries, id)
+	sh.mu.Unlock()
+
+	if ok {
+		c.recentMu.Lock()
+		c.recent.add(id, s.state, c.clock.Now())
+		c.recentMu.Unlock()
+
+		c.slabMu.Lock()
+		c.slab.release(s)
+		c.slabMu.Unlock()
+	}
+}
+
+// ストリーム id をclosedStreamGraceの間に閉じていれば、閉じる直前の状態と真を返す
+func (c *streamCollection) closedRecently(id streamID) (streamState, bool) {
+	c.recentMu.Lock()
+	defer c.recentMu.Unlock()
+	return c.recent.lookup(id, c.clock.Now())
+}
+
+// リクエストボディ用のバッファをスラブから確保する
+func (c *streamCollection) newBody(capacity int) []byte {
+	c.slabMu.Lock()
+	defer c.slabMu.Unlock()
+	return c.slab.newBody(capacity)
+}
+
+// メモリ上に存在する全てのストリームについて fn を呼び出す。
+// fn の中でこのコレクションを操作してはならない。
+func (c *streamCollection) forEach(fn func(id streamID, s *stream)) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		for id, s := range sh.entries {
+			fn(id, s)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// メモリ上に存在するストリームの数を返す
+func (c *streamCollection) len() int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		n += len(sh.entries)
+		sh.mu.RUnlock()
+	}
+	return n
 }
 
-// multiplexerコンポーネントを表す構造体
+// multiplexerコンポーネントを表す構造体。
+// multiplexerコンポーネントは独自のゴルーチンを持たず、
+// readerコンポーネントのゴルーチンとリクエストハンドラーのゴルーチンから
+// 呼び出される。これらの間の排他制御はmuにより行う。
 type multiplexer struct {
-	logger logger
-	writer *writer
+	mu sync.Mutex
+
+	// コネクションのコンテキスト。リクエストのコンテキストはこれから派生させる
+	ctx context.Context
 
-	in chan *frame
+	logger  logger
+	writer  *writer
+	server  *Server
+	metrics Metrics
 
 	indexTable *hpack.IndexTable
+	tableStats hpack.TableStats // 前回メトリクスとして通知した利用状況
 	streams    *streamCollection
 
+	// クライアントから受信したSETTINGSフレームの値
+	peerSettings PeerSettings
+
 	handler         http.Handler
-	response        chan *responseWriter
 	runningHandlers int
+	closing         bool // 終了が指示されていれば真
+
+	// Server.Shutdown, Conn.Drainメソッドや、クライアントのGOAWAYフレームによる終了の状態。
+	// announcedは終了を予告する1段階目のGOAWAYフレームを送信した後、
+	// drainingは2段階目のGOAWAYフレームを送信して新たなストリームを拒否している間、
+	// drainedは処理中のストリームが無くなり接続を閉じた後に真となる。
+	// drainPingは予告と共に送信したPINGフレームのペイロード、
+	// drainTimerはそのACKを待つ時間の上限のタイマー。
+	// drainReasonはGOAWAYフレームのデバッグデータとする終了の理由。
+	// lastStreamIDは処理を開始した最大のストリームID。
+	announced    bool
+	draining     bool
+	drained      bool
+	drainPing    [8]byte
+	drainTimer   Timer
+	drainReason  string
+	lastStreamID streamID
+
+	// リクエストのコンテキストを通じてリクエストハンドラーに公開する値
+	conn *Conn
+
+	// 新たなストリームのレート制限。Server.MaxStreamsPerSecondが0ならnil
+	streamRate *tokenBucket
+
+	// クライアントによるストリームのリセットのレート制限。Server.MaxResetsPerSecondが0ならnil。
+	// resetThrottledは上限を超過し、新たなストリームを拒否している間に真となる。
+	resetRate      *tokenBucket
+	resetThrottled bool
+
+	// クライアントにより閉じられたが、リクエストハンドラーが実行中のストリームの数。
+	// 閉じられたストリームを直ちに並行するストリームの数から除くと、
+	// ストリームを開いて閉じることを繰り返すクライアントが際限なくリクエストハンドラーを起動できてしまう。
+	resetHandlers int
+
+	// Server.RateLimitsによるレート制限のキーとするクライアントのIPアドレス
+	clientIP string
+
+	// Server.Validationに基づく検証の設定
+	validation validation
+
+	// 処理中のストリームが無い状態が続いた場合にコネクションを閉じるためのタイマー
+	idleTimeout time.Duration
+	idleTimer   Timer
 }
 
 func newMultiplexer(
+	ctx context.Context,
 	logger logger,
 	writer *writer,
 	handler http.Handler,
+	server *Server,
 ) *multiplexer {
-	return &multiplexer{
-		logger: logger,
-		writer: writer,
-		in:     make(chan *frame),
+	mp := &multiplexer{
+		ctx:     ctx,
+		logger:  logger,
+		writer:  writer,
+		server:  server,
+		metrics: server.metrics(),
 
-		indexTable: hpack.NewIndexTable(4096),
-		streams:    newStreamCollection(),
-		handler:    handler,
-		response:   make(chan *responseWriter),
+		indexTable:   hpack.NewIndexTable(initialTableSize(server)),
+		streams:      newStreamCollection(server.clock()),
+		peerSettings: defaultPeerSettings(),
+		handler:      handler,
+		idleTimeout:  server.IdleTimeout,
+		validation:   server.Validation.validation(),
 	}
+
+	if server.MaxStreamsPerSecond > 0 {
+		mp.streamRate = newTokenBucket(
+			server.MaxStreamsPerSecond, server.StreamRateBurst, server.clock().Now())
+	}
+	if server.MaxResetsPerSecond > 0 {
+		mp.resetRate = newTokenBucket(
+			server.MaxResetsPerSecond, server.ResetRateBurst, server.clock().Now())
+	}
+
+	mp.resetIdleTimer()
+	return mp
+}
+
+// SETTINGSフレームを送信する前後のいずれのクライアントのヘッダーブロックもデコードできるよう、
+// インデックステーブルのサイズの上限は、ACKを受信するまでは初期値と通知した値の大きい方とする
+func initialTableSize(server *Server) int {
+	if size := server.headerTableSize(); size > defaultHeaderTableSize {
+		return size
+	}
+	return defaultHeaderTableSize
 }
 
-// 他のコンポーネントからフレームを渡す
-func (mp *multiplexer) multiplex(f *frame) {
-	mp.in <- f
+// 送信したSETTINGSフレームのACKを受信した場合に呼び出す。
+// 以降、クライアントは通知したHeaderTableSizeに従うため、インデックステーブルのサイズの上限に反映する。
+func (mp *multiplexer) settingsAcked() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.indexTable.UpdateAllowedTableSize(mp.server.headerTableSize())
+	mp.reportTableStats()
 }
 
-// multiplexerコンポーネントの終了を指示
+// PRIORITY_UPDATEフレームにより通知された優先度をwriterコンポーネントに反映する。
+// 接続を継続できないエラーが発生した場合は偽を返す。
+func (mp *multiplexer) updatePriority(f *frame) bool {
+	if f.streamID != 0 {
+		mp.writer.writeGoAway(protocolError, "PRIORITY_UPDATE frame received on stream %d", f.streamID)
+		return false
+	}
+	if len(f.payload) < 4 {
+		mp.writer.writeGoAway(frameSizeError, "invalid PRIORITY_UPDATE frame")
+		return false
+	}
+
+	id := streamID(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+	if id == 0 {
+		mp.writer.writeGoAway(protocolError, "PRIORITY_UPDATE frame for stream 0")
+		return false
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	// 閉じたストリームや、クライアントが開くことのない偶数IDのストリームの優先度は不要
+	s := mp.streams.get(id)
+	state := s.state
+	if state == idleStream {
+		mp.streams.release(s)
+	}
+	if state == closedStream || id%2 == 0 {
+		return true
+	}
+
+	mp.writer.prioritize(id, parsePriority(string(f.payload[4:])), true)
+	return true
+}
+
+// クライアントによるストリームのリセットを計上し、レート制限の範囲内なら真を返す。
+// 超過した場合、Server.ResetRateGoAwayが真なら偽を返してコネクションを閉じさせ、
+// 偽なら真を返した上で、トークンが補充されるまで新たなストリームを拒否する。
+func (mp *multiplexer) allowReset() bool {
+	if mp.resetRate == nil {
+		return true
+	}
+
+	now := mp.server.clock().Now()
+	if mp.resetRate.take(now) {
+		mp.resetThrottled = false
+		return true
+	}
+
+	mp.metrics.Add("h2s_rapid_reset_total", 1, nil)
+	if mp.server.ResetRateGoAway {
+		return false
+	}
+	if !mp.resetThrottled {
+		mp.logger.info("too many stream resets, refusing new streams")
+	}
+	mp.resetThrottled = true
+	return true
+}
+
+// multiplexerコンポーネントの終了を指示。
+// 実行中のリクエストハンドラーがあれば、
+// それらのレスポンスを送信し終えてからwriterコンポーネントの終了を指示する。
 func (mp *multiplexer) shutdown() {
-	close(mp.in)
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.closing = true
+	mp.shutdownIfIdle()
 }
 
-// multiplexerコンポーネントの起動。
-// 受け取ったフレームにより表現されるストリームとHTTPリクエストを処理する。
-func (mp *multiplexer) run() {
-	go func() {
-		// multiplexerコンポーネントが処理を返す、
-		// つまりwriterコンポーネントへ誰もフレームを渡さないことが
-		// 確定してからそれの終了を指示する。
-		defer func() {
-			for mp.runningHandlers > 0 {
-				mp.writeResponse(<-mp.response)
-			}
+// 終了が指示されており、かつ実行中のリクエストハンドラーが無ければ、
+// つまりwriterコンポーネントへ誰もフレームを渡さないことが
+// 確定していればwriterコンポーネントの終了を指示する。
+func (mp *multiplexer) shutdownIfIdle() {
+	if !mp.closing || mp.runningHandlers > 0 {
+		return
+	}
 
-			mp.writer.shutdown()
-			mp.logger("multiplexer shutdown")
-		}()
+	if mp.idleTimer != nil {
+		mp.idleTimer.Stop()
+	}
+	mp.writer.shutdown()
+	mp.logger.debug("multiplexer shutdown")
+}
 
-		for {
-			select {
-			case res := <-mp.response:
-				mp.writeResponse(res)
+// 処理中のストリームが無ければ、IdleTimeoutの経過後にコネクションを閉じるよう
+// タイマーを再設定する。ストリームがあればタイマーを止める。
+// muを獲得した上で、ストリームの状態が変化し得る度に呼び出す。
+func (mp *multiplexer) resetIdleTimer() {
+	if mp.idleTimeout <= 0 || mp.closing {
+		return
+	}
 
-			case f, ok := <-mp.in:
-				if !ok {
-					return
-				}
+	if mp.runningHandlers > 0 || mp.streams.len() > 0 {
+		if mp.idleTimer != nil {
+			mp.idleTimer.Stop()
+		}
+		return
+	}
 
-				// エラーが発生した場合、PROTOCOL_ERRORなら
-				// GOAWAYフレームにより接続を切断、それ以外のエラーなら
-				// RST_STREAMフレームを送信しストリームをclosed状態とする。
-				if f.streamID != 0 {
-					s := mp.streams.get(f.streamID)
-					if err := s.canAccept(f); err != nil {
-						if err.code == protocolError {
-							mp.writer.write(buildGoAwayFrame(err))
-							return
-						} else {
-							mp.writer.write(
-								buildRstStreamFrame(f.streamID, err))
-							mp.streams.close(f.streamID)
-							continue
-						}
-					}
+	if mp.idleTimer == nil {
+		mp.idleTimer = mp.server.clock().AfterFunc(mp.idleTimeout, mp.closeIdle)
+	} else {
+		mp.idleTimer.Reset(mp.idleTimeout)
+	}
+}
+
+// IdleTimeoutの経過により、GOAWAYフレームを送信してコネクションを閉じる。
+// タイマーの停止と発火が競合し得るため、改めて状態を確認する。
+func (mp *multiplexer) closeIdle() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.closing || mp.runningHandlers > 0 || mp.streams.len() > 0 {
+		return
+	}
+
+	mp.logger.debug("idle timeout")
+	mp.writer.writeGoAway(noError, "idle timeout")
+}
+
+// GOAWAYフレームにより新たなストリームを拒否することをクライアントに通知し、
+// 処理中のストリームが全て完了した時点で接続を閉じる。
+// Server.Shutdown, Conn.Drainメソッドから呼び出され、通知は1度だけ行う。
+//
+// RFC 9113 6.8節に従い、まず最終ストリームIDを最大値とするGOAWAYフレームとPINGフレームにより
+// 終了を予告する。予告の時点でクライアントが送信中のストリームも処理するため、
+// PINGフレームのACKを受信するか、drainGraceが経過した時点で
+// 改めて実際の最終ストリームIDによるGOAWAYフレームを送信し、以降のストリームを拒否する。
+func (mp *multiplexer) drain(reason string) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.closing || mp.announced {
+		return
+	}
+	mp.announced = true
+	mp.drainReason = reason
+
+	f := buildGoAwayFrame(newError(noError, "%s", reason))
+	binary.BigEndian.PutUint32(f.payload, maxStreamID)
+	f.graceful = true
+	copy(mp.drainPing[:], drainPingPayload)
+	mp.writer.writeFrames([]*frame{f, {typ: pingFrame, payload: mp.drainPing[:]}})
+
+	mp.drainTimer = mp.server.clock().AfterFunc(drainGrace, func() {
+		mp.mu.Lock()
+		defer mp.mu.Unlock()
+		mp.startDraining()
+	})
+}
+
+// PINGフレームのACKを受信した場合に呼び出す。
+// drainメソッドが予告と共に送信したPINGフレームに対するものであれば、
+// クライアントは予告を受信済みであるため、新たなストリームの拒否を開始する。
+func (mp *multiplexer) pingAcked(payload []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.announced && !mp.draining && bytes.Equal(payload, mp.drainPing[:]) {
+		mp.startDraining()
+	}
+}
+
+// 実際の最終ストリームIDによるGOAWAYフレームを送信し、新たなストリームの拒否を開始する。
+// 処理を開始したストリームは完了させるため、最終ストリームIDとして
+// writerコンポーネントの最終処理済みストリームIDではなく処理を開始した最大のストリームIDを通知する。
+// muを獲得した上で呼び出す。
+func (mp *multiplexer) startDraining() {
+	if mp.closing || mp.draining {
+		return
+	}
+	mp.draining = true
+	mp.drainTimer.Stop()
+
+	f := buildGoAwayFrame(newError(noError, "%s", mp.drainReason))
+	binary.BigEndian.PutUint32(f.payload, uint32(mp.lastStreamID))
+	f.graceful = true
+	mp.writer.write(f)
+
+	mp.closeIfDrained()
+}
+
+// クライアントからNO_ERRORのGOAWAYフレームを受信した場合に呼び出す。
+// その最終ストリームIDはサーバーが開始するストリームに関するものであり、
+// プッシュを行わないこのサーバーでは、クライアントが開始した処理中のストリームは全て継続する。
+// 新たなストリームを拒否し、処理中のストリームが全て完了した時点で接続を閉じる。
+func (mp *multiplexer) peerGoingAway() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.closing || mp.draining {
+		return
+	}
+	if !mp.announced {
+		mp.announced = true
+		mp.drainReason = "client going away"
+	} else {
+		mp.drainTimer.Stop()
+	}
+	mp.draining = true
+
+	mp.closeIfDrained()
+}
+
+// drainメソッドやクライアントのGOAWAYフレームによる終了の指示後、処理中のストリームが無くなっていれば
+// 改めてGOAWAYフレームを送信して接続を閉じる。
+// muを獲得した上で、ストリームの状態が変化し得る度に呼び出す。
+func (mp *multiplexer) closeIfDrained() {
+	if !mp.draining || mp.drained || mp.closing ||
+		mp.runningHandlers > 0 || mp.streams.len() > 0 {
+		return
+	}
+
+	mp.drained = true
+	mp.writer.writeGoAway(noError, "%s", mp.drainReason)
+}
+
+// readerコンポーネントから受け取ったフレームにより表現される
+// ストリームとHTTPリクエストを処理する。
+// 接続を継続できないエラーが発生した場合は偽を返す。
+func (mp *multiplexer) multiplex(f *frame) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	defer mp.resetIdleTimer()
+	defer mp.closeIfDrained()
+
+	// エラーが発生した場合、PROTOCOL_ERRORなら
+	// GOAWAYフレームにより接続を切断、それ以外のエラーなら
+	// RST_STREAMフレームを送信しストリームをclosed状態とする。
+	// DATA, HEADERSフレームのストリームIDはreaderコンポーネントが検証済み
+	var s *stream
+	if f.streamID == 0 && f.typ == rstStreamFrame {
+		err := newError(protocolError, "frame %d received on stream 0", f.typ)
+
+		// 存在しないストリームのリセットは無視しても影響が無い
+		if mp.server.tolerate(mp.logger, err) {
+			return true
+		}
+		mp.writer.write(buildGoAwayFrame(err))
+		return false
+	}
+
+	if f.streamID != 0 {
+		// クライアントが開始するストリームのIDは奇数である必要がある
+		if f.typ == headersFrame && f.streamID%2 == 0 {
+			mp.writer.write(buildGoAwayFrame(
+				newError(protocolError, "HEADERS frame on even stream %d", f.streamID)))
+			return false
+		}
+
+		s = mp.streams.get(f.streamID)
+
+		// メモリ上に無いストリームはclosed状態として得られる。新たなストリームのIDは
+		// それまでに開始したストリームのIDより大きい必要があり、それ以下のIDは閉じたものとして扱われるため、
+		// そのストリームを開始しようとするHEADERSフレームはコネクションエラーとする。
+		// ただし最近閉じたストリームのHEADERSフレームは、サーバーがストリームを閉じた時点で
+		// クライアントが送信していたトレーラーであり得るため、ストリームエラーに留める。
+		// クライアントがEND_STREAMフラグを送信する前に閉じたストリームなら、
+		// DATAフレームと同様に、ヘッダーブロックをデコードした上で単に破棄する
+		if f.typ == headersFrame && s.state == closedStream {
+			prev, ok := mp.streams.closedRecently(f.streamID)
+			if !ok {
+				mp.writer.write(buildGoAwayFrame(
+					newError(protocolError, "stream %d is not greater than previously opened streams", f.streamID)))
+				return false
+			}
+			if !mp.skipHeaderBlock(f) {
+				return false
+			}
+			if prev == idleStream || prev == openStream || prev == halfClosedLocalStream {
+				mp.logger.debug("discard frame %d on recently closed stream %d", f.typ, f.streamID)
+				return true
+			}
+			mp.writer.write(buildRstStreamFrame(f.streamID,
+				newError(streamClosedError, "HEADERS frame on closed stream %d", f.streamID)))
+			return true
+		}
+
+		// 閉じた時点でクライアントが既に送信していたフレームは、RST_STREAMフレームで
+		// 応答し合うことにならないよう単に破棄する。DATAフレームが送信中であり得るのは、
+		// クライアントがEND_STREAMフラグを送信する前にサーバーがストリームを閉じた場合に限られる。
+		// DATAフレームの分のコネクションレベルのウィンドウサイズはreaderコンポーネントが戻している。
+		// WINDOW_UPDATEフレームはwriterコンポーネントが退避しているDATAフレームの送信に必要であるため、
+		// ここでは破棄せずwriterコンポーネントに判断させる
+		if s.state == closedStream && (f.typ == dataFrame || f.typ == rstStreamFrame) {
+			if prev, ok := mp.streams.closedRecently(f.streamID); ok &&
+				(f.typ == rstStreamFrame || prev == idleStream || prev == openStream || prev == halfClosedLocalStream) {
+				mp.logger.debug("discard frame %d on recently closed stream %d", f.typ, f.streamID)
+				return true
+			}
+		}
+
+		if err := s.canAccept(f); err != nil {
+			// DATAフレームのフロー制御はreaderコンポーネントで済ませているため、
+			// ストリームの状態に合わないフレームは無視しても影響が無い。
+			// ただしHEADERSフレームはHPACKの動的テーブルを更新するヘッダーブロックを持ち、
+			// idle状態のストリームのDATAフレームに対しては、readerコンポーネントが
+			// idle状態のストリームにWINDOW_UPDATEフレームを送信してしまっているため無視できない
+			if f.typ != headersFrame && (s.state != idleStream || f.typ != dataFrame) &&
+				mp.server.tolerate(mp.logger, err) {
+				if s.state == idleStream {
+					mp.streams.release(s)
 				}
+				return true
+			}
+
+			if err.code == protocolError {
+				mp.writer.write(buildGoAwayFrame(err))
+				return false
+			} else {
+				mp.writer.write(buildRstStreamFrame(f.streamID, err))
+				mp.discardBody(s)
+				mp.streams.close(f.streamID)
+				return true
+			}
+		}
+	}
+
+	switch f.typ {
+	case dataFrame:
+		// ペイロードをリクエストボディとしてストリームに紐付け保存する。
+		// END_STREAMフラグが立っている場合、この時点で
+		// HTTPリクエストの受信完了となるため、runHandlerメソッドにより
+		// リクエストハンドラーを起動する。
+		// ペイロードは読み込みバッファを参照しているため、
+		// リクエストボディに追加する形で複製して保持する。
+		// CONNECTメソッドのリクエストなら、既に起動しているリクエストハンドラーにトンネルを通じて渡す。
+		if s.tunnel != nil {
+			s.tunnel.push(f.payload)
+			if f.flags.eos() {
+				s.tunnel.finish(io.EOF)
+				s.state = s.state.next(recvEndStream)
+			}
+			return true
+		}
+
+		if max := s.limits.MaxBodyBytes; max > 0 && int64(len(s.body)+len(f.payload)) > max {
+			mp.discardBody(s)
+			mp.respondEarly(f.streamID, s, http.StatusRequestEntityTooLarge, f.flags.eos())
+			return true
+		}
+
+		s.body = append(s.body, f.payload...)
+		mp.writer.mem.add(len(f.payload))
+		if f.flags.eos() {
+			s.state = s.state.next(recvEndStream)
+			mp.runHandler(f.streamID, s)
+		}
+
+	case headersFrame:
+		// HEADERSフレームなら、ペイロードを
+		// ヘッダーブロックとしてデコードし、
+		// 結果をリクエストヘッダーとしてストリームに紐付け保存する。
+		// END_STREAMフラグが立っている場合、この時点で
+		// HTTPリクエストの受信完了となるため、runHandlerメソッドにより
+		// リクエストハンドラーを起動する。
+		// フラグが立っていない場合open状態として保存し、
+		// 後続のDATAフレームを待つ。
+		mp.server.corpus.save(corpusHPACK, f.payload)
+
+		headers, err := hpack.DecodeHeaderBlock(mp.indexTable, f.payload)
+		if err != nil {
+			mp.writer.writeGoAway(compressionError,
+				"failed to decode header block")
+			return false
+		}
+		mp.reportTableStats()
+
+		// トンネルのリクエストボディの終端を表すトレーラー以外は受け付けない
+		if s.tunnel != nil {
+			headers.Release()
+			if f.flags.eos() {
+				s.tunnel.finish(io.EOF)
+				s.state = s.state.next(recvEndStream)
+			}
+			return true
+		}
+
+		// open状態のストリームのHEADERSフレームはトレーラーであり、END_STREAMフラグを伴う必要がある
+		if s.state == openStream {
+			if !f.flags.eos() {
+				headers.Release()
+				mp.writer.write(buildRstStreamFrame(f.streamID,
+					newError(protocolError, "trailers without END_STREAM")))
+				mp.discardBody(s)
+				mp.streams.close(f.streamID)
+				return true
+			}
 
-				switch f.typ {
-				case dataFrame:
-					// ペイロードをリクエストボディとしてストリームに紐付け保存する。
-					// END_STREAMフラグが立っている場合、この時点で
-					// HTTPリクエストの受信完了となるため、runHandlerメソッドにより
-					// リクエストハンドラーを起動する。
-					s := mp.streams.get(f.streamID)
-					s.body = append(s.body, f)
-					if f.flags.eos() {
-						mp.runHandler(f.streamID, s)
-					}
-
-				case headersFrame:
-					// HEADERSフレームなら、ペイロードを
-					// ヘッダーブロックとしてデコードし、
-					// 結果をリクエストヘッダーとしてストリームに紐付け保存する。
-					// END_STREAMフラグが立っている場合、この時点で
-					// HTTPリクエストの受信完了となるため、runHandlerメソッドにより
-					// リクエストハンドラーを起動する。
-					// フラグが立っていない場合open状態として保存し、
-					// 後続のDATAフレームを待つ。
-					headers, err := hpack.DecodeHeaderBlock(
-						mp.indexTable,
-						f.payload,
-					)
-					if err != nil {
-						mp.writer.writeGoAway(compressionError,
-							"failed to decode header block")
-						return
-					}
-
-					s := mp.streams.get(f.streamID)
-					s.headers = append(s.headers, headers...)
-					if f.flags.eos() {
-						mp.runHandler(f.streamID, s)
-					} else {
-						s.state = openStream
-						mp.streams.save(f.streamID, s)
-					}
-
-				case rstStreamFrame:
-					// クライアントからRST_STREAMを受信した場合、
-					// 対象ストリームをclosed状態とする。
-					code := binary.BigEndian.Uint32(f.payload)
-					mp.logger("received RST_STREAM. code=%d", code)
-					mp.streams.close(f.streamID)
-
-				case settingsFrame:
-					params := decodeSettingsParams(f)
-
-					if value, ok := params[headerTableSizeSetting]; ok {
-						mp.indexTable.UpdateAllowedTableSize(int(value))
-					}
-
-					mp.writer.changeSettings(params)
-
-				case windowUpdateFrame:
-					// ペイロードを加算するウィンドウサイズとしてデコードし、
-					// writerコンポーネントに渡す
-					size := int64(binary.BigEndian.Uint32(f.payload))
-					mp.writer.incrWindow(f.streamID, size)
+			s.trailers = append(s.trailers, headers...)
+			headers.Release()
+			s.state = s.state.next(recvEndStream)
+			mp.runHandler(f.streamID, s)
+			return true
+		}
+
+		// 並行するストリームの数や新たなストリームのレートが上限に達しているか、
+		// 終了の指示により新たなストリームを受け付けていなければ、
+		// ヘッダーブロックをデコードした上でストリームを拒否する
+		if s.state == idleStream {
+			var refused string
+			if limit := mp.server.MaxConcurrentStreams; limit > 0 &&
+				mp.streams.len()+mp.resetHandlers >= int(limit) {
+				refused = "too many concurrent streams"
+			} else if mp.resetThrottled && mp.resetRate.available(mp.server.clock().Now()) < 1 {
+				refused = "too many stream resets"
+			} else if mp.draining {
+				refused = "connection is draining"
+			} else if reason := mp.server.load.overloaded(); reason != "" {
+				mp.server.load.shed("stream", reason)
+				if mp.server.ShedWithServiceUnavailable {
+					s.shed = true
+				} else {
+					refused = "server overloaded"
+				}
+			} else if mp.streamRate != nil && !mp.streamRate.take(mp.server.clock().Now()) {
+				refused = "too many new streams"
+				mp.metrics.Add("h2s_stream_rate_limited_total", 1, nil)
+				if mp.server.StreamRateGoAway {
+					headers.Release()
+					mp.writer.writeGoAway(enhanceYourCalm, refused)
+					return false
 				}
 			}
+
+			if refused != "" {
+				headers.Release()
+				mp.writer.write(buildRstStreamFrame(f.streamID,
+					newError(refusedStream, refused)))
+				mp.streams.save(f.streamID, s)
+				mp.streams.close(f.streamID)
+				return true
+			}
+
+			if f.streamID > mp.lastStreamID {
+				mp.lastStreamID = f.streamID
+			}
+
+			// 先に受信したPRIORITY_UPDATEフレームによる優先度があれば、そちらを優先する
+			if hf := headers.Get("priority"); hf != nil {
+				mp.writer.prioritize(f.streamID, parsePriority(hf.Value()), false)
+			}
+
+			// :authorityやパスに応じた上限を決定し、リクエストヘッダーがそれを超えていれば
+			// リクエストボディの受信を待たずにレスポンスを返す
+			s.limits = mp.server.requestLimits(headers)
+			if status := s.limits.checkHeaders(headers); status != 0 {
+				headers.Release()
+				mp.respondEarly(f.streamID, s, status, f.flags.eos())
+				return true
+			}
 		}
-	}()
+
+		s.headers = append(s.headers, headers...)
+		headers.Release()
+		s.state = s.state.next(recvHeaders)
+		if f.flags.eos() {
+			s.state = s.state.next(recvEndStream)
+			mp.runHandler(f.streamID, s)
+		} else if isConnect(s.headers) {
+			// CONNECTメソッドならリクエストボディを待たずにトンネルを開始する
+			mp.runHandler(f.streamID, s)
+		} else {
+			s.body = mp.streams.newBody(bodyCapacity(s.headers))
+			mp.streams.save(f.streamID, s)
+		}
+
+	case rstStreamFrame:
+		// クライアントからRST_STREAMを受信した場合、
+		// 対象ストリームをclosed状態とする。
+		code := binary.BigEndian.Uint32(f.payload)
+		mp.logger.debug("received RST_STREAM. code=%d", code)
+		if !mp.allowReset() {
+			mp.writer.writeGoAway(enhanceYourCalm, "too many stream resets")
+			return false
+		}
+		mp.abortStream(s, &StreamError{
+			StreamID: uint32(f.streamID),
+			Code:     errorCode(code),
+			Reason:   "stream reset by client",
+		})
+		mp.streams.close(f.streamID)
+		mp.writer.forgetPriority(f.streamID)
+
+	case priorityFrame:
+		// readerコンポーネントはペイロード長に誤りのあるPRIORITYフレームのみを渡すため、
+		// ストリームエラーとしてストリームを閉じる
+		err := newError(frameSizeError, "invalid PRIORITY length(%d)", len(f.payload))
+		if f.streamID == 0 {
+			mp.writer.write(buildGoAwayFrame(err))
+			return false
+		}
+		mp.writer.write(buildRstStreamFrame(f.streamID, err))
+		if s.state == idleStream {
+			mp.streams.release(s)
+			return true
+		}
+		mp.abortStream(s, err.streamError(f.streamID))
+		mp.streams.close(f.streamID)
+		mp.writer.forgetPriority(f.streamID)
+
+	case settingsFrame:
+		params := decodeSettingsParams(f)
+		if err := mp.validation.checkSettings(params); err != nil {
+			mp.writer.write(buildGoAwayFrame(err))
+			return false
+		}
+
+		// クライアントのSETTINGS_HEADER_TABLE_SIZEはレスポンスヘッダーのエンコードに関わるものであり、
+		// リクエストヘッダーのデコードに用いるインデックステーブルには影響しない
+		mp.peerSettings.apply(params)
+		if err := mp.writer.changeSettings(params); err != nil {
+			mp.writer.write(buildGoAwayFrame(err))
+			return false
+		}
+
+	case windowUpdateFrame:
+		// ペイロードを加算するウィンドウサイズとしてデコードし、
+		// writerコンポーネントに渡す
+		size := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+
+		// 0の加算はPROTOCOL_ERROR、ウィンドウサイズが上限を超える加算はFLOW_CONTROL_ERRORであり、
+		// いずれもストリーム0ならコネクションエラー、それ以外ならストリームエラーとする
+		var err *h2Error
+		if size == 0 {
+			err = newError(protocolError, "WINDOW_UPDATE with 0 increment on stream %d", f.streamID)
+		} else {
+			err = mp.writer.incrWindow(f.streamID, size, s != nil && s.state == closedStream)
+		}
+		if err == nil {
+			return true
+		}
+
+		if f.streamID == 0 {
+			mp.writer.write(buildGoAwayFrame(err))
+			return false
+		}
+		mp.writer.write(buildRstStreamFrame(f.streamID, err))
+		mp.abortStream(s, err.streamError(f.streamID))
+		mp.streams.close(f.streamID)
+		mp.writer.forgetPriority(f.streamID)
+	}
+
+	return true
+}
+
+// 処理しないHEADERSフレーム f のヘッダーブロックを、HPACKの動的テーブルを
+// クライアントと同期させるためだけにデコードする。
+// デコードに失敗した場合はGOAWAYフレームを送信し、偽を返す。
+func (mp *multiplexer) skipHeaderBlock(f *frame) bool {
+	headers, err := hpack.DecodeHeaderBlock(mp.indexTable, f.payload)
+	if err != nil {
+		mp.writer.writeGoAway(compressionError, "failed to decode header block")
+		return false
+	}
+	headers.Release()
+	mp.reportTableStats()
+	return true
+}
+
+// ストリーム s のリクエストボディを破棄し、実行中のリクエストハンドラーがあれば err によりリセットする。
+// ストリームを閉じるのは呼び出し側で行う
+func (mp *multiplexer) abortStream(s *stream, err *StreamError) {
+	if s.res != nil {
+		if s.tunnel != nil {
+			s.tunnel.finish(err)
+		}
+		mp.resetHandlers++
+		s.res.reset(err)
+	}
+	mp.discardBody(s)
 }
 
 func (mp *multiplexer) runHandler(id streamID, stream *stream) {
 	// リクエストが生成出来ない場合はPROTOCOL_ERRORの
 	// ストリームエラーを通知することとされている
-	req, err := buildRequest(stream.headers, stream.body)
+	var req *http.Request
+	var err error
+	if herr := checkFields(stream.headers); herr != nil {
+		err = herr
+	} else if herr := checkFraming(stream.headers, len(stream.body)); herr != nil {
+		err = herr
+	} else if herr := mp.validation.checkHeaders(stream.headers); herr != nil {
+		err = herr
+	} else if herr := checkConnect(stream.headers); herr != nil {
+		err = herr
+	} else if herr := mp.validation.checkTrailers(stream.trailers); herr != nil {
+		err = herr
+	} else {
+		req, err = buildRequest(stream.headers, stream.trailers, stream.body)
+	}
+	bodyLen := len(stream.body)
+	mp.discardBody(stream)
 	if err != nil {
-		mp.logger("(stream: %d) build request err %s", id, err)
+		mp.logger.debug("(stream: %d) build request err %s", id, err)
 		err = newError(protocolError, "request error")
 		mp.writer.write(buildRstStreamFrame(id, err))
+
+		// 一旦保存した上でclosed状態とし、ストリームをスラブに返却する
+		mp.streams.save(id, stream)
 		mp.streams.close(id)
 		return
 	}
 
-	stream.state = halfClosedRemoteStream
+	if mp.server.DecompressRequests {
+		decompressRequest(req, mp.server.MaxDecompressedBytes)
+	}
+
+	// CONNECTメソッドのトンネルは、クライアントがストリームを閉じるまでopen状態を保つ
+	connect := req.Method == http.MethodConnect
 	mp.streams.save(id, stream)
 	mp.runningHandlers++
+	mp.server.load.handlerStarted()
+	handler := mp.handler
+	if stream.shed {
+		handler = overloadedHandler
+	} else if !mp.server.allowedHost(req.Host) {
+		mp.metrics.Add("h2s_misdirected_requests_total", 1, nil)
+		handler = misdirectedHandler
+	} else if !mp.server.ipRate.allow(mp.clientIP, req.URL.Path, mp.server.clock().Now()) {
+		mp.metrics.Add("h2s_rate_limited_total", 1, nil)
+		handler = rateLimitedHandler
+	}
+
+	req, cancelStream := mp.conn.withContext(req)
+	req, cancelTimeout := stream.limits.withTimeout(req)
 
-	mp.logger("start http request processing. stream=%d", id)
+	mp.logger.debug("start http request processing. stream=%d", id)
+	clock := mp.server.clock()
+	res := newResponseWriter(id, clock.Now())
+	res.spoolThreshold = mp.server.ResponseSpoolThreshold
+	res.spoolDir = mp.server.SpoolDir
+	res.cancel = cancelStream
+	res.head = req.Method == http.MethodHead
+	if tracer := mp.server.Tracer; tracer != nil {
+		ctx, span := tracer.StartSpan(req, extractSpanContext(req.Header))
+		req = req.WithContext(ctx)
+		res.span = span
+	}
+	res.method, res.path, res.authority = req.Method, req.RequestURI, req.Host
+	res.bytesRead = int64(bodyLen)
+	res.ctx = req.Context()
+	res.send = func(f *frame, final bool) bool {
+		return mp.sendFromHandler(res, f, final)
+	}
+	stream.res = res
+	if connect {
+		stream.tunnel = newTunnel(req.Context(), mp.writer.mem)
+		if stream.state != openStream {
+			stream.tunnel.finish(io.EOF)
+		}
+		req.Body = stream.tunnel
+		res.tunnel = stream.tunnel
+	}
+	if timeout := stream.limits.HandlerTimeout; timeout > 0 {
+		d := &handlerDeadline{}
+		d.timer = clock.AfterFunc(timeout, func() { mp.handlerTimedOut(id, res, d) })
+		res.deadline = d
+	}
 	go func() {
-		res := newResponseWriter(id)
-		mp.handler.ServeHTTP(res, req)
-		mp.response <- res
+		res.started = clock.Now()
+		mp.serveHTTP(handler, res, req)
+		res.finished = clock.Now()
+		cancelTimeout()
+		cancelStream()
+
+		// 実行時間の上限を超えていれば、ストリームは既に閉じられている
+		reclaimed := res.deadline != nil && mp.handlerReturned(res.deadline)
+
+		// 一時ファイルに退避されたレスポンスボディは
+		// 送信に時間を要するため、muを獲得せずに送信する
+		if res.spool != nil && !res.aborted && !reclaimed {
+			mp.streamSpool(res)
+		}
+
+		mp.mu.Lock()
+		defer mp.mu.Unlock()
+		mp.writeResponse(res)
+	}()
+}
+
+// リクエストハンドラーのゴルーチンから、Flushメソッド等によりレスポンスを構成するフレームを送信する。
+// ストリームが既に閉じられていれば送信せずに偽を返す。
+// final が真ならレスポンスヘッダーの送信として記録し、実行時間の上限を超えた際に503を返さないようにする。
+func (mp *multiplexer) sendFromHandler(res *responseWriter, f *frame, final bool) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	state := mp.streams.get(res.id).state
+	if state != openStream && state != halfClosedRemoteStream {
+		return false
+	}
+	if final {
+		res.headerSent = true
+	}
+	mp.writer.write(f)
+	return true
+}
+
+// リクエストハンドラーが終了した際に、実行時間の上限のタイマーを停止する。
+// 既に上限を超えてストリームが閉じられていれば真を返す。
+func (mp *multiplexer) handlerReturned(d *handlerDeadline) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	d.timer.Stop()
+	d.finished = true
+	return d.reclaimed
+}
+
+// リクエストハンドラーが実行時間の上限を超えた場合に、その終了を待たずにストリームを閉じる。
+// リクエストハンドラーは以降も実行され得るが、実行中のリクエストハンドラーの数からは除き、
+// その終了時にはレスポンスを送信しない。
+func (mp *multiplexer) handlerTimedOut(id streamID, res *responseWriter, d *handlerDeadline) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if d.finished {
+		return
+	}
+	d.reclaimed = true
+
+	defer mp.shutdownIfIdle()
+	defer mp.resetIdleTimer()
+	defer mp.closeIfDrained()
+
+	mp.logger.info("(stream: %d) handler timed out", id)
+	mp.metrics.Add("h2s_handler_timeouts_total", 1, nil)
+	mp.runningHandlers--
+	mp.server.load.handlerFinished()
+
+	// クライアントにより既に閉じられていれば、その計上を除くのみ
+	clientReset := res.streamErr() != nil
+	res.reset(&StreamError{StreamID: uint32(id), Code: cancelError, Reason: "handler timeout"})
+	if res.tunnel != nil {
+		res.tunnel.Close()
+	}
+	if clientReset {
+		mp.resetHandlers--
+		return
+	}
+
+	s := mp.streams.get(id)
+	if s.state != openStream && s.state != halfClosedRemoteStream {
+		return
+	}
+
+	if s.limits.TimeoutWithServiceUnavailable && !res.headerSent {
+		unavailable := newResponseWriter(id, mp.server.clock().Now())
+		http.Error(unavailable, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		mp.writer.writeFrames(unavailable.buildFrames())
+		unavailable.release()
+
+		if s.state == openStream {
+			mp.writer.write(buildRstStreamFrame(id, newError(noError, "handler timeout")))
+		}
+	} else {
+		mp.writer.write(buildRstStreamFrame(id, newError(cancelError, "handler timeout")))
+	}
+
+	mp.discardBody(s)
+	mp.streams.close(id)
+}
+
+// リクエストハンドラーを呼び出さずに、ステータスコード status のレスポンスを送信してストリームを閉じる。
+// リクエストを受信し終えていない(eos が偽)なら、続けてNO_ERRORのRST_STREAMフレームを送信し、
+// 残りのリクエストボディの送信を中断させる。
+func (mp *multiplexer) respondEarly(id streamID, s *stream, status int, eos bool) {
+	res := newResponseWriter(id, mp.server.clock().Now())
+	defer res.release()
+
+	http.Error(res, http.StatusText(status), status)
+	mp.writer.writeFrames(res.buildFrames())
+	if !eos {
+		mp.writer.write(buildRstStreamFrame(id, newError(noError, "early response")))
+	}
+	mp.metrics.Add("h2s_requests_total", 1, Labels{"status": strconv.Itoa(status)})
+
+	// 一旦保存した上でclosed状態とし、ストリームをスラブに返却する
+	mp.streams.save(id, s)
+	mp.streams.close(id)
+}
+
+// リクエストハンドラーを実行する。
+// net/httpと同様に、リクエストハンドラーのパニックはサーバー全体を停止させず、
+// そのストリームのみをRST_STREAMフレームにより閉じる。
+// http.ErrAbortHandlerによるパニックは意図的な中断とみなしログを出力しない。
+func (mp *multiplexer) serveHTTP(handler http.Handler, res *responseWriter, req *http.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			res.aborted = true
+			if v != http.ErrAbortHandler {
+				mp.logger.error("(stream: %d) panic in handler: %v\n%s", res.id, v, debug.Stack())
+			}
+		}
 	}()
+
+	handler.ServeHTTP(res, req)
 }
 
-// リクエストヘッダーを表すヘッダーリストとリクエストボディを表すペイロードから、
-// HTTP/1のリクエストを再現し、http.ReadRequest関数によりhttp.Request型の値を生成。
+// content-lengthヘッダーからリクエストボディのために確保する容量を決定する。
+// 後続のDATAフレームの追加時に再確保と複製が繰り返されることを避けるためだが、
+// 値はクライアントが自由に指定できるため、maxBodyPreallocを上限とする。
+func bodyCapacity(headers hpack.HeaderList) int {
+	cl := headers.Get("content-length")
+	if cl == nil {
+		return 0
+	}
+
+	n, err := strconv.Atoi(cl.Value())
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	if n > maxBodyPrealloc {
+		return maxBodyPrealloc
+	}
+	return n
+}
+
+// ストリームが保持するリクエストボディを破棄し、
+// バッファしているバイト数から差し引く
+func (mp *multiplexer) discardBody(s *stream) {
+	mp.writer.mem.add(-len(s.body))
+	s.body = nil
+}
+
+// リクエストヘッダーを表すヘッダーリストとリクエストボディを表すペイロードから、http.Request型の値を生成。
+// HTTP/1のリクエストとして書き出して解釈し直すことはせず、疑似ヘッダーと通常のヘッダーから直接構築する。
+// そのため、ヘッダーの値に含まれる改行等によりリクエストの構造が変わることは無い。
+// trailers はリクエストボディの後に受信したトレーラーであり、http.Request.Trailerとする。
 func buildRequest(
 	headers hpack.HeaderList,
-	bodies []*frame,
+	trailers hpack.HeaderList,
+	body []byte,
 ) (*http.Request, error) {
-	http1Format := bytes.NewBuffer(nil)
-
 	method := headers.Get(":method")
 	authority := headers.Get(":authority")
 	path := headers.Get(":path")
 
-	if headers.Get("host") == nil {
-		headers = append(
-			headers,
-			hpack.NewHeaderField("host", authority.Value()),
-		)
+	if method == nil {
+		return nil, fmt.Errorf("missing :method pseudo-header")
+	}
+	if !validMethod(method.Value()) {
+		return nil, fmt.Errorf("invalid method %q", method.Value())
 	}
 
-	// リクエスト行の書き出し
-	reqLine := method.Value() + " " + path.Value() + " HTTP/1.1\r\n"
-	http1Format.WriteString(reqLine)
-
-	// 疑似ヘッダー以外のリクエストヘッダーの書き出し
-	for _, hf := range headers {
-		if hf.Name()[0] == ':' {
-			continue
+	// CONNECTメソッドのリクエストターゲットは:authorityによるauthority形式となる
+	var target string
+	var u *url.URL
+	switch {
+	case isConnect(headers) && authority != nil:
+		target = authority.Value()
+		u = &url.URL{Host: target}
+	case path != nil:
+		target = path.Value()
+		var err error
+		if u, err = url.ParseRequestURI(target); err != nil {
+			return nil, err
 		}
-		http1Format.WriteString(hf.String() + "\r\n")
+	default:
+		return nil, fmt.Errorf("missing :path pseudo-header")
 	}
 
-	http1Format.WriteString("\r\n")
+	header := toHTTPHeader(headers)
+
+	// http.ReadRequest関数と同様に、ホストはリクエストターゲット、hostヘッダーの順に採用し、
+	// hostヘッダーはHeaderから取り除く。いずれも無ければ:authorityを用いる。
+	host := u.Host
+	if host == "" {
+		host = header.Get("Host")
+	}
+	if host == "" && authority != nil {
+		host = authority.Value()
+	}
+	delete(header, "Host")
 
-	for _, body := range bodies {
-		http1Format.Write(body.payload)
+	// HTTP/2ではリクエストボディの終端はEND_STREAMフラグにより示されるため、
+	// content-lengthヘッダーの有無に関わらず受信したペイロードの長さとする。
+	// 一致しないcontent-lengthヘッダーはcheckFraming関数により既に拒否している。
+	var reqBody io.ReadCloser = http.NoBody
+	if len(body) > 0 {
+		reqBody = io.NopCloser(bytes.NewReader(body))
 	}
 
-	return http.ReadRequest(bufio.NewReader(http1Format))
+	// リクエストボディは受信を終えているため、リクエストハンドラーは読み込みを待たずにトレーラーを参照できる
+	var trailer http.Header
+	if len(trailers) > 0 {
+		trailer = toHTTPHeader(trailers)
+	}
+
+	return &http.Request{
+		Method:        method.Value(),
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        header,
+		Body:          reqBody,
+		ContentLength: int64(len(body)),
+		Host:          host,
+		RequestURI:    target,
+		Trailer:       trailer,
+	}, nil
 }
 
-// リクエストハンドラーからのレスポンスをフレームとして送信する
+// ヘッダーリストの疑似ヘッダー以外をhttp.Headerに変換する。
+// HTTP/2では分割して送信され得るcookieヘッダーは、HTTP/1と同様に1つに連結する。
+func toHTTPHeader(headers hpack.HeaderList) http.Header {
+	header := make(http.Header, len(headers))
+	var cookies []string
+	for _, hf := range headers {
+		name := hf.Name()
+		switch {
+		case strings.HasPrefix(name, ":"):
+			continue
+		case name == "cookie":
+			cookies = append(cookies, hf.Value())
+			continue
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		header[key] = append(header[key], hf.Value())
+	}
+	if len(cookies) > 0 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	return header
+}
+
+// リクエストハンドラーからのレスポンスをフレームとして送信する。
+// リクエストハンドラーのゴルーチンからmuを獲得した上で呼び出される。
 func (mp *multiplexer) writeResponse(res *responseWriter) {
+	defer mp.shutdownIfIdle()
+	defer mp.resetIdleTimer()
+	defer mp.closeIfDrained()
 	defer mp.streams.close(res.id)
+	defer res.release()
+
+	// 実行時間の上限を超えたリクエストハンドラーは、既に計上から除かれストリームも閉じられている
+	if d := res.deadline; d != nil && d.reclaimed {
+		mp.reportHandlerLatency(res, "timeout")
+		mp.finishStream(res, nil, TerminationTimeout, res.streamErr())
+		return
+	}
 
 	mp.runningHandlers--
+	mp.server.load.handlerFinished()
+
+	// CONNECTメソッドのトンネルはリクエストハンドラーの終了により閉じ、未読のリクエストボディは破棄する
+	if res.tunnel != nil {
+		res.tunnel.Close()
+	}
 
 	// リクエストハンドラーからレスポンスが生成された時点で
-	// RST_STREAMフレーム等によりストリームが閉じていれば何もしない
-	if mp.streams.get(res.id).state != halfClosedRemoteStream {
+	// RST_STREAMフレーム等によりストリームが閉じていれば何もしない。
+	// トンネルはクライアントがストリームを閉じていなくとも閉じることができる。
+	state := mp.streams.get(res.id).state
+	if state != halfClosedRemoteStream && (res.tunnel == nil || state != openStream) {
+		err := res.streamErr()
+		if err != nil {
+			mp.resetHandlers--
+		} else {
+			err = &StreamError{StreamID: uint32(res.id), Code: streamClosedError, Reason: "stream closed"}
+		}
+		mp.reportHandlerLatency(res, "reset")
+		mp.finishStream(res, nil, TerminationReset, err)
 		return
 	}
 
-	for _, f := range res.buildFrames() {
-		mp.writer.write(f)
+	if res.aborted {
+		mp.writer.write(buildRstStreamFrame(res.id,
+			newError(internalError, "handler aborted")))
+		mp.reportHandlerLatency(res, "aborted")
+		mp.finishStream(res, nil, TerminationPanic, errHandlerPanicked)
+		return
+	}
+
+	var frames []*frame
+	switch {
+	case res.streaming:
+		// Flushメソッドによりレスポンスボディは既に送信済みであり、
+		// トレーラーか空のDATAフレームのEND_STREAMフラグによりレスポンスの終了を伝える
+		if trailer := res.buildTrailerFrame(); trailer != nil {
+			frames = append(frames, trailer)
+		} else {
+			frames = append(frames, &frame{typ: dataFrame, flags: eosBit, streamID: res.id})
+		}
+	case res.spool == nil:
+		// 一時ファイルに退避されたレスポンスボディは既に送信済み
+		frames = res.buildFrames()
+	}
+
+	// クライアントがトンネルのストリームを閉じていなければ、NO_ERRORのRST_STREAMフレームにより
+	// 以降のリクエストボディの送信を中断させる
+	if state == openStream {
+		frames = append(frames, buildRstStreamFrame(res.id, newError(noError, "tunnel closed")))
+	}
+
+	if len(frames) > 0 {
+		mp.finishStream(res, frames[len(frames)-1], TerminationNormal, nil)
+		mp.writer.writeFrames(frames)
+	} else {
+		mp.finishStream(res, nil, TerminationNormal, nil)
+	}
+	mp.reportHandlerLatency(res, strconv.Itoa(res.statusCode))
+
+	// レスポンスヘッダーは必ずインデックスされないリテラルとしてエンコードされる
+	mp.metrics.Add("h2s_hpack_fields_total", float64(len(res.writtenHeader)),
+		Labels{"direction": "encode", "repr": "literal"})
+}
+
+// 一時ファイルに退避されたレスポンスボディを送信する。
+// 送信に失敗した場合はRST_STREAMフレームによりストリームを閉じる。
+func (mp *multiplexer) streamSpool(res *responseWriter) {
+	open := func() bool {
+		mp.mu.Lock()
+		defer mp.mu.Unlock()
+		return mp.streams.get(res.id).state == halfClosedRemoteStream
+	}
+
+	if err := res.streamSpool(mp.writer, open); err != nil {
+		mp.logger.error("(stream: %d) failed to send spooled body: %s", res.id, err)
+
+		mp.mu.Lock()
+		defer mp.mu.Unlock()
+		mp.writer.write(buildRstStreamFrame(res.id, err))
+		mp.streams.close(res.id)
 	}
 }
+
+// リクエストハンドラーの起動待ちの時間と実行時間をメトリクスとして通知する。
+// レスポンスを送信しなかった場合、ステータスコードの代わりにその理由を与える。
+func (mp *multiplexer) reportHandlerLatency(res *responseWriter, status string) {
+	labels := Labels{"status": status}
+	mp.metrics.Add("h2s_requests_total", 1, labels)
+	mp.metrics.Observe("h2s_handler_queue_seconds",
+		res.started.Sub(res.dispatched).Seconds(), labels)
+	mp.metrics.Observe("h2s_handler_run_seconds",
+		res.finished.Sub(res.started).Seconds(), labels)
+}
+
+// インデックステーブルの利用状況をメトリクスとして通知する
+func (mp *multiplexer) reportTableStats() {
+	stats := mp.indexTable.Stats()
+	reportTableStats(mp.metrics, mp.tableStats, stats)
+	mp.tableStats = stats
+}
@@ -0,0 +1,57 @@
+package h2s
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// 既存のnet/httpのサーバー hs が、ALPNにより"h2"が合意された接続を
+// sv により処理するよう設定する。hs のルーティングやリスナー、TLSの設定はそのまま用いられ、
+// sv の証明書は用いない。sv がnilなら既定のオプションのServerを用いる。
+// hs.ListenAndServeTLS等の呼び出し前に呼び出すこと。
+// hs.Shutdownメソッドの呼び出し時には sv.Shutdownメソッドにより接続を穏やかに終了させる。
+func ConfigureServer(hs *http.Server, sv *Server) error {
+	if sv == nil {
+		sv = NewServer(tls.Certificate{})
+	}
+
+	if hs.TLSConfig == nil {
+		hs.TLSConfig = &tls.Config{}
+	}
+
+	// HTTP/2はTLS 1.2以上を必要とする
+	if max := hs.TLSConfig.MaxVersion; max != 0 && max < tls.VersionTLS12 {
+		return fmt.Errorf("h2s: TLSConfig.MaxVersion must be TLS 1.2 or later for HTTP/2")
+	}
+	if hs.TLSConfig.MinVersion < tls.VersionTLS12 {
+		hs.TLSConfig.MinVersion = tls.VersionTLS12
+	}
+
+	// HTTP/1.1より優先されるよう、"h2"をプロトコル名の先頭に加える
+	hasProto := false
+	for _, p := range hs.TLSConfig.NextProtos {
+		if p == proto {
+			hasProto = true
+		}
+	}
+	if !hasProto {
+		hs.TLSConfig.NextProtos = append([]string{proto}, hs.TLSConfig.NextProtos...)
+	}
+
+	if hs.TLSNextProto == nil {
+		hs.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	// handler はnet/httpにより与えられ、hs.Handlerがnilならhttp.DefaultServeMuxとなり、
+	// リクエストのTLSやコンテキストも設定される
+	hs.TLSNextProto[proto] = func(_ *http.Server, conn *tls.Conn, handler http.Handler) {
+		sv.ServeConn(conn, handler)
+	}
+
+	hs.RegisterOnShutdown(func() {
+		go sv.Shutdown(context.Background())
+	})
+	return nil
+}
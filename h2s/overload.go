@@ -0,0 +1,101 @@
+package h2s
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// サーバー全体の負荷を監視し、上限を超えている間は新たなストリームやコネクションを拒否する構造体。
+// 負荷の取得には相応のコストを要するため、overloadSampleInterval毎にのみ取得し直す。
+type loadShedder struct {
+	running int64 // 全コネクションで実行中のリクエストハンドラーの数。sync/atomicによりアクセスする
+
+	sv      *Server
+	mu      sync.Mutex
+	sampled time.Time
+	reason  string // 超過している指標。超過していなければ空
+	heap    []metrics.Sample
+}
+
+const (
+	// 負荷を取得し直す間隔
+	overloadSampleInterval = 100 * time.Millisecond
+
+	// ヒープ上のオブジェクトの合計サイズを表すruntime/metricsの指標
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+)
+
+// 負荷の上限が1つも設定されていなければnilを返す
+func newLoadShedder(sv *Server) *loadShedder {
+	if sv.MaxGoroutines <= 0 && sv.MaxHeapBytes <= 0 && sv.MaxRunningHandlers <= 0 {
+		return nil
+	}
+	return &loadShedder{
+		sv:   sv,
+		heap: []metrics.Sample{{Name: heapObjectsMetric}},
+	}
+}
+
+// 負荷が上限を超えていれば、超過している指標の名前を返す。
+// nilのloadShedderに対しては常に空を返す。
+func (l *loadShedder) overloaded() string {
+	if l == nil {
+		return ""
+	}
+
+	// 実行中のリクエストハンドラーの数は取得のコストが無いため常に判定する
+	if limit := l.sv.MaxRunningHandlers; limit > 0 &&
+		atomic.LoadInt64(&l.running) >= int64(limit) {
+		return "handlers"
+	}
+
+	now := l.sv.clock().Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.sampled.IsZero() && now.Sub(l.sampled) < overloadSampleInterval {
+		return l.reason
+	}
+	l.sampled = now
+	l.reason = ""
+
+	if limit := l.sv.MaxGoroutines; limit > 0 && runtime.NumGoroutine() >= limit {
+		l.reason = "goroutines"
+	} else if limit := l.sv.MaxHeapBytes; limit > 0 {
+		metrics.Read(l.heap)
+		if v := l.heap[0].Value; v.Kind() == metrics.KindUint64 && v.Uint64() >= uint64(limit) {
+			l.reason = "heap"
+		}
+	}
+	return l.reason
+}
+
+// リクエストハンドラーの開始、終了を計上する
+func (l *loadShedder) handlerStarted() {
+	if l != nil {
+		atomic.AddInt64(&l.running, 1)
+	}
+}
+
+func (l *loadShedder) handlerFinished() {
+	if l != nil {
+		atomic.AddInt64(&l.running, -1)
+	}
+}
+
+// 過負荷により拒否したことを計上する。scopeは"stream"または"conn"。
+func (l *loadShedder) shed(scope, reason string) {
+	l.sv.metrics().Add("h2s_load_shed_total", 1, Labels{"scope": scope, "reason": reason})
+}
+
+// Server.ShedWithServiceUnavailableが真の場合に、
+// 過負荷により拒否したストリームに対してリクエストハンドラーの代わりに用いるハンドラー
+var overloadedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+})
@@ -0,0 +1,44 @@
+package h2s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"io"
+	"net"
+	"time"
+)
+
+// ConnPolicyにより拒否したコネクションにGOAWAYフレームを送信し、
+// クライアントが接続を閉じるのを待つ時間の上限
+const rejectLingerTimeout = time.Second
+
+// ConnPolicyによりコネクションを受け入れるか判定する。
+// 拒否する場合、GOAWAYフレームのデバッグデータとする文字列を返す。
+func (sv *Server) checkConnPolicy(conn *tls.Conn) (bool, string) {
+	if sv.ConnPolicy == nil {
+		return true, ""
+	}
+	return sv.ConnPolicy(conn.ConnectionState(), conn.RemoteAddr())
+}
+
+// ConnPolicyにより拒否したコネクションに、サーバーのコネクションプリフェイスとして
+// 空のSETTINGSフレームを送信した上で、debug をデバッグデータとするGOAWAYフレームを送信する。
+// エラーコードは、いずれのストリームも処理せずに拒否したことを示すREFUSED_STREAMとする。
+// 未読のデータを残して切断するとTCPのRSTによりGOAWAYフレームが破棄され得るため、
+// 送信後はクライアントが接続を閉じるまで受信したデータを読み捨てる。
+func rejectConn(conn net.Conn, debug string) {
+	var buf bytes.Buffer
+	framer := h2frame.NewFramer(&buf, nil)
+	framer.WriteSettings()
+	buildGoAwayFrame(newError(refusedStream, "%s", debug)).writeTo(framer)
+
+	conn.SetDeadline(time.Now().Add(rejectLingerTimeout))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+}
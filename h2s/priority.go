@@ -0,0 +1,74 @@
+package h2s
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RFC 9218で定義されるストリームの優先度
+type priority struct {
+	urgency     uint8 // 0(最優先)から7
+	incremental bool  // 真ならレスポンスを他のストリームと交互に送信してよい
+}
+
+// priorityヘッダーやPRIORITY_UPDATEフレームにより通知されなかった場合の優先度
+var defaultPriority = priority{urgency: 3}
+
+// writerコンポーネントが保持するストリーム毎の優先度の数の上限。
+// PRIORITY_UPDATEフレームはidle状態のストリームにも送信できるため、際限なく保持しないようにする。
+const maxTrackedPriorities = 256
+
+// priorityヘッダー、またはPRIORITY_UPDATEフレームのフィールド値(Structured FieldsのDictionary)を解釈する。
+// 未知のキーや不正な値は無視し、省略された値は初期値とする。
+func parsePriority(value string) priority {
+	p := defaultPriority
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+
+		// パラメーターは用いない
+		if i := strings.IndexByte(member, ';'); i >= 0 {
+			member = member[:i]
+		}
+
+		// 値を省略したキーは真(?1)を表す
+		key, val := member, "?1"
+		if i := strings.IndexByte(member, '='); i >= 0 {
+			key, val = member[:i], member[i+1:]
+		}
+
+		switch key {
+		case "u":
+			if u, err := strconv.Atoi(val); err == nil && u >= 0 && u <= 7 {
+				p.urgency = uint8(u)
+			}
+		case "i":
+			switch val {
+			case "?1":
+				p.incremental = true
+			case "?0":
+				p.incremental = false
+			}
+		}
+	}
+	return p
+}
+
+// 送信を待機しているDATAフレームを優先度に従い送信する順に並べ替える。
+// urgencyの小さいストリームを先とし、同じurgencyならincrementalでないストリームを
+// ストリームIDの順に先に送信する。incrementalなストリーム同士や、同じストリームのフレームの順序は保つ。
+func sortPending(pending []*pendingFrame, priorityOf func(streamID) priority) {
+	sort.SliceStable(pending, func(i, j int) bool {
+		pi, pj := priorityOf(pending[i].streamID), priorityOf(pending[j].streamID)
+		switch {
+		case pi.urgency != pj.urgency:
+			return pi.urgency < pj.urgency
+		case pi.incremental != pj.incremental:
+			return !pi.incremental
+		case !pi.incremental:
+			return pending[i].streamID < pending[j].streamID
+		default:
+			return false
+		}
+	})
+}
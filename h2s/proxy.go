@@ -0,0 +1,118 @@
+package h2s
+
+import (
+	"errors"
+	"github.com/murakmii/c99-minimal-h2s/h2client"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 受信したストリームを、HTTP/2の上流サーバーのストリームに1対1で対応させて転送する
+// リクエストハンドラー。独自のゲートウェイ等に組み込んで用いる。
+//
+// 上流のレスポンスのトレーラーはそのまま転送し、上流からRST_STREAMフレームにより
+// ストリームを閉じられた場合は、クライアントに対してもRST_STREAMフレームによりストリームを閉じる。
+// クライアントがストリームを閉じたことはリクエストのコンテキストを通じて上流へ伝わる。
+// なお、このパッケージはリクエストボディとレスポンスボディをバッファするため、
+// フロー制御は上流とクライアントのそれぞれで独立して行われる。
+type ReverseProxy struct {
+	// 転送先。Scheme, Hostを転送先とし、Pathはリクエストのパスの前に付加する
+	Target *url.URL
+
+	// 上流へのリクエストの送信に用いる。nilならh2client.Transportを用いる
+	Transport http.RoundTripper
+
+	// 非nilなら、上流へ送信する直前のリクエストを与えて呼び出す
+	Rewrite func(*http.Request)
+
+	transportOnce    sync.Once
+	defaultTransport *h2client.Transport
+}
+
+var _ http.Handler = (*ReverseProxy)(nil)
+
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = p.Target.Scheme
+	out.URL.Host = p.Target.Host
+	out.URL.Path = joinURLPath(p.Target.Path, r.URL.Path)
+	out.URL.RawPath = ""
+	if p.Target.RawQuery != "" && out.URL.RawQuery != "" {
+		out.URL.RawQuery = p.Target.RawQuery + "&" + out.URL.RawQuery
+	} else if p.Target.RawQuery != "" {
+		out.URL.RawQuery = p.Target.RawQuery
+	}
+
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+
+	if p.Rewrite != nil {
+		p.Rewrite(out)
+	}
+
+	res, err := p.transport().RoundTrip(out)
+	if err != nil {
+		// 上流でストリームが閉じられた場合や、クライアントが既にストリームを
+		// 閉じている場合は、応答せずにストリームを閉じる
+		var streamErr *h2client.StreamError
+		if errors.As(err, &streamErr) || r.Context().Err() != nil {
+			panic(http.ErrAbortHandler)
+		}
+
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	// トレーラーは実際に受信したものを改めて宣言する
+	for name, values := range res.Header {
+		if name != "Trailer" {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+	}
+	for name := range res.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	w.WriteHeader(res.StatusCode)
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+
+	for name, values := range res.Trailer {
+		w.Header()[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+}
+
+func (p *ReverseProxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+
+	p.transportOnce.Do(func() {
+		p.defaultTransport = &h2client.Transport{}
+	})
+	return p.defaultTransport
+}
+
+// 転送先のパスとリクエストのパスを、間の"/"が重複しないよう連結する
+func joinURLPath(base, path string) string {
+	switch {
+	case base == "":
+		return path
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+	return base + path
+}
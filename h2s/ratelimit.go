@@ -0,0 +1,189 @@
+package h2s
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// トークンバケットによるレート制限。
+// 1秒あたり rate 個のトークンを、burst 個を上限として補充する。
+// 排他制御は呼び出し側で行う。
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// トークンが満たされた状態のtokenBucketを生成する。burst が0以下なら rate とする。
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// 時刻 now までの分のトークンを補充する
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// 時刻 now までの分のトークンを補充した上で、トークンを1つ消費する。
+// トークンが無ければ消費せずに偽を返す。
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 以下はトークンをバイト数として扱い、帯域幅を制限するために用いる。
+// 時刻 now までの分を補充した上で、直ちに消費できるトークンの数を返す。
+func (b *tokenBucket) available(now time.Time) int64 {
+	b.refill(now)
+	if b.tokens < 0 {
+		return 0
+	}
+	return int64(b.tokens)
+}
+
+// トークンを n 個消費する。不足していれば負となり、以降の補充で返済する
+func (b *tokenBucket) consume(n int64) {
+	b.tokens -= float64(n)
+}
+
+// トークンが n 個(burstを上限とする)に達するまでの時間を返す。
+// availableメソッドにより補充した直後に呼び出す。
+func (b *tokenBucket) delay(n int64) time.Duration {
+	need := float64(n)
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// 時刻 now までの分を補充した上で、トークンを n 個消費し、
+// 不足分が補充されるまでの時間を返す。不足していなければ0を返す。
+func (b *tokenBucket) reserve(n int64, now time.Time) time.Duration {
+	b.refill(now)
+	b.consume(n)
+	return b.delay(0)
+}
+
+// クライアントのIPアドレス毎のリクエストのレート制限の設定。
+// Server.RateLimitsに、パスのプレフィックス毎に設定する。
+type RateLimit struct {
+	// 制限を適用するリクエストのパスのプレフィックス。
+	// 複数の設定に一致する場合は最も長いものを適用する。空なら全てのリクエストに一致する。
+	Prefix string
+
+	// クライアント毎に受け付ける1秒あたりのリクエストの数。
+	// Burstは瞬間的に受け付ける数の上限であり、0ならRequestsPerSecondとする。
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// RateLimit毎に、クライアントのIPアドレスをキーとしたトークンバケットを保持する構造体。
+// 全てのコネクションで共有する。
+type ipRateLimiter struct {
+	limits []RateLimit
+
+	// トークンバケットと、それらを最近使用した順に並べたリスト。
+	// リストの要素の値は*ipRateEntryとする。
+	mu      sync.Mutex
+	buckets map[ipRateKey]*list.Element
+	lru     *list.List
+}
+
+type ipRateKey struct {
+	limit int // RateLimitのインデックス
+	ip    string
+}
+
+type ipRateEntry struct {
+	key    ipRateKey
+	bucket *tokenBucket
+}
+
+// 保持するトークンバケットの数の上限。
+// 超過する場合、最も長く使用されていないものを取り除く。
+const maxRateLimitBuckets = 1 << 16
+
+// RateLimitが1つも設定されていなければnilを返す
+func newIPRateLimiter(limits []RateLimit) *ipRateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &ipRateLimiter{
+		limits:  append([]RateLimit(nil), limits...),
+		buckets: make(map[ipRateKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// クライアント ip からの path へのリクエストを受け付けられれば真を返す。
+// nilのipRateLimiterに対しては常に真を返す。
+func (l *ipRateLimiter) allow(ip, path string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	limit := -1
+	for i, rl := range l.limits {
+		if rl.RequestsPerSecond > 0 && strings.HasPrefix(path, rl.Prefix) &&
+			(limit < 0 || len(rl.Prefix) > len(l.limits[limit].Prefix)) {
+			limit = i
+		}
+	}
+	if limit < 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ipRateKey{limit: limit, ip: ip}
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*ipRateEntry).bucket.take(now)
+	}
+
+	if len(l.buckets) >= maxRateLimitBuckets {
+		l.evict()
+	}
+	rl := l.limits[limit]
+	b := newTokenBucket(rl.RequestsPerSecond, rl.Burst, now)
+	l.buckets[key] = l.lru.PushFront(&ipRateEntry{key: key, bucket: b})
+	return b.take(now)
+}
+
+// 最も長く使用されていないトークンバケットを取り除く。
+// 取り除いたクライアントは次のリクエストでトークンが満たされた状態から始まるが、
+// 多数のIPアドレスからのリクエストによりメモリを使い尽くされないよう、上限を優先する。
+func (l *ipRateLimiter) evict() {
+	if e := l.lru.Back(); e != nil {
+		l.lru.Remove(e)
+		delete(l.buckets, e.Value.(*ipRateEntry).key)
+	}
+}
+
+// レート制限を超過したリクエストに対して、リクエストハンドラーの代わりに用いるハンドラー
+var rateLimitedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+})
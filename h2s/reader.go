@@ -3,73 +3,128 @@ package h2s
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
 	"io"
-	"net/http"
+	"net"
+	"time"
 )
 
 // フレームのペイロードの最大値。
 // 仕様では初期値は@<code>{16384}と規定されている。
-// 変更することは可能だが本誌では初期値のまま扱うため、
-// 単に定数として定義する。
-const maxFrameSize = 16384
+// Server.MaxFrameSizeにより、maxAllowedFrameSizeまでの範囲で変更できる。
+const (
+	maxFrameSize        = h2frame.DefaultMaxFrameSize
+	maxAllowedFrameSize = h2frame.MaxAllowedFrameSize
+)
+
+// ウィンドウサイズの最大値
+const maxWindowSize = 1<<31 - 1
 
-var clientPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+var clientPreface = []byte(h2frame.ClientPreface)
 
 // readerコンポーネントの起動。
 // フレームの受信とmultiplexerコンポーネントへの引き渡しを継続的に行う。
+// multiplexerコンポーネントの処理はこのゴルーチン上でそのまま行うため、
+// 1コネクションあたりのゴルーチンはreader, writerコンポーネントと
+// 実行中のリクエストハンドラーの分のみとなる。
 func runReader(
+	server *Server,
 	logger logger,
 	peer io.Reader,
+	interceptor FrameInterceptor,
+	observe func(FrameHeader),
 	writer *writer,
-	handler http.Handler,
+	multiplexer *multiplexer,
 ) {
 	go func() {
-		multiplexer := newMultiplexer(logger, writer, handler)
-		multiplexer.run()
+		fr := newFrameReader(
+			peer, server.readBufferSize(), server.AdaptiveReadBuffer)
+		fr.interceptor = interceptor
+		fr.observe = observe
+		fr.tracer = newFrameTracer(server, logger, "recv", initialTableSize(server))
+		fr.zeroPadding = multiplexer.validation.zeroPadding
 
 		receivedPreface := make([]byte, len(clientPreface))
-		if _, err := io.ReadFull(peer, receivedPreface); err != nil {
-			logger("failed to read client preface: %s", err)
+		if _, err := io.ReadFull(fr.r, receivedPreface); err != nil {
+			logger.info("failed to read client preface: %s", err)
+			reportReadError(writer, err)
+			writer.shutdown()
 			return
 		}
 
 		if bytes.Compare(receivedPreface, clientPreface) != 0 {
-			logger("invalid client preface")
+			logger.info("invalid client preface")
+			writer.reportError(&ConnectionError{Code: protocolError, Reason: "invalid client preface"})
+			writer.shutdown()
 			return
 		}
 
-		logger("connection preface completed")
+		logger.debug("connection preface completed")
 
 		// readerコンポーネントが処理を返す、
 		// つまりmultiplexerコンポーネントへ誰もフレームを渡さないことが
 		// 確定してからそれの終了を指示する。
 		defer func() {
-			logger("reader shutdown")
+			logger.debug("reader shutdown")
 			multiplexer.shutdown()
 		}()
 
-		var headerBuf []*frame
+		fr.recorder = server.corpus.newRecorder()
+		defer fr.recorder.close()
+
+		// Server.KeepAliveIntervalによるキープアライブ。無効ならnil
+		keepAlive := newKeepAlive(server, logger, writer)
+		defer keepAlive.stop()
+
+		// Server.MaxRecvBytesPerSecondによる受信の帯域幅の制限。無制限ならnil
+		var recvRate *tokenBucket
+		if rate := server.MaxRecvBytesPerSecond; rate > 0 {
+			recvRate = newTokenBucket(float64(rate), 0, server.clock().Now())
+		}
+
+		// 不完全なヘッダーブロックを持つHEADERSフレーム。
+		// 後続のCONTINUATIONフレームのペイロードはこれに直接追加していく。
+		// 追加により maxHeaderBlock を超える場合はデコードを待たずに接続を閉じる。
+		var headerBuf *frame
+		maxHeaderBlock := server.maxHeaderBlockSize()
 
 		for {
 			// フレームの受信に失敗した場合はreaderコンポーネントを終了する。
 			// HTTP/2関連のエラーであれば事前にGOAWAYフレームを送信する。
-			f, err := readFrame(peer, maxFrameSize)
+			// それ以外はピアとの接続が失われているため、リクエストハンドラーの終了を待たずに
+			// コネクションのコンテキストを終了させる。
+			f, err := fr.readFrame(server.maxFrameSize())
 			if err != nil {
 				if h2, ok := err.(*h2Error); ok {
 					writer.write(buildGoAwayFrame(h2))
+				} else if err == io.EOF {
+					logger.debug("connection closed by peer")
+					writer.shutdown()
 				} else {
-					logger("failed to read frame: %s", err)
+					logger.info("failed to read frame: %s", err)
+					reportReadError(writer, err)
+					writer.shutdown()
 				}
 				return
 			}
+			keepAlive.received()
 
 			// 不完全なヘッダブロックがあるにも関わらず、
 			// 当該ヘッダブロックのCONTINUATIONフレーム以外が来た場合はエラー
-			if len(headerBuf) > 0 && f.typ != continuationFrame {
+			if headerBuf != nil && f.typ != continuationFrame {
 				writer.writeGoAway(protocolError, "invalid header sequence")
 				return
 			}
 
+			// PRIORITY_UPDATEフレームはストリームの状態に依らず、優先度を更新するのみ
+			if f.typ == priorityUpdateFrame {
+				if !multiplexer.updatePriority(f) {
+					return
+				}
+				continue
+			}
+
 			// 不明なフレームタイプは単に無視することと仕様で規定されている
 			if f.typ > continuationFrame {
 				continue
@@ -79,32 +134,53 @@ func runReader(
 			// multiplexerコンポーネントにフレームを渡す。
 			switch f.typ {
 			case dataFrame:
-				window := make([]byte, 4)
-				binary.BigEndian.PutUint32(window, uint32(len(f.payload)))
-
 				// コネクションレベル、ストリームレベルの両方を
-				// DATAフレームのフレームサイズ分だけ増加させる
-				/*writer.write(&frame{
-					typ:     windowUpdateFrame,
-					payload: window,
-				})
-				writer.write(&frame{
-					typ:      windowUpdateFrame,
-					streamID: f.streamID,
-					payload:  window,
-				})*/
+				// DATAフレームのフレームサイズ分だけ増加させる。
+				// END_STREAMフラグが立っている場合、以降ストリームで
+				// DATAフレームを受信することは無いためコネクションレベルのみとする。
+				// 受信の帯域幅を制限している場合、上限を超えた分が補充されるまで
+				// WINDOW_UPDATEフレームの送信を遅延させ、クライアントの送信を待機させる。
+				if len(f.payload) > 0 {
+					window := make([]byte, 4)
+					binary.BigEndian.PutUint32(window, uint32(len(f.payload)))
+
+					frames := []*frame{{typ: windowUpdateFrame, payload: window}}
+					if !f.flags.eos() {
+						frames = append(frames, &frame{
+							typ:      windowUpdateFrame,
+							streamID: f.streamID,
+							payload:  window,
+						})
+					}
+
+					var delay time.Duration
+					if recvRate != nil {
+						delay = recvRate.reserve(int64(len(f.payload)), server.clock().Now())
+					}
+					if delay > 0 {
+						server.clock().AfterFunc(delay, func() { writer.writeFrames(frames) })
+					} else {
+						writer.writeFrames(frames)
+					}
+				}
 
 			case headersFrame:
 				if !f.flags.eoh() {
-					headerBuf = append(headerBuf, f)
+					headerBuf = f.clone()
+					writer.mem.add(len(f.payload))
 					continue
 				}
 
 			case priorityFrame:
-				continue
+				// 優先度はPRIORITY_UPDATEフレームによるもののみ扱うため、単に無視する。
+				// ただしペイロード長の誤りはストリームエラーとなるため、multiplexerコンポーネントに渡す
+				if len(f.payload) == 5 {
+					continue
+				}
 
 			case settingsFrame:
 				if f.flags.ack() {
+					multiplexer.settingsAcked()
 					continue
 				}
 
@@ -113,49 +189,72 @@ func runReader(
 				return
 
 			case pingFrame:
-				if !f.flags.ack() {
-					logger("received PING and respond ack")
+				if f.flags.ack() {
+					keepAlive.acked(f.payload)
+					multiplexer.pingAcked(f.payload)
+				} else {
+					logger.debug("received PING and respond ack")
+					f = f.clone()
 					f.flags = ackBit
 					writer.write(f)
 				}
 				continue
 
 			case goAwayFrame:
-				logger(
+				logger.debug(
 					"received GOAWAY. code=%d, msg(str)=%s",
 					binary.BigEndian.Uint32(f.payload[4:]),
 					string(f.payload[8:]),
 				)
-				return
+				goAway := decodeGoAway(f.payload)
+				goAway.FromPeer = true
+				writer.recordGoAway(goAway)
+				if goAway.Code != noError {
+					return
+				}
+
+				// 正常な終了であれば、処理中のストリームのフレームを受信するため読み込みを続ける
+				multiplexer.peerGoingAway()
+				continue
 
 			case continuationFrame:
-				if len(headerBuf) == 0 || headerBuf[0].streamID != f.streamID {
+				if headerBuf == nil || headerBuf.streamID != f.streamID {
 					writer.writeGoAway(protocolError, "invalid header block")
 					return
 				}
 
-				headerBuf = append(headerBuf, f)
-				if f.flags.eoh() {
-					f = mergeHeaders(headerBuf)
-					headerBuf = nil
+				if len(headerBuf.payload)+len(f.payload) > maxHeaderBlock {
+					writer.writeGoAway(enhanceYourCalm,
+						"header block of stream %d exceeds %d bytes", f.streamID, maxHeaderBlock)
+					return
+				}
+
+				// 読み込みバッファからペイロードを直接追加するため、
+				// CONTINUATIONフレーム毎の複製は生じない
+				headerBuf.payload = append(headerBuf.payload, f.payload...)
+				writer.mem.add(len(f.payload))
+				if !f.flags.eoh() {
+					continue
 				}
+
+				f = headerBuf
+				f.flags |= eohBit
+				headerBuf = nil
+				writer.mem.add(-len(f.payload))
 			}
 
-			multiplexer.multiplex(f)
+			if !multiplexer.multiplex(f) {
+				return
+			}
 		}
 	}()
 }
 
-func mergeHeaders(frames []*frame) *frame {
-	merged := &frame{
-		typ:      headersFrame,
-		flags:    (frames[0].flags & eosBit) | eohBit,
-		streamID: frames[0].streamID,
-	}
-
-	for _, f := range frames[1:] {
-		merged.payload = append(merged.payload, f.payload...)
+// ピアからの読み込みの失敗をコネクションのエラーとして通知する。
+// クライアントによる切断(io.EOF)と、サーバー自身が接続を閉じたことによる失敗は通知しない。
+func reportReadError(writer *writer, err error) {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return
 	}
-
-	return merged
+	writer.reportError(&TransportError{Op: "read", Err: err})
 }
@@ -0,0 +1,54 @@
+package h2s
+
+import "time"
+
+const (
+	closedStreamGrace = 2 * time.Second // 閉じたストリームを記録しておく時間
+	maxRecentlyClosed = 128             // 記録しておくストリームの数の上限
+)
+
+// 最近閉じたストリームの記録。
+// ストリームを閉じた時点でクライアントが既に送信していたDATA, HEADERS, RST_STREAMフレームを、
+// RST_STREAMフレームで応答せずに破棄するために用いる。閉じる直前の状態も記録し、
+// クライアントがEND_STREAMフラグを送信済みであったかどうかを区別できるようにする。
+// 記録はclosedStreamGraceの間だけ保持し、maxRecentlyClosedを超えれば古いものから破棄する。
+type recentlyClosed struct {
+	entries []closedEntry // 閉じた順
+}
+
+type closedEntry struct {
+	id    streamID
+	at    time.Time
+	state streamState // 閉じる直前の状態
+}
+
+// 状態 state のストリーム id を閉じたことを記録する
+func (rc *recentlyClosed) add(id streamID, state streamState, now time.Time) {
+	rc.expire(now)
+	if len(rc.entries) == maxRecentlyClosed {
+		rc.entries = rc.entries[1:]
+	}
+	rc.entries = append(rc.entries, closedEntry{id: id, at: now, state: state})
+}
+
+// ストリーム id を最近閉じていれば、閉じる直前の状態と真を返す
+func (rc *recentlyClosed) lookup(id streamID, now time.Time) (streamState, bool) {
+	rc.expire(now)
+	for _, e := range rc.entries {
+		if e.id == id {
+			return e.state, true
+		}
+	}
+	return closedStream, false
+}
+
+// closedStreamGraceを過ぎた記録を破棄する
+func (rc *recentlyClosed) expire(now time.Time) {
+	i := 0
+	for i < len(rc.entries) && now.Sub(rc.entries[i].at) >= closedStreamGrace {
+		i++
+	}
+	if i > 0 {
+		rc.entries = append(rc.entries[:0], rc.entries[i:]...)
+	}
+}
@@ -2,10 +2,15 @@ package h2s
 
 import (
 	"bytes"
+	"context"
 	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // http.ResponseWriterインターフェイスを満たす構造体
@@ -15,12 +20,123 @@ type responseWriter struct {
 	statusCode    int
 	writtenHeader hpack.HeaderList
 	body          *bytes.Buffer
+
+	// レスポンスボディがspoolThresholdを超えた場合、
+	// 以降はspoolDirに作成した一時ファイルに退避する
+	spoolThreshold int
+	spoolDir       string
+	spool          *os.File
+
+	// リクエストハンドラーがパニックにより中断した場合に真。
+	// レスポンスを送信せず、RST_STREAMフレームによりストリームを閉じる。
+	aborted bool
+
+	// クライアントからRST_STREAMフレームによりストリームを閉じられた場合に非nil。
+	// 以降の書き込みはこれを返す。multiplexerコンポーネントから設定されるためresetMuにより保護する。
+	// cancelはリクエストのコンテキストを終了させる関数であり、閉じられた時点で呼び出す。
+	resetMu  sync.Mutex
+	resetErr *StreamError
+	cancel   context.CancelFunc
+
+	// Flushメソッドによりレスポンスを逐次送信するための関数と、リクエストのコンテキスト。
+	// sendはストリームが閉じられていなければフレームをwriterコンポーネントに渡して真を返す。
+	// その際 final が真ならheaderSentを真とする。
+	// streamingはレスポンスヘッダーを送信済みであり、以降の書き込みを直ちに送信するなら真。
+	// streamingはリクエストハンドラーのゴルーチンからのみ参照し、
+	// headerSentはmultiplexerコンポーネントのmuを獲得して参照する。
+	send       func(f *frame, final bool) bool
+	ctx        context.Context
+	streaming  bool
+	headerSent bool
+
+	// HandlerTimeoutが設定されている場合の、実行時間の上限の管理
+	deadline *handlerDeadline
+
+	// HEADメソッドのリクエストなら真。レスポンスボディは送信せず、
+	// Content-Typeの決定に用いる先頭部分のみをbodyに保持し、書き込まれた長さをheadLenに計上する。
+	head    bool
+	headLen int64
+
+	// CONNECTメソッドのリクエストなら非nil。
+	// レスポンスは最初の書き込みから逐次送信する。
+	tunnel *tunnel
+
+	// Server.Tracerにより開始したスパン。未設定ならnil
+	span Span
+
+	// Server.AccessLogに渡すリクエストの概要と、
+	// 受信したリクエストボディ、書き込まれたレスポンスボディのバイト数
+	method       string
+	path         string
+	authority    string
+	bytesRead    int64
+	bytesWritten int64
+
+	// リクエストハンドラーの実行時間の計測のための時刻
+	dispatched time.Time // リクエストハンドラーの起動が指示された時刻
+	started    time.Time // リクエストハンドラーの実行が開始された時刻
+	finished   time.Time // リクエストハンドラーの実行が終了した時刻
 }
 
-var _ http.ResponseWriter = (*responseWriter)(nil)
+// http.DetectContentTypeが参照するレスポンスボディの先頭部分の長さ
+const sniffLen = 512
+
+var (
+	_ http.ResponseWriter = (*responseWriter)(nil)
+	_ http.Flusher        = (*responseWriter)(nil)
+)
+
+// 確保したresponseWriterを再利用するためのプール
+var responseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return &responseWriter{header: make(http.Header)}
+	},
+}
+
+func newResponseWriter(id streamID, dispatched time.Time) *responseWriter {
+	res := responseWriterPool.Get().(*responseWriter)
+	res.id = id
+	res.dispatched = dispatched
+	return res
+}
+
+// 初期化してプールに返却する。
+// Headerのmapは再利用するが、レスポンスボディのバッファは
+// 送信前のDATAフレームのペイロードとして参照され得るため再利用しない。
+func (res *responseWriter) release() {
+	for key := range res.header {
+		delete(res.header, key)
+	}
+
+	if res.spool != nil {
+		res.spool.Close()
+		os.Remove(res.spool.Name())
+	}
 
-func newResponseWriter(id streamID) *responseWriter {
-	return &responseWriter{id: id, header: make(http.Header)}
+	res.statusCode = 0
+	res.aborted = false
+	res.resetErr = nil
+	res.cancel = nil
+	res.send = nil
+	res.ctx = nil
+	res.streaming = false
+	res.headerSent = false
+	res.deadline = nil
+	res.span = nil
+	res.method, res.path, res.authority = "", "", ""
+	res.bytesRead, res.bytesWritten = 0, 0
+	res.tunnel = nil
+	res.head = false
+	res.headLen = 0
+	res.writtenHeader = nil
+	res.body = nil
+	res.spoolThreshold = 0
+	res.spoolDir = ""
+	res.spool = nil
+	res.dispatched = time.Time{}
+	res.started = time.Time{}
+	res.finished = time.Time{}
+	responseWriterPool.Put(res)
 }
 
 // Headerメソッドの実装。
@@ -31,87 +147,441 @@ func (res *responseWriter) Header() http.Header {
 
 // レスポンスボディの書き出し。
 // この時点では単にバッファするのみ。
+// バッファがspoolThresholdを超える場合は一時ファイルに退避する。
+// Flushメソッドの呼び出し以降や、CONNECTメソッドのリクエストならバッファせず、直ちに送信する。
 func (res *responseWriter) Write(b []byte) (int, error) {
+	n, err := res.write(b)
+	if !res.head {
+		res.bytesWritten += int64(n)
+	}
+	return n, err
+}
+
+func (res *responseWriter) write(b []byte) (int, error) {
+	if res.tunnel != nil {
+		res.Flush()
+	}
+	if res.streaming {
+		return res.writeData(b)
+	}
+
 	res.WriteHeader(200)
 
+	if !bodyAllowed(res.statusCode) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if res.head {
+		return res.discard(b)
+	}
+
+	if err := res.streamErr(); err != nil {
+		return 0, err
+	}
+
+	if res.spool != nil {
+		return res.spool.Write(b)
+	}
+
 	if res.body == nil {
 		res.body = bytes.NewBuffer(nil)
 	}
 
+	if res.spoolThreshold > 0 && res.body.Len()+len(b) > res.spoolThreshold {
+		if err := res.spillToFile(); err != nil {
+			return 0, err
+		}
+		return res.spool.Write(b)
+	}
+
 	return res.body.Write(b)
 }
 
+// ストリームが閉じられたことを通知し、リクエストのコンテキストを終了させる。
+// リクエストハンドラーは処理を中断でき、生成しても送信されないレスポンスを生成せずに済む。
+func (res *responseWriter) reset(err *StreamError) {
+	res.resetMu.Lock()
+	res.resetErr = err
+	res.resetMu.Unlock()
+
+	if res.cancel != nil {
+		res.cancel()
+	}
+}
+
+// ストリームが閉じられていれば、その理由を返す
+func (res *responseWriter) streamErr() error {
+	res.resetMu.Lock()
+	defer res.resetMu.Unlock()
+	if res.resetErr != nil {
+		return res.resetErr
+	}
+	return nil
+}
+
+// Flushメソッドの実装。
+// レスポンスヘッダーとバッファされたレスポンスボディを送信し、以降の書き込みは直ちに送信する。
+// Server-Sent Events等、リクエストハンドラーの終了を待たずにレスポンスを送信するために用いる。
+// 送信するレスポンスヘッダーはcontent-lengthヘッダーを含まず、レスポンスボディの終端は
+// リクエストハンドラーの終了時にEND_STREAMフラグにより伝える。
+// レスポンスボディが一時ファイルに退避されている場合は、リクエストハンドラーの終了後にまとめて送信するため何もしない。
+func (res *responseWriter) Flush() {
+	if res.streaming || res.spool != nil || res.send == nil {
+		return
+	}
+
+	// レスポンスボディを持たないステータスコードならHEADERSフレームによりストリームを閉じるため、
+	// リクエストハンドラーの終了を待つ
+	if res.writtenHeader != nil && !bodyAllowed(res.statusCode) {
+		return
+	}
+	res.streaming = true
+
+	var body []byte
+	if res.body != nil {
+		body = res.body.Bytes()
+		res.body = nil
+	}
+
+	if !res.send(res.buildHeadersFrame(body, -1), true) {
+		return
+	}
+	if len(body) > 0 && !res.head {
+		res.sendAndWait(&frame{
+			typ:      dataFrame,
+			streamID: res.id,
+			payload:  body,
+		})
+	}
+}
+
+// フレームを送信し、それがピアへ送信されるか、リクエストのコンテキストが終了するまで待つ。
+// ストリームが閉じられていれば偽を返す。
+func (res *responseWriter) sendAndWait(f *frame) bool {
+	written := make(chan struct{})
+	f.written = written
+	if !res.send(f, false) {
+		return false
+	}
+
+	select {
+	case <-written:
+	case <-res.ctx.Done():
+	}
+	return true
+}
+
+// ステータスコードがレスポンスボディを持ち得るなら真を返す
+func bodyAllowed(statusCode int) bool {
+	switch {
+	case statusCode >= 100 && statusCode <= 199:
+		return false
+	case statusCode == http.StatusNoContent, statusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// HEADメソッドのリクエストに対するレスポンスボディの書き込み。
+// 長さを計上し、Content-Typeの決定に必要な先頭部分のみを保持する。
+func (res *responseWriter) discard(b []byte) (int, error) {
+	if err := res.streamErr(); err != nil {
+		return 0, err
+	}
+
+	if res.body == nil {
+		res.body = bytes.NewBuffer(nil)
+	}
+	if n := sniffLen - res.body.Len(); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		res.body.Write(b[:n])
+	}
+
+	res.headLen += int64(len(b))
+	return len(b), nil
+}
+
+// Flushメソッドの呼び出し以降のレスポンスボディの書き込み。
+// DATAフレームがピアへ送信されるまで待つため、クライアントのウィンドウサイズが書き込みの速度を制限する。
+func (res *responseWriter) writeData(b []byte) (int, error) {
+	if err := res.streamErr(); err != nil {
+		return 0, err
+	}
+	if err := res.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 || res.head {
+		return len(b), nil
+	}
+
+	// ピアへ送信されるまでペイロードを参照するため、呼び出し元のバッファは用いない
+	sent := res.sendAndWait(&frame{
+		typ:      dataFrame,
+		streamID: res.id,
+		payload:  append([]byte(nil), b...),
+	})
+
+	// ストリームやコネクションが閉じられた場合は、送信されずに破棄されている
+	if err := res.streamErr(); err != nil {
+		return 0, err
+	}
+	if err := res.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !sent {
+		return 0, io.ErrClosedPipe
+	}
+	return len(b), nil
+}
+
+// バッファされたレスポンスボディを一時ファイルに移す
+func (res *responseWriter) spillToFile() error {
+	spool, err := os.CreateTemp(res.spoolDir, "h2s-response-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := spool.Write(res.body.Bytes()); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return err
+	}
+
+	res.spool = spool
+	res.body = nil
+	return nil
+}
+
 // レスポンスヘッダーの書き出し。
 // この時点で設定されているヘッダーをヘッダーリストとして確定させる。
+// 1xxのステータスコードなら中間レスポンスとして直ちに送信し、ヘッダーリストは確定させない。
 func (res *responseWriter) WriteHeader(statusCode int) {
 	if res.writtenHeader != nil {
 		return
 	}
 
+	if statusCode >= 100 && statusCode <= 199 {
+		res.writeInterim(statusCode)
+		return
+	}
+
 	res.statusCode = statusCode
-	res.writtenHeader = make(hpack.HeaderList, 0, len(res.header)+1)
+	res.writtenHeader = res.headerList(statusCode)
+}
+
+// 103 Early Hints等の中間レスポンスを送信する。
+// net/httpと同様に、この時点で設定されているヘッダーを共に送信する。
+// HTTP/2では101 Switching Protocolsを用いることができないため無視する。
+func (res *responseWriter) writeInterim(statusCode int) {
+	if statusCode == http.StatusSwitchingProtocols || res.send == nil {
+		return
+	}
 
-	res.writtenHeader = append(res.writtenHeader,
-		hpack.NewHeaderField(":status", strconv.Itoa(statusCode)))
+	res.send(&frame{
+		typ:      headersFrame,
+		flags:    eohBit,
+		streamID: res.id,
+		payload:  hpack.EncodeHeaderList(res.headerList(statusCode)),
+	}, false)
+}
+
+// ステータスコードと設定されているヘッダーからヘッダーリストを生成する
+func (res *responseWriter) headerList(statusCode int) hpack.HeaderList {
+	list := make(hpack.HeaderList, 0, len(res.header)+1)
+	list = append(list, hpack.NewHeaderField(":status", strconv.Itoa(statusCode)))
 
 	for key, values := range res.header {
+		// http.TrailerPrefixを持つものはトレーラーとして最後に送信する
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+
 		key = strings.ToLower(key)
 		for _, value := range values {
-			res.writtenHeader = append(res.writtenHeader,
-				hpack.NewHeaderField(key, value))
+			list = append(list, hpack.NewHeaderField(key, value))
 		}
 	}
+	return list
 }
 
-// 設定されたレスポンスの内容を等価な一連のフレームに変換する
+// 設定されたレスポンスの内容を等価な一連のフレームに変換する。
+// レスポンスボディが一時ファイルに退避されている場合は使用できない。
+// HEADメソッドのリクエストなら、content-lengthヘッダーは書き込まれたレスポンスボディの長さとし、
+// DATAフレームは送信しない。何も書き込まれていなければcontent-lengthヘッダーを付与しない。
 func (res *responseWriter) buildFrames() []*frame {
+	// 1xx, 204, 304はレスポンスボディもトレーラーも持たず、
+	// content-lengthヘッダーを付与せずにHEADERSフレームによりストリームを閉じる
 	res.WriteHeader(200)
+	if !bodyAllowed(res.statusCode) {
+		headers := res.buildHeadersFrame(nil, -1)
+		headers.flags |= eosBit
+		return []*frame{headers}
+	}
+
+	var body []byte
+	if res.body != nil {
+		body = res.body.Bytes()
+	}
+	bodyLen := int64(len(body))
+	if res.head {
+		bodyLen = res.headLen
+		if bodyLen == 0 {
+			bodyLen = -1
+		}
+	}
+
+	frames := []*frame{res.buildHeadersFrame(body, bodyLen)}
+	if len(body) > 0 && !res.head {
+		frames = append(frames, &frame{
+			typ:      dataFrame,
+			streamID: res.id,
+			payload:  body,
+		})
+	}
+
+	// 最後のフレームにEND_STREAMフラグを設定し終了。
+	// トレーラーがあれば、それを表すHEADERSフレームを最後のフレームとする。
+	if trailer := res.buildTrailerFrame(); trailer != nil {
+		frames = append(frames, trailer)
+	} else {
+		frames[len(frames)-1].flags |= eosBit
+	}
+	return frames
+}
+
+// トレーラーを表すHEADERSフレームを生成する。トレーラーが無ければnilを返す。
+// net/httpと同様に、レスポンスヘッダーのTrailerで宣言された名前と
+// http.TrailerPrefixを持つ名前のヘッダーの、リクエストハンドラーの終了時点の値を送信する。
+func (res *responseWriter) buildTrailerFrame() *frame {
+	var trailers hpack.HeaderList
+	add := func(name string, values []string) {
+		name = strings.ToLower(name)
+		for _, value := range values {
+			trailers = append(trailers, hpack.NewHeaderField(name, value))
+		}
+	}
+
+	for _, declared := range res.header["Trailer"] {
+		for _, name := range strings.Split(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			add(name, res.header[name])
+		}
+	}
+
+	for key, values := range res.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			add(strings.TrimPrefix(key, http.TrailerPrefix), values)
+		}
+	}
+
+	if len(trailers) == 0 {
+		return nil
+	}
 
-	body := res.body.Bytes()
-	bodyLen := len(body)
+	return &frame{
+		typ:      headersFrame,
+		flags:    eohBit | eosBit,
+		streamID: res.id,
+		payload:  hpack.EncodeHeaderList(trailers),
+	}
+}
+
+// レスポンスヘッダーを表すHEADERSフレームを生成する。
+// sniff はContent-Typeの決定に用いるレスポンスボディの先頭部分。
+// bodyLen が負ならレスポンスボディの長さは未確定であり、content-lengthヘッダーを付与しない。
+// その場合、Content-Typeはレスポンスボディが書き込まれている場合のみ決定する。
+func (res *responseWriter) buildHeadersFrame(sniff []byte, bodyLen int64) *frame {
+	res.WriteHeader(200)
 
 	// http.ResponseWriterの要件通り、
 	// http.DetectContentTypeによってContent-Typeを決定。
-	if res.writtenHeader.Get("content-type") == nil {
+	if res.writtenHeader.Get("content-type") == nil && (bodyLen >= 0 || len(sniff) > 0) {
 		res.writtenHeader = append(
 			res.writtenHeader,
 			hpack.NewHeaderField(
 				"content-type",
-				http.DetectContentType(body),
+				http.DetectContentType(sniff),
 			),
 		)
 	}
 
-	if res.writtenHeader.Get("content-length") == nil {
+	if bodyLen >= 0 && res.writtenHeader.Get("content-length") == nil {
 		res.writtenHeader = append(
 			res.writtenHeader,
 			hpack.NewHeaderField(
 				"content-length",
-				strconv.Itoa(bodyLen),
+				strconv.FormatInt(bodyLen, 10),
 			),
 		)
 	}
 
-	frames := []*frame{
-		{
-			typ:      headersFrame,
-			flags:    eohBit,
-			streamID: res.id,
-			payload:  hpack.EncodeHeaderList(res.writtenHeader),
-		},
+	return &frame{
+		typ:      headersFrame,
+		flags:    eohBit,
+		streamID: res.id,
+		payload:  hpack.EncodeHeaderList(res.writtenHeader),
 	}
+}
 
-	// レスポンスボディが無いなら
-	// HEADERSフレームにEND_STREAMフラグを設定し終了
-	if bodyLen == 0 {
-		frames[0].flags |= eosBit
-		return frames
+// 一時ファイルに退避されたレスポンスボディを送信する。
+// 一時ファイルから maxFrameSize ずつ読み出したDATAフレームを1つずつwriterコンポーネントに渡し、
+// それがピアへ送信されるのを待ってから次を読み出すため、
+// メモリ上に保持するレスポンスボディは高々1フレーム分となる。
+// 送信の途中でストリームが閉じられた場合は open が偽を返すため、その時点で中断する。
+func (res *responseWriter) streamSpool(w *writer, open func() bool) error {
+	size, err := res.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
 	}
 
-	return append(frames, &frame{
-		typ:      dataFrame,
-		flags:    eosBit,
-		streamID: res.id,
-		payload:  body,
-	})
+	sniff := make([]byte, sniffLen)
+	n, err := res.spool.ReadAt(sniff, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if !open() {
+		return nil
+	}
+
+	headers := res.buildHeadersFrame(sniff[:n], size)
+	trailer := res.buildTrailerFrame()
+	if size == 0 && trailer == nil {
+		headers.flags |= eosBit
+	}
+	w.write(headers)
+
+	if _, err := res.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for remain := size; remain > 0; {
+		chunk := make([]byte, maxFrameSize)
+		n, err := io.ReadFull(res.spool, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		remain -= int64(n)
+
+		if !open() {
+			return nil
+		}
+
+		f := &frame{
+			typ:      dataFrame,
+			streamID: res.id,
+			payload:  chunk[:n],
+		}
+		if remain <= 0 && trailer == nil {
+			f.flags = eosBit
+		}
+
+		w.writeAndWait(f)
+	}
+
+	if trailer != nil && open() {
+		w.write(trailer)
+	}
+	return nil
 }
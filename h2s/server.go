@@ -1,96 +1,698 @@
 package h2s
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
-	"log"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type (
 	// serverコンポーネントを表す構造体。
 	// セキュア通信にて利用する証明書をフィールドに持つ。
+	// 公開フィールドは各種オプションであり、
+	// NewServer関数による生成後、ListenAndServeメソッドの呼び出し前に設定する。
 	Server struct {
-		cert tls.Certificate
-	}
+		certMu sync.RWMutex
+		cert   *tls.Certificate
+
+		// メトリクスの送出先。nilなら計測値は破棄される。
+		Metrics Metrics
+
+		// 時刻の取得やタイマーの生成に用いる。nilならtimeパッケージを用いる。
+		// ただしTLSハンドシェイクのタイムアウトは接続のデッドラインとして
+		// OSに委ねるため、常に実際の時刻に基づく。
+		Clock Clock
+
+		// コネクション毎の読み込み、書き込みバッファのサイズ(バイト)。
+		// 0ならdefaultBufferSizeを用いる。
+		ReadBufferSize  int
+		WriteBufferSize int
+
+		// 真なら読み込みバッファを小さなサイズから始め、
+		// 受信したフレームのサイズに応じてReadBufferSizeを上限に拡張、縮小する。
+		// アイドル状態のコネクションが多い場合のメモリ使用量を抑えられる。
+		AdaptiveReadBuffer bool
+
+		// サーバー全体でバッファするリクエストボディ等の合計サイズの上限(バイト)。
+		// 超過した場合、最も多くバッファしているコネクションをGOAWAYフレームにより切断する。
+		// 0なら無制限。
+		MaxBufferedBytes int64
+
+		// SETTINGSフレームによりクライアントに通知する設定。
+		// InitialWindowSizeはストリームのウィンドウサイズの初期値であり、0なら最大値とする。
+		// MaxConcurrentStreamsは並行するストリームの数の上限であり、0なら無制限とする。
+		// 超過したストリームはREFUSED_STREAMにより拒否する。
+		// MaxFrameSizeは受信するフレームのペイロードの最大値であり、0なら初期値とする。
+		InitialWindowSize    uint32
+		MaxConcurrentStreams uint32
+		MaxFrameSize         uint32
+
+		// SETTINGSフレームによりクライアントに通知する、上記以外の設定。
+		// HeaderTableSizeはリクエストヘッダーのデコードに用いるHPACKの動的テーブルのサイズの上限であり、
+		// 0なら初期値(4096)とする。クライアントが設定を反映したことを確認するまでは、初期値も許容する。
+		// MaxHeaderListSizeはリクエストヘッダーのサイズの目安であり、0なら通知しない。
+		// 上限の強制はLimits.MaxHeaderListSizeにより行う。
+		// DisablePushが真ならSETTINGS_ENABLE_PUSHに0を明示する。
+		// このパッケージはサーバープッシュを行わないため、通知の有無によらず挙動は変わらない。
+		HeaderTableSize   uint32
+		MaxHeaderListSize uint32
+		DisablePush       bool
+
+		// コネクション毎に新たなストリームを受け付ける1秒あたりの数の上限。0なら無制限。
+		// StreamRateBurstは瞬間的に受け付ける数の上限であり、0ならMaxStreamsPerSecondとする。
+		// 超過したストリームはREFUSED_STREAMにより拒否するが、
+		// StreamRateGoAwayが真ならENHANCE_YOUR_CALMのGOAWAYフレームによりコネクションを閉じる。
+		// MaxConcurrentStreamsとは異なり、短時間のストリームを大量に開くクライアントを制限する。
+		MaxStreamsPerSecond float64
+		StreamRateBurst     int
+		StreamRateGoAway    bool
+
+		// コネクション毎にクライアントがRST_STREAMフレームによりストリームを閉じる1秒あたりの数の上限。
+		// 0なら無制限。ResetRateBurstは瞬間的な数の上限であり、0ならMaxResetsPerSecondとする。
+		// ストリームを開いて直ちに閉じることを繰り返す攻撃(Rapid Reset)への対策であり、
+		// 超過している間は新たなストリームをREFUSED_STREAMにより拒否するが、
+		// ResetRateGoAwayが真ならENHANCE_YOUR_CALMのGOAWAYフレームによりコネクションを閉じる。
+		// なお、この設定によらず、閉じられたストリームのリクエストハンドラーが実行中の間は
+		// そのストリームをMaxConcurrentStreamsの計上に含める。
+		MaxResetsPerSecond float64
+		ResetRateBurst     int
+		ResetRateGoAway    bool
+
+		// コネクション毎の1秒あたりの送信、受信バイト数の上限。0なら無制限。
+		// 送信はDATAフレームの送信をウィンドウサイズと同様に待機させ、
+		// 受信はWINDOW_UPDATEフレームの送信を遅延させることでクライアントの送信を抑える。
+		// 特定のクライアントが帯域幅を占有しないよう、複数のクライアントを収容する場合に用いる。
+		MaxSendBytesPerSecond int64
+		MaxRecvBytesPerSecond int64
+
+		// 空でなければ、:authority(またはhostヘッダー)がこれらのいずれかに一致するリクエストのみを
+		// リクエストハンドラーに渡し、他は421 Misdirected Requestとする。
+		// "*.example.com"のように、先頭を"*."とした値はそのサブドメインに一致する。
+		// DNSリバインディングにより、内部向けのサーバーへ意図しないホスト名でアクセスされることを防ぐ。
+		AllowedHosts []string
+
+		// リクエスト毎に適用する上限と、:authorityやパスのプレフィックス毎のその上書き
+		Limits         RequestLimits
+		LimitOverrides []LimitOverride
+
+		// クライアントのIPアドレス毎のリクエストのレート制限。
+		// リクエストハンドラーを呼び出す前に判定し、超過したリクエストには
+		// リクエストハンドラーを呼び出さずに429 Too Many Requestsを返す。
+		RateLimits []RateLimit
+
+		// サーバー全体の負荷の上限。MaxGoroutinesはゴルーチンの数、
+		// MaxHeapBytesはヒープ上のオブジェクトの合計サイズ(バイト)、
+		// MaxRunningHandlersは全コネクションで実行中のリクエストハンドラーの数であり、0なら無制限。
+		// いずれかを超えている間、新たなストリームはREFUSED_STREAMにより拒否し、
+		// 新たなコネクションにはSETTINGSフレームに続けてGOAWAYフレームを送信して閉じる。
+		// ShedWithServiceUnavailableが真なら、ストリームは拒否せずに
+		// リクエストハンドラーを呼び出さないまま503 Service Unavailableを返す。
+		MaxGoroutines              int
+		MaxHeapBytes               int64
+		MaxRunningHandlers         int
+		ShedWithServiceUnavailable bool
+
+		// TLSハンドシェイクを完了させるまでの時間の上限。0なら無制限。
+		HandshakeTimeout time.Duration
+
+		// 処理中のストリームが無い状態が続いた場合に、
+		// GOAWAYフレームを送信してコネクションを閉じるまでの時間。0なら閉じない。
+		IdleTimeout time.Duration
+
+		// クライアントからのデータの受信を待つ時間の上限と、クライアントへの1回の送信に要する時間の上限。
+		// 超過した場合はコネクションを閉じる。0なら無制限。
+		// ReadTimeoutは接続直後のコネクションプリフェイスの受信にも適用されるため、
+		// 何も送信しないクライアントにコネクションを占有され続けることを防げる。
+		// ただし、処理中のストリームがあってもクライアントが何も送信しなければ超過するため、
+		// 長時間応答を待たせるリクエストを扱う場合は十分に大きな値とすること。
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+
+		// クライアントからKeepAliveIntervalの間フレームを受信しなければPINGフレームを送信し、
+		// それからKeepAliveTimeoutの間何も受信しなければコネクションを閉じる。
+		// 応答しなくなったピアのコネクションを検出するために用いる。
+		// KeepAliveIntervalが0なら送信しない。KeepAliveTimeoutが0ならKeepAliveIntervalと同じとする。
+		KeepAliveInterval time.Duration
+		KeepAliveTimeout  time.Duration
+
+		// 同時に行うTLSハンドシェイクの数の上限。0なら無制限。
+		// 上限に達している場合、新たな接続はHandshakeQueueTimeoutの間だけ
+		// 空きを待ち、それでも空かなければ切断する。
+		MaxConcurrentHandshakes int
+		HandshakeQueueTimeout   time.Duration
+
+		// フレームをバッファしてからピアへ送信するまでの待機時間。
+		// 並行するストリームの小さなフレームをまとめて送信するために用いる。
+		// 0なら後続のフレームが無い時点で即座に送信する。
+		FlushDelay time.Duration
 
-	// HTTP/2とは本質的には無関係だが、ログ出力のための型を定義しておく
-	logger func(format string, a ...interface{})
+		// レスポンスボディをメモリ上にバッファする上限(バイト)。
+		// 超過した場合、レスポンスボディはSpoolDirに作成する一時ファイルに退避され、
+		// リクエストハンドラーの終了後にそこから少しずつ送信される。
+		// 0なら常にメモリ上にバッファする。SpoolDirが空ならos.TempDirを用いる。
+		ResponseSpoolThreshold int
+		SpoolDir               string
+
+		// 真なら、content-encodingヘッダーがgzipのリクエストボディを展開してから
+		// リクエストハンドラーに渡す。content-encoding, content-lengthヘッダーは取り除く。
+		// 展開後のサイズがMaxDecompressedBytesを超えた場合、リクエストボディの読み込みは
+		// ErrDecompressedBodyTooLargeを返す。0ならdefaultMaxDecompressedBytesとする。
+		DecompressRequests   bool
+		MaxDecompressedBytes int64
+
+		// 真なら送信するDATAフレームを常に最大フレームサイズで分割するのではなく、
+		// ストリームの最初は小さく、送信量が増えるにつれて大きなサイズで分割する。
+		// 並行するストリームのフレームが交互に送信されやすくなる。
+		AdaptiveDataFrameSize bool
+
+		// 受信したフレームやリクエストヘッダーを検証する厳密さ。既定値はValidationDefault。
+		// ValidationRelaxedにより一部の検証を省略し、CPUの使用量を抑えられる。
+		Validation ValidationProfile
+
+		// 真なら、無視しても接続の状態が食い違わないプロトコル違反については
+		// ログとメトリクスに記録するのみで、コネクションやストリームを閉じずに処理を継続する。
+		// 対象はストリームの状態に合わないHEADERS以外のフレームと、ストリーム0に対するRST_STREAMフレーム。
+		// 仕様から僅かに外れたクライアントを、拒否する前に把握するために用いる。
+		Lenient bool
+
+		// 非nilなら、サーバーが送信するGOAWAYフレームのデバッグデータを、エラーコードと
+		// 本来のデバッグデータであるエラーの内容を与えて呼び出した結果に置き換える。
+		// nilならエラーの内容をそのまま送信するため、内部の情報がクライアントに伝わり得る。
+		// GoAwayReference関数を設定すれば、ログと突き合わせるための参照IDに置き換えられる。
+		// 置き換えた場合は本来の内容を置き換えた内容と共にログに出力し、
+		// Conn.ErrメソッドやOnConnectionErrorには本来の内容を与える。
+		GoAwayDebugData func(code h2frame.ErrCode, reason string) string
+
+		// 非nilなら、TLSハンドシェイクとALPNによるプロトコルの合意の完了後、
+		// HTTP/2の送受信を開始する前に呼び出す。偽を返したコネクションは拒否する。
+		// 証明書のピンニングやSNI、クライアントのIPアドレスによる制限に用いる。
+		// 拒否する際に空でない文字列を返すと、それをデバッグデータとするGOAWAYフレームを
+		// 送信してから切断する。空なら何も送信せずに切断する。
+		ConnPolicy func(state tls.ConnectionState, remote net.Addr) (ok bool, debug string)
+
+		// 非nilなら、コネクション毎に呼び出し、返されたFrameInterceptorにより
+		// 送受信するフレームに介入する。nilを返したコネクションには介入しない。
+		Interceptor func(conn net.Conn) FrameInterceptor
+
+		// 非nilなら、コネクション上でフレームを受信、送信する度に、その概要を与えて呼び出す。
+		// 受信したフレームはFrameInterceptorによる介入の前、送信するフレームは介入の後のもの、
+		// つまり実際に送受信したフレームを通知する。フレームの内容を変更せずに観察するために用いる。
+		// OnFrameReadはreaderコンポーネントの、OnFrameWriteはwriterコンポーネントの
+		// ゴルーチンから呼び出すため、速やかに処理を返すこと。
+		OnFrameRead  func(remoteAddr string, h FrameHeader)
+		OnFrameWrite func(remoteAddr string, h FrameHeader)
+
+		// 真なら、送受信した全てのフレームを、SETTINGSフレームのパラメーターや
+		// HPACKによりデコードしたヘッダーリスト等を含む読み易い形式でLoggerにDebugレベルで出力する。
+		// OnFrameRead, OnFrameWriteと同様に実際に送受信したフレームを対象とする。
+		// 出力が多量となるため、問題の調査時に限って有効にすること。
+		TraceFrames bool
+
+		// 非nilなら、コネクションがエラーにより終了した場合に、コネクション毎に最初のエラーについて呼び出す。
+		// err は以下のいずれかであり、種類により原因を区別してアラート等に用いることができる。
+		//   - *HandshakeError: TLSハンドシェイクの失敗
+		//   - *TransportError: 下層の接続の読み書きの失敗やタイムアウト。ピアとの接続が失われている
+		//   - *ConnectionError: エラーコードを伴うGOAWAYフレームの送信、または受信(FromPeerが真)。
+		//     サーバーが送信したもののうち、CodeがINTERNAL_ERRORのものはサーバー自身の不具合を、
+		//     それ以外はクライアントのプロトコル違反等を表す
+		// クライアントによる正常な切断やNO_ERRORのGOAWAYフレームによる終了では呼び出さない。
+		// コネクションのゴルーチンから呼び出すため、速やかに処理を返すこと。
+		OnConnectionError func(remoteAddr string, err error)
+
+		// 非nilなら、ストリーム毎にリクエストハンドラーの実行からレスポンスの送信までのスパンを開始する。
+		// traceparent, tracestateヘッダーにより伝播された呼び出し元のスパンを親として与える。
+		Tracer Tracer
+
+		// 非nilなら、ストリーム毎にリクエストハンドラーが終了し、レスポンスの送信を終えた時点で
+		// その概要を与えて呼び出す。リクエストハンドラー毎にアクセスログを実装せずに済ませるために用いる。
+		// 送信の終了を待つゴルーチン等から呼び出すため、速やかに処理を返すこと。
+		AccessLog func(entry AccessLogEntry)
+
+		// ログの出力先。nilなら何も出力しない。
+		// logパッケージに出力するにはNewStdLogger関数が返すLoggerを設定する。
+		Logger Logger
+
+		// 空でなければ、受信したヘッダーブロックとフレーム列をこのディレクトリ以下に
+		// ファジングのコーパスとして保存する。ヘッダーブロックはhpack、
+		// コネクション毎のフレーム列はframesの各サブディレクトリに、内容の重複を除いて保存する。
+		// MaxCorpusBytesは保存する合計サイズの上限であり、0ならdefaultMaxCorpusBytesとする。
+		CorpusDir      string
+		MaxCorpusBytes int64
+
+		// 空でなければ、コネクション毎に送受信した全てのバイト列をこのディレクトリに記録する。
+		// 受信したものは"<開始時刻>-<ConnStats.ID>.recv"、送信したものは同じく".send"のファイルとなる。
+		// 記録したものはh2stest.Server.Replayメソッドにより再現できるため、
+		// 特定のクライアントとの間でのみ起こる不具合を回帰テストとするために用いる。
+		// 内容を一切加工せず、サイズの上限も無いため、問題の調査時に限って有効にすること。
+		CaptureDir string
+
+		// 1つのリスナーに対して並行してAcceptを呼び出すゴルーチンの数。
+		// 接続要求が集中した際に、受け入れに伴う処理を複数のコアに分散させる。
+		// 0なら1とする。
+		AcceptWorkers int
+
+		initOnce   sync.Once
+		budget     *memoryBudget
+		handshakes chan struct{}
+		corpus     *corpus
+		load       *loadShedder
+		ipRate     *ipRateLimiter
+
+		// ConnStats, Shutdownメソッドのために保持する接続中のコネクションと
+		// 待ち受け中のリスナー。inShutdownはShutdownメソッドの呼び出し後に真となる。
+		// handshakingはTLSハンドシェイクを終えていない接続。
+		connsMu     sync.Mutex
+		conns       map[*connState]struct{}
+		listeners   map[net.Listener]struct{}
+		handshaking map[net.Conn]struct{}
+		inShutdown  bool
+	}
 )
 
 const (
 	// ALPNにて交換されるアプリケーション層のプロトコル名。
 	// HTTP/2では"h2"によりHTTP/2を利用することを示すこととされている。
 	proto = "h2"
+
+	// 読み込み、書き込みバッファのサイズの既定値
+	defaultBufferSize = 4096
+
+	// SETTINGS_HEADER_TABLE_SIZEの初期値
+	defaultHeaderTableSize = 4096
+
+	// リクエストヘッダーのサイズの上限が設定されていない場合の、ヘッダーブロックのサイズの上限
+	defaultMaxHeaderBlockSize = 1 << 20
 )
 
-func newLogger(tag string) logger {
-	return func(format string, a ...interface{}) {
-		log.Printf(tag+" "+format+"\n", a...)
+func NewServer(cert tls.Certificate) *Server {
+	return &Server{
+		cert:        &cert,
+		conns:       make(map[*connState]struct{}),
+		listeners:   make(map[net.Listener]struct{}),
+		handshaking: make(map[net.Conn]struct{}),
 	}
 }
 
-func NewServer(cert tls.Certificate) *Server {
-	return &Server{cert: cert}
+// 以降のTLSハンドシェイクで用いる証明書を差し替える。
+// 証明書の更新のために、ListenAndServeメソッドとは別のゴルーチンから呼び出すことができる。
+// 接続済みのコネクションには影響しない。
+func (sv *Server) SetCertificate(cert tls.Certificate) {
+	sv.certMu.Lock()
+	defer sv.certMu.Unlock()
+	sv.cert = &cert
+}
+
+func (sv *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sv.certMu.RLock()
+	defer sv.certMu.RUnlock()
+	return sv.cert, nil
 }
 
 // serverコンポーネントの主要な実装である接続要求の受け入れ。
-// このメソッドは1度呼び出すと接続要求に受け入れに失敗しない限り処理を返さない。
-// いわゆるGraceful shutdownといった振る舞いは、
-// HTTP/2とは本質的には無関係であるため本誌では省略する。
+// このメソッドは1度呼び出すと接続要求に受け入れに失敗するか、
+// Shutdownメソッドが呼び出されない限り処理を返さない。
 func (sv *Server) ListenAndServe(addr string, handler http.Handler) {
 	listener, err := tls.Listen("tcp", addr, &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{sv.cert},
-		NextProtos:   []string{proto},
+		MinVersion:     tls.VersionTLS13,
+		GetCertificate: sv.getCertificate,
+		NextProtos:     []string{proto},
 	})
 	if err != nil {
-		log.Printf("failed to listen: %s", err)
+		sv.log().Error("failed to listen: %s", err)
+		return
+	}
+
+	sv.Serve(listener, handler)
+}
+
+// TLSを用いずにHTTP/2で接続要求を受け入れる(h2c)。
+// HTTP/1.1からのUpgradeには対応せず、クライアントが最初からHTTP/2を用いる
+// (prior knowledge)ことを前提に、直ちにコネクションプリフェイスを待ち受ける。
+// TLSを終端するロードバランサーの背後や、証明書を用意しないローカルでの試験に用いる。
+// Server.ConnPolicyはTLSの状態を判定するものであるため適用しない。
+// ListenAndServeメソッドと同様に、Shutdownメソッドが呼び出されない限り処理を返さない。
+func (sv *Server) ListenAndServeH2C(addr string, handler http.Handler) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		sv.log().Error("failed to listen: %s", err)
 		return
 	}
+
+	sv.Serve(listener, handler)
+}
+
+// 呼び出し側が用意したリスナーにより接続要求を受け入れる。
+// 受け入れた接続が*tls.ConnであればListenAndServeメソッドと同様にTLSハンドシェイクを行い、
+// そうでなければListenAndServeH2Cメソッドと同様にh2cとして扱う。
+// 独自のtls.Configによるリスナーを与える場合、NextProtosに"h2"を含める必要がある。
+// また、SetCertificateメソッドによる証明書はそのtls.Configが用いない限り使用されない。
+// 事前に確保したソケットや、テストのためのメモリ上のリスナーから接続を受け入れるために用いる。
+// listener はこのメソッドが処理を返す際に閉じられる。
+// ListenAndServeメソッドと同様に、Shutdownメソッドが呼び出されない限り処理を返さない。
+func (sv *Server) Serve(listener net.Listener, handler http.Handler) {
 	defer listener.Close()
 
-	log.Printf("start server on %s", addr)
+	if !sv.trackListener(listener) {
+		return
+	}
+	defer sv.untrackListener(listener)
+
+	sv.init()
+	sv.log().Info("start server on %s", listener.Addr())
+
+	// いずれかのゴルーチンで接続要求の受け入れに失敗した場合、
+	// リスナーを閉じて他のゴルーチンも終了させる
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < sv.acceptWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sv.acceptLoop(listener, handler)
+			once.Do(func() { listener.Close() })
+		}()
+	}
+	wg.Wait()
+}
 
+// 接続要求を受け入れ続ける。接続要求の受け入れに失敗した場合に処理を返す。
+func (sv *Server) acceptLoop(listener net.Listener, handler http.Handler) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("failed to accept connection: %s\n", err)
+			if sv.shuttingDown() {
+				return
+			}
+			sv.log().Error("failed to accept connection: %s", err)
 			return
 		}
 
-		logger := newLogger(conn.RemoteAddr().String())
+		if _, ok := conn.(*tls.Conn); ok {
+			go sv.serveTLS(conn, handler)
+		} else {
+			go sv.serveH2C(conn, handler)
+		}
+	}
+}
 
-		// Handshakeメソッドにより明示的にハンドシェイクを行い、
-		// その結果、つまりALPNの結果合意されたプロトコル名を
-		// tlsConn.ConnectionState().NegotiatedProtocol で確認する。
-		go func() {
-			tlsConn := conn.(*tls.Conn)
+// TLSを用いない接続で、HTTP/2のデータの送受信を直ちに開始する
+func (sv *Server) serveH2C(conn net.Conn, handler http.Handler) {
+	logger := sv.newLogger(conn.RemoteAddr().String())
+	logger.debug("start h2c connection")
+	sv.startRW(logger, conn, handler)
+}
 
-			logger("start connection")
+// TLSによる接続のハンドシェイクを行い、HTTP/2のデータの送受信を開始する。
+// Handshakeメソッドにより明示的にハンドシェイクを行い、
+// その結果、つまりALPNの結果合意されたプロトコル名を
+// tlsConn.ConnectionState().NegotiatedProtocol で確認する。
+func (sv *Server) serveTLS(conn net.Conn, handler http.Handler) {
+	logger := sv.newLogger(conn.RemoteAddr().String())
+	tlsConn := conn.(*tls.Conn)
 
-			if err := tlsConn.Handshake(); err != nil {
-				logger("failed to handshake: %s", err)
-				conn.Close()
-				return
-			}
+	logger.debug("start connection")
 
-			negotiated := tlsConn.ConnectionState().NegotiatedProtocol
-			if negotiated != proto {
-				logger("invalid negotiated protocol: %s", negotiated)
-				conn.Close()
-				return
-			}
+	if !sv.trackHandshake(conn) {
+		conn.Close()
+		return
+	}
 
-			startRW(logger, conn, handler)
-		}()
+	if !sv.acquireHandshake() {
+		logger.info("too many concurrent handshakes")
+		sv.untrackHandshake(conn)
+		conn.Close()
+		return
+	}
+
+	if sv.HandshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(sv.HandshakeTimeout))
+	}
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	sv.releaseHandshake()
+	sv.untrackHandshake(conn)
+	if err != nil {
+		logger.info("failed to handshake: %s", err)
+		sv.connectionError(conn.RemoteAddr().String(), &HandshakeError{Err: err})
+		conn.Close()
+		return
+	}
+
+	negotiated := tlsConn.ConnectionState().NegotiatedProtocol
+	if negotiated != proto {
+		logger.info("invalid negotiated protocol: %s", negotiated)
+		conn.Close()
+		return
+	}
+
+	if ok, debug := sv.checkConnPolicy(tlsConn); !ok {
+		logger.info("rejected by connection policy: %s", debug)
+		sv.metrics().Add("h2s_conn_rejected_total", 1, nil)
+		if debug != "" {
+			rejectConn(conn, debug)
+		}
+		conn.Close()
+		return
+	}
+
+	sv.startRW(logger, conn, handler)
+}
+
+// 公開フィールドの設定に基づき、コネクション間で共有する状態を初期化する。
+// ListenAndServe, ListenAndServeH2C, ServeConnメソッドのいずれから呼び出されても1度だけ行う。
+func (sv *Server) init() {
+	sv.initOnce.Do(func() {
+		sv.budget = newMemoryBudget(sv.MaxBufferedBytes, sv.metrics())
+		if sv.MaxConcurrentHandshakes > 0 {
+			sv.handshakes = make(chan struct{}, sv.MaxConcurrentHandshakes)
+		}
+		if sv.CorpusDir != "" {
+			sv.corpus = newCorpus(sv.CorpusDir, sv.MaxCorpusBytes, sv.log())
+		}
+		sv.load = newLoadShedder(sv)
+		sv.ipRate = newIPRateLimiter(sv.RateLimits)
+	})
+}
+
+// 確立済みの接続上でHTTP/2のデータの送受信を行う。
+// TLSハンドシェイクやALPNによるプロトコルの合意は呼び出し側で済ませておくか、
+// テスト等で事前にHTTP/2を用いることが分かっている接続を与える。
+// このメソッドはコネクションが終了するまで処理を返さない。
+func (sv *Server) ServeConn(conn net.Conn, handler http.Handler) {
+	sv.init()
+	sv.startRW(sv.newLogger(conn.RemoteAddr().String()), conn, handler)
+}
+
+// TLSハンドシェイクを行う権利を獲得する。
+// 上限に達している場合はHandshakeQueueTimeoutの間だけ待ち、
+// それでも獲得できなければ偽を返す。
+func (sv *Server) acquireHandshake() bool {
+	if sv.handshakes == nil {
+		return true
+	}
+
+	select {
+	case sv.handshakes <- struct{}{}:
+		return true
+	default:
+	}
+
+	if sv.HandshakeQueueTimeout <= 0 {
+		return false
+	}
+
+	timer := sv.clock().NewTimer(sv.HandshakeQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case sv.handshakes <- struct{}{}:
+		return true
+	case <-timer.C():
+		return false
+	}
+}
+
+// TLSハンドシェイクを行う権利を返却する
+func (sv *Server) releaseHandshake() {
+	if sv.handshakes != nil {
+		<-sv.handshakes
 	}
 }
 
 // reader, writerコンポーネントを初期化し、HTTP/2に関するデータの送受信を開始
-func startRW(logger logger, conn net.Conn, handler http.Handler) {
-	writer := newWriter(logger, conn)
-	runReader(logger, bufio.NewReader(conn), writer, handler)
+func (sv *Server) startRW(logger logger, conn net.Conn, handler http.Handler) {
+	// コネクションの各コンポーネントとリクエストハンドラーは、このコンテキストの終了により終了する
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remote := conn.RemoteAddr().String()
+	interceptor := sv.interceptor(conn)
+	counted := &countingConn{Conn: conn, readTimeout: sv.ReadTimeout, writeTimeout: sv.WriteTimeout}
+	writer := newWriter(ctx, cancel, sv, logger, counted, remote)
+	writer.interceptor = interceptor
+	observeRead, observeWrite := sv.frameObservers(remote)
+	writer.observe = observeWrite
+	writer.tracer = newFrameTracer(sv, logger, "send", defaultHeaderTableSize)
+	multiplexer := newMultiplexer(ctx, logger, writer, handler, sv)
+	multiplexer.conn = &Conn{mp: multiplexer, nc: conn, cancel: cancel}
+	multiplexer.clientIP = remote
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		multiplexer.clientIP = host
+	}
+
+	cs := &connState{
+		conn:        conn,
+		counted:     counted,
+		remote:      remote,
+		since:       sv.clock().Now(),
+		writer:      writer,
+		multiplexer: multiplexer,
+	}
+	// Shutdownメソッドの呼び出し後にハンドシェイクを終えた接続は処理しない
+	if !sv.trackConn(cs) {
+		logger.info("server is shutting down")
+		conn.Close()
+		return
+	}
+	defer sv.untrackConn(cs)
+
+	// 識別子の割り当て後、送受信を開始する前に記録を開始する
+	counted.capture = newCapture(sv, logger, cs)
+	defer counted.capture.close()
+
+	// 過負荷であれば、SETTINGSフレームの送信後に処理したストリームが無いことを
+	// GOAWAYフレームにより通知してコネクションを閉じる。
+	// クライアントは他のサーバーや時間を置いての再試行を判断できる。
+	if reason := sv.load.overloaded(); reason != "" {
+		sv.load.shed("conn", reason)
+		writer.writeGoAway(noError, "server overloaded")
+	}
+
+	runReader(sv, logger, counted, interceptor, observeRead, writer, multiplexer)
 	writer.run()
 }
+
+// Server.OnConnectionErrorが設定されていれば呼び出す
+func (sv *Server) connectionError(remote string, err error) {
+	if sv.OnConnectionError != nil {
+		sv.OnConnectionError(remote, err)
+	}
+}
+
+// メトリクスの送出先を返す。未設定なら何もしないMetricsを返す。
+func (sv *Server) metrics() Metrics {
+	if sv.Metrics == nil {
+		return nopMetrics{}
+	}
+	return sv.Metrics
+}
+
+func (sv *Server) acceptWorkers() int {
+	if sv.AcceptWorkers <= 0 {
+		return 1
+	}
+	return sv.AcceptWorkers
+}
+
+// SETTINGSフレームによりクライアントに通知する設定を返す
+func (sv *Server) settingsParams() []*settingsParam {
+	// 優先度はRFC 9218のpriorityヘッダーとPRIORITY_UPDATEフレームによってのみ扱う
+	params := []*settingsParam{
+		newSettingsParam(initialWindowSizeSetting, sv.initialWindowSize()),
+		newSettingsParam(noRFC7540PrioritiesSetting, 1),
+	}
+
+	if sv.MaxConcurrentStreams > 0 {
+		params = append(params,
+			newSettingsParam(maxConcurrentStreams, sv.MaxConcurrentStreams))
+	}
+
+	if sv.MaxFrameSize > 0 {
+		params = append(params,
+			newSettingsParam(maxFrameSizeSetting, uint32(sv.maxFrameSize())))
+	}
+
+	if sv.HeaderTableSize > 0 {
+		params = append(params,
+			newSettingsParam(headerTableSizeSetting, sv.HeaderTableSize))
+	}
+
+	if sv.MaxHeaderListSize > 0 {
+		params = append(params,
+			newSettingsParam(maxHeaderListSizeSetting, sv.MaxHeaderListSize))
+	}
+
+	if sv.DisablePush {
+		params = append(params, newSettingsParam(enablePushSetting, 0))
+	}
+
+	return params
+}
+
+// リクエストヘッダーのデコードに用いるHPACKの動的テーブルのサイズの上限
+func (sv *Server) headerTableSize() int {
+	if sv.HeaderTableSize == 0 {
+		return defaultHeaderTableSize
+	}
+	return int(sv.HeaderTableSize)
+}
+
+// HEADERS, CONTINUATIONフレームにより受信するヘッダーブロックのサイズの上限。
+// ヘッダーブロックは受信を終えるまでデコードできず、Limits.MaxHeaderListSizeによる検証はその後となるため、
+// END_HEADERSフラグの無いCONTINUATIONフレームを送り続けるクライアントに対してはこれにより制限する。
+// パスに依らず適用するため、MaxHeaderListSizeとLimitOverridesの中で最も緩い上限に、
+// エンコードによる増加分として1フレーム分の余裕を加える。
+func (sv *Server) maxHeaderBlockSize() int {
+	limit := int(sv.MaxHeaderListSize)
+	if sv.Limits.MaxHeaderListSize > 0 {
+		if sv.Limits.MaxHeaderListSize > limit {
+			limit = sv.Limits.MaxHeaderListSize
+		}
+	} else if limit == 0 {
+		limit = defaultMaxHeaderBlockSize
+	}
+
+	for _, o := range sv.LimitOverrides {
+		if o.Limits.MaxHeaderListSize > limit {
+			limit = o.Limits.MaxHeaderListSize
+		}
+	}
+	return limit + sv.maxFrameSize()
+}
+
+func (sv *Server) initialWindowSize() uint32 {
+	if sv.InitialWindowSize == 0 || sv.InitialWindowSize > maxWindowSize {
+		return maxWindowSize
+	}
+	return sv.InitialWindowSize
+}
+
+// 受信するフレームのペイロードの最大値。
+// 仕様で許される範囲に収まるよう補正する。
+func (sv *Server) maxFrameSize() int {
+	switch {
+	case sv.MaxFrameSize <= maxFrameSize:
+		return maxFrameSize
+	case sv.MaxFrameSize > maxAllowedFrameSize:
+		return maxAllowedFrameSize
+	}
+	return int(sv.MaxFrameSize)
+}
+
+func (sv *Server) readBufferSize() int {
+	if sv.ReadBufferSize <= 0 {
+		return defaultBufferSize
+	}
+	return sv.ReadBufferSize
+}
+
+func (sv *Server) writeBufferSize() int {
+	if sv.WriteBufferSize <= 0 {
+		return defaultBufferSize
+	}
+	return sv.WriteBufferSize
+}
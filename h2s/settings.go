@@ -0,0 +1,50 @@
+package h2s
+
+import "math"
+
+// クライアントがSETTINGSフレームにより通知した設定。
+// 通知されていない項目はRFC 9113の初期値となる。
+// Conn.PeerSettingsメソッドやServer.ConnStatsメソッドにより取得する。
+type PeerSettings struct {
+	HeaderTableSize   uint32 // SETTINGS_HEADER_TABLE_SIZE
+	EnablePush        bool   // SETTINGS_ENABLE_PUSH
+	InitialWindowSize uint32 // SETTINGS_INITIAL_WINDOW_SIZE
+	MaxFrameSize      uint32 // SETTINGS_MAX_FRAME_SIZE
+
+	// SETTINGS_MAX_CONCURRENT_STREAMS, SETTINGS_MAX_HEADER_LIST_SIZE。
+	// 通知されていなければ上限が無いことを表すmath.MaxUint32となる。
+	MaxConcurrentStreams uint32
+	MaxHeaderListSize    uint32
+}
+
+// SETTINGSフレームを受信する前の設定
+func defaultPeerSettings() PeerSettings {
+	return PeerSettings{
+		HeaderTableSize:      4096,
+		EnablePush:           true,
+		InitialWindowSize:    65535,
+		MaxFrameSize:         maxFrameSize,
+		MaxConcurrentStreams: math.MaxUint32,
+		MaxHeaderListSize:    math.MaxUint32,
+	}
+}
+
+// 受信したSETTINGSフレームの値を反映する。未知の設定は無視する
+func (ps *PeerSettings) apply(params map[settingsParamType]uint32) {
+	for typ, value := range params {
+		switch typ {
+		case headerTableSizeSetting:
+			ps.HeaderTableSize = value
+		case enablePushSetting:
+			ps.EnablePush = value == 1
+		case maxConcurrentStreams:
+			ps.MaxConcurrentStreams = value
+		case initialWindowSizeSetting:
+			ps.InitialWindowSize = value
+		case maxFrameSizeSetting:
+			ps.MaxFrameSize = value
+		case maxHeaderListSizeSetting:
+			ps.MaxHeaderListSize = value
+		}
+	}
+}
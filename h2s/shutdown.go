@@ -0,0 +1,111 @@
+package h2s
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Shutdownメソッドにて、全てのコネクションが終了したかを確認する間隔
+const shutdownPollInterval = 100 * time.Millisecond
+
+// サーバーを穏やかに終了させる。
+// 全てのリスナーを閉じて新たな接続要求の受け入れを止め、
+// まだリクエストを受信し得ないTLSハンドシェイク中の接続は直ちに閉じる。
+// 接続中のコネクションにはGOAWAYフレームを送信して新たなストリームを拒否させる。
+// その上で、処理中のストリームが全て完了してコネクションが閉じられるまで待つ。
+// ctx が先に終了した場合は残るコネクションを強制的に閉じ、ctx.Err()を返す。
+// ListenAndServeメソッドとは別のゴルーチンから呼び出すことができる。
+func (sv *Server) Shutdown(ctx context.Context) error {
+	sv.connsMu.Lock()
+	sv.inShutdown = true
+	for listener := range sv.listeners {
+		listener.Close()
+	}
+	for conn := range sv.handshaking {
+		conn.Close()
+	}
+	sv.connsMu.Unlock()
+
+	// inShutdownを真とした後は新たなコネクションが追跡対象とならないため、
+	// 終了の指示はこの時点で追跡しているコネクションに対してのみ行えば良い
+	for _, cs := range sv.trackedConns() {
+		cs.multiplexer.drain("shutdown")
+	}
+
+	clock := sv.clock()
+
+	for {
+		if len(sv.trackedConns()) == 0 {
+			return nil
+		}
+
+		timer := clock.NewTimer(shutdownPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			for _, cs := range sv.trackedConns() {
+				cs.multiplexer.conn.Close()
+			}
+			return ctx.Err()
+		case <-timer.C():
+		}
+	}
+}
+
+// Shutdownメソッドが呼び出されていれば真を返す
+func (sv *Server) shuttingDown() bool {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+	return sv.inShutdown
+}
+
+// リスナーをShutdownメソッドにより閉じる対象に加える。
+// 既にShutdownメソッドが呼び出されていれば偽を返す。
+func (sv *Server) trackListener(listener net.Listener) bool {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+
+	if sv.inShutdown {
+		return false
+	}
+	sv.listeners[listener] = struct{}{}
+	return true
+}
+
+// TLSハンドシェイク中の接続をShutdownメソッドにより閉じる対象に加える。
+// 既にShutdownメソッドが呼び出されていれば偽を返す。
+func (sv *Server) trackHandshake(conn net.Conn) bool {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+
+	if sv.inShutdown {
+		return false
+	}
+	sv.handshaking[conn] = struct{}{}
+	return true
+}
+
+func (sv *Server) untrackHandshake(conn net.Conn) {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+	delete(sv.handshaking, conn)
+}
+
+func (sv *Server) untrackListener(listener net.Listener) {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+	delete(sv.listeners, listener)
+}
+
+// 接続中のコネクションの一覧を返す
+func (sv *Server) trackedConns() []*connState {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+
+	conns := make([]*connState, 0, len(sv.conns))
+	for cs := range sv.conns {
+		conns = append(conns, cs)
+	}
+	return conns
+}
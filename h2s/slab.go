@@ -0,0 +1,63 @@
+package h2s
+
+const (
+	streamSlabSize = 64       // 1度に確保するストリームの数
+	bodySlabSize   = 64 << 10 // 1度に確保するリクエストボディ用の領域のサイズ
+	maxSlabBody    = 4 << 10  // スラブから確保するリクエストボディの容量の上限
+)
+
+// コネクション毎にストリームの状態を確保するためのスラブ。
+// ストリームやリクエストボディを1つずつヒープに確保する代わりに、
+// まとめて確保した領域から切り出す。確保した領域はコネクションの終了時に
+// スラブごと解放されるため、短命なストリームが大量に生成されても
+// ヒープの断片化やGCの走査対象の増加を抑えられる。
+type streamSlab struct {
+	streams []stream  // 未使用のストリーム
+	free    []*stream // closed状態となり再利用可能なストリーム
+	bodies  []byte    // リクエストボディ用の未使用の領域
+}
+
+// 指定の状態のストリームをスラブから確保する
+func (sl *streamSlab) newStream(state streamState) *stream {
+	var s *stream
+
+	if n := len(sl.free); n > 0 {
+		s, sl.free = sl.free[n-1], sl.free[:n-1]
+	} else {
+		if len(sl.streams) == 0 {
+			sl.streams = make([]stream, streamSlabSize)
+		}
+		s, sl.streams = &sl.streams[0], sl.streams[1:]
+	}
+
+	s.state = state
+	return s
+}
+
+// closed状態となったストリームを初期化し、再利用可能とする。
+// ヘッダーリストは容量を保ったまま再利用する。
+func (sl *streamSlab) release(s *stream) {
+	for i := range s.headers {
+		s.headers[i] = nil
+	}
+
+	*s = stream{headers: s.headers[:0]}
+	sl.free = append(sl.free, s)
+}
+
+// 容量 capacity のリクエストボディ用のバッファを確保する。
+// 小さなバッファはスラブから切り出し、大きなバッファはヒープに確保する。
+// 切り出したバッファの容量を超えてappendした場合は通常通りヒープに再確保される。
+func (sl *streamSlab) newBody(capacity int) []byte {
+	if capacity == 0 || capacity > maxSlabBody {
+		return make([]byte, 0, capacity)
+	}
+
+	if len(sl.bodies) < capacity {
+		sl.bodies = make([]byte, bodySlabSize)
+	}
+
+	body := sl.bodies[:0:capacity]
+	sl.bodies = sl.bodies[capacity:]
+	return body
+}
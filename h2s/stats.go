@@ -0,0 +1,201 @@
+package h2s
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// コネクション毎のリソースの使用状況。
+	// ログやメトリクスとは別に、プログラムから任意の時点で取得するために用いる。
+	ConnStats struct {
+		// プロセス内で一意なコネクションの識別子。
+		// Server.DrainConn, Server.CloseConnメソッドに与えて操作対象を指定する。
+		ID uint64
+
+		RemoteAddr string
+		Since      time.Time // 接続を開始した時刻
+
+		// コネクション上で送受信したバイト数。TLSのレコードを除いたHTTP/2のフレームの合計
+		BytesRead    int64
+		BytesWritten int64
+
+		// コネクションが使用しているゴルーチンの数。
+		// reader, writerコンポーネントと実行中のリクエストハンドラーの合計。
+		Goroutines int
+
+		// バッファしているバイト数。
+		// リクエストボディ、送信を待機しているDATAフレーム、
+		// 不完全なヘッダーブロックのサイズの合計。
+		BufferedBytes int64
+
+		Streams           int // メモリ上に保持しているストリームの数
+		RunningHandlers   int // 実行中のリクエストハンドラーの数
+		PendingDataFrames int // ウィンドウサイズの不足により送信を待機しているDATAフレームの数
+
+		// デコードに用いるHPACKのインデックステーブルの利用状況
+		HPACKTableSize    int
+		HPACKMaxTableSize int
+		HPACKEntries      int
+
+		// クライアントがSETTINGSフレームにより通知した設定
+		PeerSettings PeerSettings
+
+		// キープアライブのPINGフレームにより最後に計測したクライアントとの往復時間。
+		// Server.KeepAliveIntervalが0の場合や、まだ計測していない場合は0。
+		RTT time.Duration
+	}
+
+	// 使用状況の取得や終了のために保持しておくコネクションの各コンポーネント
+	connState struct {
+		id          uint64
+		conn        net.Conn
+		counted     *countingConn
+		remote      string
+		since       time.Time
+		writer      *writer
+		multiplexer *multiplexer
+	}
+
+	// 送受信したバイト数を数えるnet.Conn。
+	// readTimeout, writeTimeoutが正なら、読み書きの度にその時間後をデッドラインとして設定する。
+	// captureが非nilなら、送受信したバイト列をそれに記録する。
+	countingConn struct {
+		net.Conn
+		read    int64 // sync/atomicによりアクセスする
+		written int64 // sync/atomicによりアクセスする
+
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		capture      *capture
+	}
+)
+
+// 最後に割り当てたコネクションの識別子。sync/atomicによりアクセスする
+var lastConnID uint64
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	c.capture.received(b[:n])
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	c.capture.sent(b[:n])
+	return n, err
+}
+
+// コネクションを使用状況の取得対象に加え、識別子を割り当てる。
+// 既にShutdownメソッドが呼び出されていれば偽を返す。
+func (sv *Server) trackConn(cs *connState) bool {
+	cs.id = atomic.AddUint64(&lastConnID, 1)
+
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+
+	if sv.inShutdown {
+		return false
+	}
+	sv.conns[cs] = struct{}{}
+	return true
+}
+
+// コネクションを使用状況の取得対象から外す
+func (sv *Server) untrackConn(cs *connState) {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+	delete(sv.conns, cs)
+}
+
+// 接続中の全コネクションのリソースの使用状況を返す。
+// ListenAndServeメソッドとは別のゴルーチンから呼び出すことができる。
+func (sv *Server) ConnStats() []ConnStats {
+	conns := sv.trackedConns()
+	stats := make([]ConnStats, 0, len(conns))
+	for _, cs := range conns {
+		stats = append(stats, cs.stats())
+	}
+	return stats
+}
+
+func (cs *connState) stats() ConnStats {
+	mp := cs.multiplexer
+	mp.mu.Lock()
+	running := mp.runningHandlers
+	readerRunning := !mp.closing
+	table := mp.indexTable.Stats()
+	peer := mp.peerSettings
+	mp.mu.Unlock()
+
+	// writerコンポーネントのゴルーチンは常に1つ存在する
+	goroutines := 1 + running
+	if readerRunning {
+		goroutines++
+	}
+
+	return ConnStats{
+		ID:                cs.id,
+		RemoteAddr:        cs.remote,
+		Since:             cs.since,
+		BytesRead:         atomic.LoadInt64(&cs.counted.read),
+		BytesWritten:      atomic.LoadInt64(&cs.counted.written),
+		Goroutines:        goroutines,
+		BufferedBytes:     cs.writer.mem.bytes(),
+		Streams:           mp.streams.len(),
+		RunningHandlers:   running,
+		PendingDataFrames: int(atomic.LoadInt32(&cs.writer.pendingFrames)),
+		HPACKTableSize:    table.TableSize,
+		HPACKMaxTableSize: table.MaxTableSize,
+		HPACKEntries:      table.Entries,
+		PeerSettings:      peer,
+		RTT:               time.Duration(atomic.LoadInt64(&cs.writer.rtt)),
+	}
+}
+
+// 識別子 id のコネクションを、Conn.Drainメソッドと同様に穏やかに終了させる。
+// 問題のあるクライアントを、サーバーを再起動せずに切断するために用いる。
+// ListenAndServeメソッドとは別のゴルーチンから呼び出すことができる。
+// 該当するコネクションが無ければ偽を返す。
+func (sv *Server) DrainConn(id uint64, reason string) bool {
+	cs := sv.lookupConn(id)
+	if cs == nil {
+		return false
+	}
+	cs.multiplexer.conn.Drain(reason)
+	return true
+}
+
+// 識別子 id のコネクションを、Conn.Closeメソッドと同様に直ちに閉じる。
+// 処理が停滞したコネクションを切断するために用いる。
+// 該当するコネクションが無ければ偽を返す。
+func (sv *Server) CloseConn(id uint64) bool {
+	cs := sv.lookupConn(id)
+	if cs == nil {
+		return false
+	}
+	cs.multiplexer.conn.Close()
+	return true
+}
+
+// 識別子 id のコネクションを返す。無ければnilを返す
+func (sv *Server) lookupConn(id uint64) *connState {
+	sv.connsMu.Lock()
+	defer sv.connsMu.Unlock()
+
+	for cs := range sv.conns {
+		if cs.id == id {
+			return cs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package h2s
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type (
+	// 分散トレーシングのスパンを開始するインターフェイス。
+	// Server.Tracerに設定すると、ストリーム毎にリクエストハンドラーの実行からレスポンスの送信までを覆う
+	// スパンを開始する。OpenTelemetry等のトレーシングのライブラリに依存しないよう、
+	// それらのTracerProviderへの橋渡しは利用者が実装する。
+	Tracer interface {
+		// リクエストのスパンを開始する。parent はtraceparent, tracestateヘッダーから取り出した
+		// 呼び出し元のスパンであり、ヘッダーが無いか不正なら無効(IsValidが偽)である。
+		// 返したコンテキストをリクエストのコンテキストとするため、リクエストハンドラーは子のスパンを作成できる。
+		// multiplexerコンポーネントのゴルーチンから呼び出すため、速やかに処理を返すこと。
+		StartSpan(r *http.Request, parent SpanContext) (context.Context, Span)
+	}
+
+	// Tracerが開始したスパン
+	Span interface {
+		// レスポンスの最後のフレームをピアへ送信した時点で、ステータスコードを与えて呼び出す。
+		// レスポンスを送信しなかった場合(ストリームのリセット、リクエストハンドラーのパニックや
+		// 実行時間の超過)は、statusCode を0とし err にその理由を与える。
+		End(statusCode int, err error)
+	}
+
+	// W3C Trace Contextにより伝播された呼び出し元のスパン
+	SpanContext struct {
+		TraceID    [16]byte
+		SpanID     [8]byte
+		Flags      byte   // trace-flags。最下位ビットはサンプリングされていることを表す
+		TraceState string // tracestateヘッダーの値。加工せずにそのまま保持する
+	}
+)
+
+// リクエストハンドラーのパニックによりレスポンスを送信しなかったことを表すエラー。Span.Endに与える
+var errHandlerPanicked = errors.New("h2s: handler panicked")
+
+// トレースIDとスパンIDがいずれも0でなければ真を返す
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// サンプリングされていれば真を返す
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&0x01 != 0
+}
+
+// traceparent, tracestateヘッダーから呼び出し元のスパンを取り出す。
+// traceparentが無いか不正であれば無効なSpanContextを返す。
+// 未知のバージョンは、先頭の4つのフィールドのみを解釈する。
+func extractSpanContext(header http.Header) SpanContext {
+	var sc SpanContext
+
+	fields := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(fields) < 4 {
+		return sc
+	}
+
+	version, traceID, spanID, flags := fields[0], fields[1], fields[2], fields[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(fields) != 4) {
+		return sc
+	}
+
+	var v [1]byte
+	var f [1]byte
+	if !decodeLowerHex(v[:], version) || !decodeLowerHex(sc.TraceID[:], traceID) ||
+		!decodeLowerHex(sc.SpanID[:], spanID) || !decodeLowerHex(f[:], flags) || !sc.IsValid() {
+		return SpanContext{}
+	}
+
+	sc.Flags = f[0]
+	sc.TraceState = strings.Join(header.Values("tracestate"), ",")
+	return sc
+}
+
+// 小文字の16進数の文字列 s を dst の長さ分だけデコードする。長さや文字が不正なら偽を返す
+func decodeLowerHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
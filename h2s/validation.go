@@ -0,0 +1,301 @@
+package h2s
+
+import (
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"strconv"
+	"strings"
+)
+
+// 受信したフレームやリクエストヘッダーを検証する厳密さ。
+// Server.Validationに設定する。
+type ValidationProfile int
+
+const (
+	// 仕様上必須の検証のうち、コストの低いものを行う。
+	// 疑似ヘッダーの構成、ヘッダーの名前に用いる文字、SETTINGSフレームの値の範囲を検証する。
+	// いずれのValidationProfileでも、RFC 9113 8.2により不正とされるヘッダーの名前の大文字、
+	// コネクション固有のヘッダー、trailers以外の値のteヘッダーは検証する。
+	ValidationDefault ValidationProfile = iota
+
+	// ValidationDefaultに加え、ヘッダーの値に用いる文字と、
+	// パディングが全て0であることを検証する。
+	ValidationStrict
+
+	// 処理に必要な最低限の検証のみを行う。
+	// 範囲外のSETTINGSフレームの値はエラーとせずに無視する。
+	ValidationRelaxed
+)
+
+// ValidationProfileから導出する、個々の検証を行うかどうか
+type validation struct {
+	pseudoHeaders bool // 疑似ヘッダーの重複、未知の名前、通常のヘッダーとの順序
+	fieldNames    bool // ヘッダーの名前に用いる文字。大文字はcheckFieldsにより常に検証する
+	fieldValues   bool // ヘッダーの値に用いる文字
+	zeroPadding   bool // パディングが全て0であること
+	settingsRange bool // SETTINGSフレームの値の範囲。偽なら範囲外の値は無視する
+}
+
+func (p ValidationProfile) validation() validation {
+	switch p {
+	case ValidationStrict:
+		return validation{
+			pseudoHeaders: true,
+			fieldNames:    true,
+			fieldValues:   true,
+			zeroPadding:   true,
+			settingsRange: true,
+		}
+	case ValidationRelaxed:
+		return validation{}
+	}
+	return validation{pseudoHeaders: true, fieldNames: true, settingsRange: true}
+}
+
+// リクエストの疑似ヘッダー
+var requestPseudoHeaders = map[string]struct{}{
+	":method":    {},
+	":scheme":    {},
+	":authority": {},
+	":path":      {},
+}
+
+// リクエストヘッダーを検証する。不正であればPROTOCOL_ERRORのストリームエラーとなるエラーを返す
+func (v validation) checkHeaders(headers hpack.HeaderList) *h2Error {
+	seen := make(map[string]struct{}, len(requestPseudoHeaders))
+	regular := false
+
+	for _, hf := range headers {
+		name := hf.Name()
+
+		if v.pseudoHeaders && len(name) > 0 && name[0] == ':' {
+			if regular {
+				return newError(protocolError, "pseudo-header %s after regular header", name)
+			}
+			if _, ok := requestPseudoHeaders[name]; !ok {
+				return newError(protocolError, "unknown pseudo-header %s", name)
+			}
+			if _, ok := seen[name]; ok {
+				return newError(protocolError, "duplicated pseudo-header %s", name)
+			}
+			seen[name] = struct{}{}
+			continue
+		}
+		regular = true
+
+		if v.fieldNames && !validFieldName(name) {
+			return newError(protocolError, "invalid header name %q", name)
+		}
+		if v.fieldValues && !validFieldValue(hf.Value()) {
+			return newError(protocolError, "invalid value of header %s", name)
+		}
+	}
+
+	return nil
+}
+
+// リクエストのトレーラーを検証する。不正であればPROTOCOL_ERRORのストリームエラーとなるエラーを返す。
+// トレーラーは疑似ヘッダーを持ってはならず、通常のヘッダーと同様にcheckFields関数の検証を常に行う。
+func (v validation) checkTrailers(trailers hpack.HeaderList) *h2Error {
+	for _, hf := range trailers {
+		if name := hf.Name(); len(name) > 0 && name[0] == ':' {
+			return newError(protocolError, "pseudo-header %s in trailers", name)
+		}
+	}
+	if err := checkFields(trailers); err != nil {
+		return err
+	}
+	return v.checkHeaders(trailers)
+}
+
+// HTTP/2では用いてはならない、コネクション固有のヘッダー。
+// RFC 9113 8.2.2によりこれらを含むリクエストは不正なものとして扱う必要がある。
+// http.Requestはヘッダーリストから直接構築するためこのサーバー自身の解釈には影響しないが、
+// 受け入れるとリクエストハンドラーやプロキシ先のHTTP/1.1サーバーにそのまま渡り、
+// transfer-encoding等によりリクエストボディの境界が変わり得る。
+var connectionSpecificHeaders = map[string]struct{}{
+	"connection":        {},
+	"keep-alive":        {},
+	"proxy-connection":  {},
+	"transfer-encoding": {},
+	"upgrade":           {},
+}
+
+// RFC 9113 8.2により、リクエストを不正なものとして扱う必要があるヘッダーを検証する。
+// ValidationProfileに関わらず常に行い、不正であればPROTOCOL_ERRORのストリームエラーとなるエラーを返す。
+func checkFields(headers hpack.HeaderList) *h2Error {
+	for _, hf := range headers {
+		name := hf.Name()
+		for i := 0; i < len(name); i++ {
+			if 'A' <= name[i] && name[i] <= 'Z' {
+				return newError(protocolError, "uppercase header name %q", name)
+			}
+		}
+
+		if _, ok := connectionSpecificHeaders[name]; ok {
+			return newError(protocolError, "connection-specific header %s", name)
+		}
+
+		// teヘッダーはtrailers以外の値を持ってはならない
+		if name == "te" && !strings.EqualFold(strings.TrimSpace(hf.Value()), "trailers") {
+			return newError(protocolError, "invalid te header")
+		}
+	}
+	return nil
+}
+
+// リクエストボディの境界に関わるヘッダーを検証する。
+// ValidationProfileに関わらず常に行い、不正であればPROTOCOL_ERRORのストリームエラーとなるエラーを返す。
+// bodyLen は受信したリクエストボディの長さであり、content-lengthヘッダーと一致する必要がある。
+func checkFraming(headers hpack.HeaderList, bodyLen int) *h2Error {
+	contentLength := int64(-1)
+
+	for _, hf := range headers {
+		if hf.Name() != "content-length" {
+			continue
+		}
+
+		// 複数のcontent-lengthヘッダーやカンマ区切りの値は、全て同じ値である場合のみ受け入れる
+		for _, v := range strings.Split(hf.Value(), ",") {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil || n < 0 {
+				return newError(protocolError, "invalid content-length")
+			}
+			if contentLength >= 0 && n != contentLength {
+				return newError(protocolError, "conflicting content-length")
+			}
+			contentLength = n
+		}
+	}
+
+	if contentLength >= 0 && contentLength != int64(bodyLen) {
+		return newError(protocolError,
+			"content-length(%d) mismatches body length(%d)", contentLength, bodyLen)
+	}
+	return nil
+}
+
+// CONNECTメソッドのリクエストなら真を返す
+func isConnect(headers hpack.HeaderList) bool {
+	method := headers.Get(":method")
+	return method != nil && method.Value() == "CONNECT"
+}
+
+// CONNECTメソッドのリクエストの疑似ヘッダーを検証する。
+// ValidationProfileに関わらず常に行い、:authorityを持ち、:schemeと:pathを持たない必要がある。
+// CONNECTメソッド以外のリクエストなら何もしない。
+func checkConnect(headers hpack.HeaderList) *h2Error {
+	if !isConnect(headers) {
+		return nil
+	}
+
+	authority := headers.Get(":authority")
+	if authority == nil || authority.Value() == "" {
+		return newError(protocolError, "CONNECT request without :authority")
+	}
+	if headers.Get(":scheme") != nil || headers.Get(":path") != nil {
+		return newError(protocolError, "CONNECT request with :scheme or :path")
+	}
+	return nil
+}
+
+// HTTP/2のヘッダーの名前として正当なら真を返す。
+// tokenとして許される文字のうち、大文字を除いたものからなる必要がある。
+func validFieldName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isTokenChar(c) || ('A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// HTTPのメソッドとして正当なら真を返す。tokenとして許される文字からなる必要がある。
+func validMethod(method string) bool {
+	if len(method) == 0 {
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		if !isTokenChar(method[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenとして許される文字なら真を返す
+func isTokenChar(c byte) bool {
+	if c <= ' ' || c >= 0x7F {
+		return false
+	}
+	switch c {
+	case '(', ')', ',', '/', ':', ';', '<', '=', '>', '?', '@', '[', '\\', ']', '{', '}', '"':
+		return false
+	}
+	return true
+}
+
+// ヘッダーの値として正当なら真を返す。
+// NUL, CR, LFを含まず、前後に空白を持たない必要がある。
+func validFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case 0, '\r', '\n':
+			return false
+		}
+	}
+
+	if n := len(value); n > 0 {
+		switch {
+		case value[0] == ' ', value[0] == '\t', value[n-1] == ' ', value[n-1] == '\t':
+			return false
+		}
+	}
+	return true
+}
+
+// SETTINGSフレームの値を検証する。範囲外の値があればコネクションエラーとなるエラーを返すが、
+// settingsRangeが偽ならその値を params から取り除いて無視する。
+func (v validation) checkSettings(params map[settingsParamType]uint32) *h2Error {
+	for typ, value := range params {
+		var err *h2Error
+		switch typ {
+		case enablePushSetting:
+			if value > 1 {
+				err = newError(protocolError, "invalid SETTINGS_ENABLE_PUSH(%d)", value)
+			}
+		case initialWindowSizeSetting:
+			if value > maxWindowSize {
+				err = newError(flowControlError, "too large SETTINGS_INITIAL_WINDOW_SIZE(%d)", value)
+			}
+		case maxFrameSizeSetting:
+			if value < maxFrameSize || value > maxAllowedFrameSize {
+				err = newError(protocolError, "invalid SETTINGS_MAX_FRAME_SIZE(%d)", value)
+			}
+		case noRFC7540PrioritiesSetting:
+			if value > 1 {
+				err = newError(protocolError, "invalid SETTINGS_NO_RFC7540_PRIORITIES(%d)", value)
+			}
+		}
+
+		if err != nil {
+			if v.settingsRange {
+				return err
+			}
+			delete(params, typ)
+		}
+	}
+	return nil
+}
+
+// パディングが全て0であれば真を返す
+func zeroPadding(padding []byte) bool {
+	for _, b := range padding {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
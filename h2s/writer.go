@@ -1,52 +1,187 @@
 package h2s
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// フロー制御のウィンドウサイズをメトリクスとして通知する間隔
+const windowSampleInterval = time.Second
+
 type (
 	// 他コンポーネントからウィンドウサイズの加算を
 	// 通知する際に用いる構造体
 	windowIncremented struct {
-		id    streamID
-		value int64
+		id     streamID
+		value  int64
+		closed bool          // 対象のストリームをmultiplexerコンポーネントが既に閉じていれば真
+		result chan *h2Error // 加算の結果。ウィンドウサイズが上限を超えるならエラー
+	}
+
+	// 他コンポーネントからピアの設定の変更を通知する際に用いる構造体
+	settingsChanged struct {
+		params map[settingsParamType]uint32
+		result chan *h2Error // 反映の結果。ウィンドウサイズが上限を超えるならエラー
+	}
+
+	// ウィンドウサイズの不足により送信を待機しているDATAフレームと、
+	// その後に送信する必要のあるトレーラー等の同じストリームのフレーム
+	pendingFrame struct {
+		*frame
+		since time.Time // 待機を開始した時刻
+		scope string    // 待機の原因となったウィンドウ(connection, stream)
 	}
 
 	// writerコンポーネントを表す構造体
 	writer struct {
+		// コネクションのコンテキストの終了を通知するチャネルと、それを終了させる関数。
+		// ピアとの接続を閉じるとコンテキストを終了させ、他のコンポーネントからのフレームの送信や
+		// 処理中のリクエストハンドラーにコネクションの終了を伝える。
+		done   <-chan struct{}
+		cancel context.CancelFunc
+
 		logger        logger
+		metrics       Metrics
 		peer          io.WriteCloser
-		in            chan *frame
-		settings      chan map[settingsParamType]uint32
+		buffered      *bufio.Writer // peerへの書き込みをバッファする
+		clock         Clock
+		flushDelay    time.Duration   // バッファを送信するまでの待機時間
+		framer        *h2frame.Framer // bufferedへフレームを書き出す
+		interceptor   FrameInterceptor
+		observe       func(FrameHeader) // 非nilならピアへ書き出したフレームを与えて呼び出す
+		tracer        *frameTracer      // 非nilならピアへ書き出したフレームをログに出力する
+		in            chan []*frame
+		settings      chan *settingsChanged
+		inspect       chan chan<- *writerSnapshot // Server.Connectionsによるフロー制御の状態の要求
+		advertised    []*settingsParam            // 最初に送信するSETTINGSフレームの設定
 		lastProcessed streamID
 		maxFrameSize  int
 
 		initWindow    int64
 		window        chan *windowIncremented
 		streamsWindow map[streamID]int64
-		pendingData   []*frame
+		pendingData   []*pendingFrame
+		pendingFrames int32 // len(pendingData)。他のゴルーチンからsync/atomicにより参照する
+
+		// キープアライブのPINGフレームにより最後に計測した往復時間(ナノ秒)。
+		// 未計測なら0。keepAliveが記録し、sync/atomicによりアクセスする
+		rtt int64
+
+		// 真ならDATAフレームをストリーム毎に適応的なサイズで分割する。
+		// その際のストリーム毎の次のフレームのサイズ。
+		adaptiveData  bool
+		dataFrameSize map[streamID]int
+
+		// コネクションがバッファしているバイト数。
+		// reader, multiplexerコンポーネントもこれを用いて計上する。
+		mem      *connMemory
+		pressure chan struct{}
+
+		// Server.MaxSendBytesPerSecondによる送信の帯域幅の制限。無制限ならnil。
+		// 帯域幅の不足により待機しているDATAフレームがある間は、
+		// トークンの補充を待つためのタイマーを設定する。
+		sendRate  *tokenBucket
+		paceTimer Timer
+		paceC     <-chan time.Time
+
+		// コネクションを閉じたGOAWAYフレーム。送受信した最初のもののみを保持する
+		goAwayMu sync.Mutex
+		goAway   *ConnectionError
+
+		// Server.GoAwayDebugData。非nilなら送信するGOAWAYフレームのデバッグデータを置き換える
+		goAwayDebug func(code errorCode, reason string) string
+
+		// コネクションを終了させたエラーをServer.OnConnectionErrorに通知する関数と、
+		// 既に通知したかどうか。goAwayMuにより保護する
+		onError  func(err error)
+		reported bool
+
+		// RFC 9218によるストリーム毎の優先度。multiplexerコンポーネントが設定し、
+		// 退避されたDATAフレームを送信する順序の決定に用いる。
+		// ストリームを閉じるフレームを送信した時点で削除する。
+		priorityMu sync.Mutex
+		priorities map[streamID]priority
 	}
 )
 
-func newWriter(logger logger, peer io.WriteCloser) *writer {
-	return &writer{
+// DATAフレームを適応的なサイズで分割する場合の、ストリームの最初のフレームのサイズ
+const initialDataFrameSize = 4096
+
+func newWriter(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	server *Server,
+	logger logger,
+	peer io.WriteCloser,
+	remote string,
+) *writer {
+	w := &writer{
+		done:         ctx.Done(),
+		cancel:       cancel,
 		logger:       logger,
+		metrics:      server.metrics(),
 		peer:         peer,
-		in:           make(chan *frame, 1),
-		settings:     make(chan map[settingsParamType]uint32),
+		buffered:     bufio.NewWriterSize(peer, server.writeBufferSize()),
+		clock:        server.clock(),
+		flushDelay:   server.FlushDelay,
+		in:           make(chan []*frame, 1),
+		settings:     make(chan *settingsChanged),
+		inspect:      make(chan chan<- *writerSnapshot),
+		advertised:   server.settingsParams(),
 		maxFrameSize: 16384,
 
 		initWindow:    65535,
 		window:        make(chan *windowIncremented),
 		streamsWindow: make(map[streamID]int64),
-		pendingData:   make([]*frame, 0),
+		pendingData:   make([]*pendingFrame, 0),
+		adaptiveData:  server.AdaptiveDataFrameSize,
+		goAwayDebug:   server.GoAwayDebugData,
+		dataFrameSize: make(map[streamID]int),
+		pressure:      make(chan struct{}, 1),
+		priorities:    make(map[streamID]priority),
+	}
+	w.onError = func(err error) { server.connectionError(remote, err) }
+
+	if rate := server.MaxSendBytesPerSecond; rate > 0 {
+		w.sendRate = newTokenBucket(float64(rate), 0, w.clock.Now())
 	}
+
+	w.framer = h2frame.NewFramer(w.buffered, nil)
+	w.mem = server.budget.newConn(w.notifyPressure)
+	return w
 }
 
-// 他のコンポーネントからフレームを送信する
+// 他のコンポーネントからフレームを送信する。
+// 以下の各メソッドは、コネクションのコンテキストが終了していれば何もせずに処理を返す。
 func (w *writer) write(f *frame) {
-	w.in <- f
+	w.writeFrames([]*frame{f})
+}
+
+// 他のコンポーネントから一連のフレームをまとめて送信する。
+// レスポンスを構成するHEADERS, DATAフレームを1度のチャネル送信で渡すために用いる。
+func (w *writer) writeFrames(frames []*frame) {
+	select {
+	case w.in <- frames:
+	case <-w.done:
+	}
+}
+
+// フレームを送信し、それがピアへ送信されるか破棄されるまで待つ
+func (w *writer) writeAndWait(f *frame) {
+	written := make(chan struct{})
+	f.written = written
+	w.write(f)
+
+	select {
+	case <-written:
+	case <-w.done:
+	}
 }
 
 // GOAWAYフレーム送信のシンタックスシュガー
@@ -57,88 +192,224 @@ func (w *writer) writeGoAway(
 	w.write(buildGoAwayFrame(newError(code, format, a...)))
 }
 
-func (w *writer) changeSettings(params map[settingsParamType]uint32) {
-	w.settings <- params
+// ストリーム id の優先度を設定する。
+// override が偽なら、PRIORITY_UPDATEフレームにより既に設定されている優先度を優先する。
+func (w *writer) prioritize(id streamID, p priority, override bool) {
+	w.priorityMu.Lock()
+	defer w.priorityMu.Unlock()
+
+	if _, ok := w.priorities[id]; ok {
+		if override {
+			w.priorities[id] = p
+		}
+	} else if len(w.priorities) < maxTrackedPriorities {
+		w.priorities[id] = p
+	}
+}
+
+// ストリーム id の優先度を破棄する
+func (w *writer) forgetPriority(id streamID) {
+	w.priorityMu.Lock()
+	delete(w.priorities, id)
+	w.priorityMu.Unlock()
+}
+
+// ピアの設定の変更をwriterコンポーネントに通知し、その結果を返す。
+// 初期ウィンドウサイズの変更によりストリームのウィンドウサイズが上限を超える場合は反映せず、
+// FLOW_CONTROL_ERRORのエラーを返す
+func (w *writer) changeSettings(params map[settingsParamType]uint32) *h2Error {
+	change := &settingsChanged{params: params, result: make(chan *h2Error, 1)}
+	select {
+	case w.settings <- change:
+		return <-change.result
+	case <-w.done:
+		return nil
+	}
+}
+
+// ウィンドウサイズの加算をwriterコンポーネントに通知し、その結果を返す。
+// 加算によりウィンドウサイズが上限を超える場合は加算せず、FLOW_CONTROL_ERRORのエラーを返す。
+// closed は対象のストリームが既に閉じていれば真とする。
+func (w *writer) incrWindow(id streamID, value int64, closed bool) *h2Error {
+	incr := &windowIncremented{id: id, value: value, closed: closed, result: make(chan *h2Error, 1)}
+	select {
+	case w.window <- incr:
+		return <-incr.result
+	case <-w.done:
+		return nil
+	}
+}
+
+// メモリ不足による切断をwriterコンポーネントに通知。
+// 他のコネクションのゴルーチンから呼び出されるためブロックしない。
+func (w *writer) notifyPressure() {
+	select {
+	case w.pressure <- struct{}{}:
+	default:
+	}
+}
+
+// コネクションを閉じたGOAWAYフレームを記録する。既に記録していれば何もしない。
+// エラーコードがNO_ERRORでなければ、コネクションのエラーとして通知する。
+func (w *writer) recordGoAway(e *ConnectionError) {
+	w.goAwayMu.Lock()
+	if w.goAway == nil {
+		w.goAway = e
+	}
+	w.goAwayMu.Unlock()
+
+	if e.Code != noError {
+		w.reportError(e)
+	}
 }
 
-// ウィンドウサイズの加算をwriterコンポーネントに通知
-func (w *writer) incrWindow(id streamID, value int64) {
-	w.window <- &windowIncremented{id: id, value: value}
+// コネクションを終了させたエラーをServer.OnConnectionErrorに通知する。
+// コネクション毎に最初のエラーのみ通知する。
+func (w *writer) reportError(err error) {
+	w.goAwayMu.Lock()
+	first := !w.reported
+	w.reported = true
+	w.goAwayMu.Unlock()
+
+	if first {
+		w.onError(err)
+	}
 }
 
-// writerコンポーネントの終了
+// ピアへの書き込みの失敗を通知し、接続を閉じる
+func (w *writer) writeFailed(err error) {
+	w.reportError(&TransportError{Op: "write", Err: err})
+	w.closePeer()
+}
+
+// 記録したGOAWAYフレームを返す。無ければnilを返す
+func (w *writer) connError() *ConnectionError {
+	w.goAwayMu.Lock()
+	defer w.goAwayMu.Unlock()
+	return w.goAway
+}
+
+// writerコンポーネントの終了。
+// コネクションのコンテキストを終了させ、既に渡されたフレームを送信した上で接続を閉じる。
+// 以降に渡されたフレームは破棄される。
 func (w *writer) shutdown() {
-	close(w.in)
+	w.cancel()
 }
 
 // writerコンポーネントの起動。
 // writeメソッドにより与えられたフレームを継続的にピアに送信する
 func (w *writer) run() {
-	defer w.logger("writer shutdown")
-
-	w.write(&frame{
-		typ: settingsFrame,
-		payload: encodeSettingsParam([]*settingsParam{
-			newSettingsParam(initialWindowSizeSetting, 2147483647),
-		}),
+	defer w.logger.debug("writer shutdown")
+	defer w.mem.close()
+
+	// SETTINGSフレームは最初に送信しなければならないため、
+	// 他のコンポーネントから渡されたフレームより先に直接送信する
+	w.sendToPeer(&frame{
+		typ:     settingsFrame,
+		payload: encodeSettingsParam(w.advertised),
 	})
+	w.flush()
 
 	// コネクションレベルのウィンドウサイズに初期ウィンドウサイズを設定。
 	// ストリームID:0のストリームは存在しないため、
 	// これをコネクションレベルのウィンドウサイズとして扱う。
 	w.streamsWindow[0] = w.initWindow
 
+	// バッファの送信を遅延させている間のみ非nilとなるタイマー
+	var flushTimer Timer
+	var flushTimeout <-chan time.Time
+
+	sampleTimer := w.clock.NewTimer(windowSampleInterval)
+	defer func() {
+		sampleTimer.Stop()
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+		if w.paceTimer != nil {
+			w.paceTimer.Stop()
+		}
+	}()
+
 	for {
 		select {
-		case f, ok := <-w.in:
-			// shutdownメソッドにより終了が指示(チャネルがclose)されている場合
-			// 接続を閉じて処理を返す
-			if !ok {
-				w.closePeer()
-				return
+		case frames := <-w.in:
+			for _, f := range frames {
+				w.process(f)
 			}
 
-			switch f.typ {
-			case dataFrame:
-				// DATAフレームのフレームサイズに対して
-				// ウィンドウサイズが少ない場合、DATAフレームを一旦退避させる。
-				if _, ok := w.streamsWindow[f.streamID]; !ok {
-					w.streamsWindow[f.streamID] = w.initWindow
+		case <-w.done:
+			// コネクションのコンテキストが終了した場合、既に渡されたフレームを
+			// 送信した上で接続を閉じて処理を返す
+			for len(w.in) > 0 {
+				for _, f := range <-w.in {
+					w.process(f)
 				}
-
-				pLen := int64(len(f.payload))
-				if w.streamsWindow[0] < pLen ||
-					w.streamsWindow[f.streamID] < pLen {
-					w.pendingData = append(w.pendingData, f)
-					continue
-				}
-
-			case goAwayFrame:
-				binary.BigEndian.PutUint32(f.payload, uint32(w.lastProcessed))
 			}
+			w.closePeer()
+			return
 
+		case <-w.pressure:
+			// サーバー全体でバッファしているバイト数が上限を超過しているため、
+			// このコネクションを切断する
+			f := buildGoAwayFrame(
+				newError(enhanceYourCalm, "memory pressure"))
+			binary.BigEndian.PutUint32(f.payload, uint32(w.lastProcessed))
 			w.sendToPeer(f)
 
 		case incr := <-w.window:
+			// 閉じたストリームのDATAフレームを全て送信し終えていれば、
+			// 以降そのウィンドウサイズは参照しないため加算を破棄する。
+			// multiplexerコンポーネントはレスポンスを渡した時点でストリームを閉じるため、
+			// 退避されたDATAフレームが残っている間は加算しなければ送信が停止してしまう。
+			// 渡されたレスポンスがまだチャネルに残っていれば、先に処理して退避させておく。
+			if incr.closed {
+				for len(w.in) > 0 {
+					for _, f := range <-w.in {
+						w.process(f)
+					}
+				}
+			}
+			if incr.closed && !w.hasPendingData(incr.id) {
+				incr.result <- nil
+				w.logger.debug("discard window increment on finished stream %d", incr.id)
+				break
+			}
+
 			// 対象のウィンドウサイズを増加させ、
 			// 退避されたDATAフレームの送信を試みる。
 			if _, ok := w.streamsWindow[incr.id]; !ok {
 				w.streamsWindow[incr.id] = w.initWindow
 			}
 
+			// ピアの誤りを隠さないよう、上限を超える加算は適用せずにエラーとする
+			if w.streamsWindow[incr.id]+incr.value > maxWindowSize {
+				incr.result <- newError(flowControlError,
+					"window of stream %d overflowed by increment %d", incr.id, incr.value)
+				break
+			}
+			incr.result <- nil
+
 			w.streamsWindow[incr.id] += incr.value
-			w.logger("incremented window stream=%d, incr=%d",
+			w.logger.debug("incremented window stream=%d, incr=%d",
 				incr.id, incr.value)
 			w.flushPendingData()
 
-		case params := <-w.settings:
+		case change := <-w.settings:
+			params := change.params
 			if value, ok := params[initialWindowSizeSetting]; ok {
 				// 初期ウィンドウサイズの変更を反映し、
 				// 退避されたDATAフレームの送信を試みる。
 				// 増分は新旧の差分である点に注意。
+				// 初期ウィンドウサイズはストリームのものであり、コネクションレベルのウィンドウサイズは変更しない
 				diff := int64(value) - w.initWindow
+				if err := w.checkWindowsDiff(diff); err != nil {
+					change.result <- err
+					break
+				}
 				for k := range w.streamsWindow {
-					w.streamsWindow[k] += diff
+					if k != 0 {
+						w.streamsWindow[k] += diff
+					}
 				}
 				w.initWindow = int64(value)
 				w.flushPendingData()
@@ -149,55 +420,376 @@ func (w *writer) run() {
 				w.maxFrameSize = int(value)
 			}
 
+			change.result <- nil
 			w.sendToPeer(&frame{typ: settingsFrame, flags: ackBit})
+
+		case reply := <-w.inspect:
+			reply <- w.takeSnapshot()
+
+		case <-flushTimeout:
+			flushTimer, flushTimeout = nil, nil
+			w.flush()
+
+		case <-w.paceC:
+			// 帯域幅の制限のトークンが補充されたため、退避されたDATAフレームの送信を試みる
+			w.paceTimer, w.paceC = nil, nil
+			w.flushPendingData()
+
+		case <-sampleTimer.C():
+			w.sampleWindow()
+			sampleTimer.Reset(windowSampleInterval)
+		}
+
+		w.schedulePacing()
+
+		// 後続のフレームが無ければバッファされたフレームを送信する。
+		// 後続のフレームがあるならそれもバッファし、まとめて送信する。
+		// flushDelayが設定されている場合、その間に他のストリームから
+		// 渡されたフレームもまとめるため、送信をタイマーにより遅延させる。
+		if len(w.in) > 0 || (w.buffered.Buffered() == 0 && !w.holding()) {
+			continue
+		}
+
+		if w.flushDelay <= 0 {
+			w.flush()
+		} else if flushTimer == nil {
+			flushTimer = w.clock.NewTimer(w.flushDelay)
+			flushTimeout = flushTimer.C()
+		}
+	}
+}
+
+// バッファされたフレームをピアへ送信する。
+// FrameInterceptorが送信を保留しているフレームがあれば、それも送信する。
+func (w *writer) flush() {
+	if w.peer == nil {
+		return
+	}
+
+	if hi, ok := w.interceptor.(shapingInterceptor); ok {
+		for _, hf := range hi.release() {
+			if err := w.writeRaw(hf); err != nil {
+				w.writeFailed(err)
+				return
+			}
+		}
+	}
+
+	if err := w.buffered.Flush(); err != nil {
+		w.writeFailed(err)
+	}
+}
+
+// 他のコンポーネントから渡されたフレームをピアに送信する
+func (w *writer) process(f *frame) {
+	switch f.typ {
+	case dataFrame:
+		// 接続が閉じられていれば待機させず、単に破棄する
+		if w.peer == nil {
+			break
+		}
+
+		// DATAフレームのフレームサイズに対して
+		// ウィンドウサイズが少ない場合、送信できる分だけを送信し、
+		// 残りを一旦退避させる。同じストリームのDATAフレームが既に
+		// 退避されている場合は、順序を保つためそのまま退避させる。
+		if _, ok := w.streamsWindow[f.streamID]; !ok {
+			w.streamsWindow[f.streamID] = w.initWindow
+		}
+
+		// 退避されたDATAフレームがあれば、このフレーム自体は送信可能であっても
+		// 追い越さないよう後ろに退避させる。ペイロードが空のEND_STREAMフラグのみのDATAフレームや、
+		// 帯域幅の制限のトークンが補充された後のフレームもこれに該当する
+		scope := w.blockedBy(f)
+		if w.hasPendingData(f.streamID) {
+			if scope == "" {
+				scope = "stream"
+			}
+		} else {
+			if scope == "" {
+				break
+			}
+			if f = w.sendAvailable(f); f == nil {
+				return
+			}
+		}
+
+		w.hold(f, scope)
+		return
+
+	case headersFrame, rstStreamFrame:
+		// トレーラーやNO_ERRORのRST_STREAMフレーム等、レスポンスボディの後に送信するフレームは、
+		// 退避されたDATAフレームを全て送信するまで同様に退避させる。
+		// エラーによるRST_STREAMフレームなら、退避されたDATAフレームは送信する意味が無いため破棄する
+		if w.peer == nil || !w.hasPendingData(f.streamID) {
+			break
+		}
+		if f.typ == rstStreamFrame && binary.BigEndian.Uint32(f.payload) != uint32(noError) {
+			w.discardPending(f.streamID)
+			break
+		}
+
+		w.hold(f, "stream")
+		return
+
+	case goAwayFrame:
+		if !f.graceful {
+			binary.BigEndian.PutUint32(f.payload, uint32(w.lastProcessed))
 		}
 	}
 
+	w.sendToPeer(f)
+}
+
+// ウィンドウサイズの回復を待つため、フレーム f を退避させる
+func (w *writer) hold(f *frame, scope string) {
+	w.pendingData = append(w.pendingData, &pendingFrame{
+		frame: f,
+		since: w.clock.Now(),
+		scope: scope,
+	})
+	w.mem.add(len(f.payload))
+	w.countPending()
+}
+
+// ストリーム id の退避されたフレームを送信せずに破棄する
+func (w *writer) discardPending(id streamID) {
+	remain := w.pendingData[:0]
+	for _, data := range w.pendingData {
+		if data.streamID != id {
+			remain = append(remain, data)
+			continue
+		}
+		w.mem.add(-len(data.payload))
+		data.discarded = true
+		data.markWritten()
+	}
+	w.pendingData = remain
+	w.countPending()
 }
 
-// ピアとの接続を1度だけ閉じる
+// ピアとの接続を1度だけ閉じる。
+// バッファされたフレームがあれば閉じる前に送信を試みる。
 func (w *writer) closePeer() {
 	if w.peer == nil {
 		return
 	}
-	w.peer.Close()
+	peer := w.peer
 	w.peer = nil
-	w.logger("close connection")
+
+	w.buffered.Flush()
+	peer.Close()
+	w.cancel()
+	w.logger.debug("close connection")
+
+	// 送信を待機していたDATAフレームはもう送信できないため破棄する
+	for _, data := range w.pendingData {
+		w.mem.add(-len(data.payload))
+		data.discarded = true
+		data.markWritten()
+	}
+	w.pendingData = nil
+	atomic.StoreInt32(&w.pendingFrames, 0)
+}
+
+// 全てのストリームのウィンドウサイズに diff を加算しても上限を超えないか検証する。
+// 超えるストリームがあればFLOW_CONTROL_ERRORのエラーを返す
+func (w *writer) checkWindowsDiff(diff int64) *h2Error {
+	for id, window := range w.streamsWindow {
+		if id != 0 && window+diff > maxWindowSize {
+			return newError(flowControlError,
+				"window of stream %d overflowed by initial window size change %d", id, diff)
+		}
+	}
+	return nil
 }
 
-// 現在のウィンドウサイズを元に、退避されたDATAフレームを可能な限り送信する
+// DATAフレームの送信を妨げているウィンドウを返す。
+// 送信可能なら空文字列を返す。
+func (w *writer) blockedBy(f *frame) string {
+	pLen := int64(len(f.payload))
+	switch {
+	case w.streamsWindow[0] < pLen:
+		return "connection"
+	case w.streamsWindow[f.streamID] < pLen:
+		return "stream"
+	case w.sendRate != nil && w.sendRate.available(w.clock.Now()) < pLen:
+		return "bandwidth"
+	default:
+		return ""
+	}
+}
+
+// 現在のウィンドウサイズを元に、退避されたDATAフレームを可能な限り送信する。
+// 送信できたDATAフレームについては待機していた時間をメトリクスとして通知する。
 func (w *writer) flushPendingData() {
-	remain := make([]*frame, 0, len(w.pendingData))
+	// 優先度の高いストリームから順にウィンドウサイズを割り当てる
+	w.priorityMu.Lock()
+	sortPending(w.pendingData, func(id streamID) priority {
+		if p, ok := w.priorities[id]; ok {
+			return p
+		}
+		return defaultPriority
+	})
+	w.priorityMu.Unlock()
+
+	remain := make([]*pendingFrame, 0, len(w.pendingData))
+
+	// 同じストリームの後続のフレームが先に送信されないよう、
+	// 送信しきれなかったストリームを記録しておく
+	blocked := make(map[streamID]bool)
+
+	// ストリームを閉じるフレームを送信したストリーム。送信後にウィンドウサイズを破棄する
+	var finished []streamID
 
 	for _, data := range w.pendingData {
-		dataLen := int64(len(data.payload))
-		if w.streamsWindow[0] < dataLen ||
-			w.streamsWindow[data.streamID] < dataLen {
+		if blocked[data.streamID] {
 			remain = append(remain, data)
 			continue
 		}
 
-		w.sendToPeer(data)
+		// DATAフレームの後に退避されたフレームはフロー制御の対象外であり、そのまま送信する
+		before := len(data.payload)
+		if data.typ != dataFrame {
+			w.sendToPeer(data.frame)
+			w.mem.add(-before)
+			if data.isStreamCloser() {
+				finished = append(finished, data.streamID)
+			}
+			continue
+		}
+
+		rest := w.sendAvailable(data.frame)
+		if rest != nil {
+			w.mem.add(len(rest.payload) - before)
+			remain = append(remain, data)
+			blocked[data.streamID] = true
+			continue
+		}
+
+		w.metrics.Observe("h2s_flow_control_stall_seconds",
+			w.clock.Now().Sub(data.since).Seconds(), Labels{"scope": data.scope})
+		w.mem.add(-before)
+		if data.isStreamCloser() {
+			finished = append(finished, data.streamID)
+		}
 	}
 
 	w.pendingData = remain
+	for _, id := range finished {
+		w.forgetWindow(id)
+	}
+	w.countPending()
+}
+
+// 帯域幅の不足により退避されたDATAフレームを送信できない場合に、
+// 1フレーム分のトークンが補充される時刻にタイマーを設定する。
+// ウィンドウサイズの不足による待機はWINDOW_UPDATEフレームの受信により解消されるため、
+// タイマーは設定しない。
+func (w *writer) schedulePacing() {
+	if w.sendRate == nil || w.paceTimer != nil || len(w.pendingData) == 0 {
+		return
+	}
+
+	need := int64(w.maxFrameSize)
+	for _, data := range w.pendingData {
+		if n := int64(len(data.payload)); n < need {
+			need = n
+		}
+	}
+
+	if w.sendRate.available(w.clock.Now()) >= need {
+		return
+	}
+	w.paceTimer = w.clock.NewTimer(w.sendRate.delay(need))
+	w.paceC = w.paceTimer.C()
+}
+
+// 指定IDのストリームのフレームが退避されていれば真を返す
+func (w *writer) hasPendingData(id streamID) bool {
+	for _, data := range w.pendingData {
+		if data.streamID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ウィンドウサイズが許す範囲でDATAフレームを送信する。
+// 全て送信できなければ、送信できなかった残りのペイロードを持つフレームを返す。
+// ペイロードが空のDATAフレームはフロー制御の対象外であるため常に送信する。
+func (w *writer) sendAvailable(f *frame) *frame {
+	avail := w.streamsWindow[0]
+	if window := w.streamsWindow[f.streamID]; window < avail {
+		avail = window
+	}
+	if w.sendRate != nil {
+		if tokens := w.sendRate.available(w.clock.Now()); tokens < avail {
+			avail = tokens
+		}
+	}
+
+	if len(f.payload) == 0 || avail >= int64(len(f.payload)) {
+		w.sendToPeer(f)
+		return nil
+	}
+
+	if avail > 0 {
+		w.sendToPeer(&frame{
+			typ:      dataFrame,
+			streamID: f.streamID,
+			payload:  f.payload[:avail],
+		})
+		f.payload = f.payload[avail:]
+	}
+
+	return f
+}
+
+// 退避されたフレームの数を、Server.ConnStatsのために他のゴルーチンから参照できるよう記録する
+func (w *writer) countPending() {
+	atomic.StoreInt32(&w.pendingFrames, int32(len(w.pendingData)))
+}
+
+// コネクションレベルのウィンドウサイズと、退避されたフレームの数をメトリクスとして通知する。
+// コネクション毎の系列を生じさせないよう、ラベルではなく観測値の分布として通知する。
+// 送信量に比例して観測値が偏らないよう、フレームの送信毎ではなくwindowSampleInterval毎に通知するため、
+// 1つの観測値は、ある時点での1つのコネクションの状態を表す。
+func (w *writer) sampleWindow() {
+	w.metrics.Observe("h2s_flow_control_window_bytes",
+		float64(w.streamsWindow[0]), Labels{"scope": "connection"})
+	w.metrics.Observe("h2s_flow_control_pending_frames",
+		float64(len(w.pendingData)), nil)
 }
 
 // ピアにフレームを送信する
 func (w *writer) sendToPeer(f *frame) {
+	defer f.markWritten()
+
 	// ストリームの処理が終了している場合最終処理済みストリームIDを更新
-	if f.isStreamCloser() && f.streamID > w.lastProcessed {
-		w.lastProcessed = f.streamID
+	if f.isStreamCloser() {
+		if f.streamID > w.lastProcessed {
+			w.lastProcessed = f.streamID
+		}
+		w.forgetPriority(f.streamID)
 	}
 
 	if w.peer == nil {
+		f.discarded = true
 		return
 	}
 
+	// コネクションのエラーとしては、デバッグデータを置き換える前の本来の内容を記録する
+	var goAway *ConnectionError
+	if f.typ == goAwayFrame {
+		goAway = decodeGoAway(f.payload)
+		w.replaceDebugData(f, goAway)
+	}
+
 L:
 	for _, f := range w.splitFrame(f) {
-		if err := f.encodeTo(w.peer); err != nil {
-			w.closePeer()
+		if err := w.writeFrame(f); err != nil {
+			w.writeFailed(err)
 			return
 		}
 
@@ -208,18 +800,114 @@ L:
 			pLen := int64(len(f.payload))
 			w.streamsWindow[0] -= pLen
 			w.streamsWindow[f.streamID] -= pLen
+			if w.sendRate != nil {
+				w.sendRate.consume(pLen)
+			}
 
 		case goAwayFrame:
-			w.logger("send GOAWAY. msg=%s", string(f.payload[8:]))
-			w.closePeer()
-			break L
+			w.logger.debug("send GOAWAY. msg=%s", string(f.payload[8:]))
+			if !f.graceful {
+				w.recordGoAway(goAway)
+				w.closePeer()
+				break L
+			}
 		}
 	}
+
+	if f.isStreamCloser() {
+		w.forgetWindow(f.streamID)
+	}
+}
+
+// ストリームを閉じるフレームを送信した後、そのストリームのフレームが退避されていなければ、
+// 以降参照しないストリームのウィンドウサイズを破棄する。
+// 残しておくと、初期ウィンドウサイズの変更時に閉じたストリームのウィンドウサイズまで検証してしまう。
+// 退避されたフレームを送信している間は、flushPendingDataメソッドが送信後に改めて呼び出す。
+// 破棄する際にストリームレベルのウィンドウサイズをメトリクスとして通知するため、
+// 1つの観測値は、DATAフレームを送信した1つのストリームの終了時点でのウィンドウサイズを表す。
+func (w *writer) forgetWindow(id streamID) {
+	if w.hasPendingData(id) {
+		return
+	}
+	if window, ok := w.streamsWindow[id]; ok {
+		w.metrics.Observe("h2s_flow_control_window_bytes",
+			float64(window), Labels{"scope": "stream"})
+		delete(w.streamsWindow, id)
+	}
+}
+
+// Server.GoAwayDebugDataが設定されていれば、GOAWAYフレーム f のデバッグデータを置き換える。
+// 本来の内容 goAway と置き換えた内容はログに出力し、突き合わせられるようにする。
+func (w *writer) replaceDebugData(f *frame, goAway *ConnectionError) {
+	if w.goAwayDebug == nil {
+		return
+	}
+
+	debug := w.goAwayDebug(goAway.Code, goAway.Reason)
+	if debug == goAway.Reason {
+		return
+	}
+	f.payload = append(f.payload[:8:8], debug...)
+	w.logger.info("send GOAWAY(code=%s) with debug data %q for %q", goAway.Code, debug, goAway.Reason)
+}
+
+// フレームをバッファに書き出す。
+// FrameInterceptorが設定されていれば、それが返したフレームを代わりに書き出す。
+func (w *writer) writeFrame(f *frame) error {
+	if w.interceptor == nil {
+		if w.observe != nil {
+			w.observe(FrameHeader{
+				Type:     h2frame.Type(f.typ),
+				Flags:    h2frame.Flags(f.flags),
+				StreamID: uint32(f.streamID),
+				Length:   len(f.payload),
+			})
+		}
+		if w.tracer != nil {
+			w.tracer.trace(f.export())
+		}
+		return f.writeTo(w.framer)
+	}
+
+	for _, hf := range w.interceptor.InterceptWrite(f.export()) {
+		if err := w.writeRaw(hf); err != nil {
+			return err
+		}
+	}
+
+	// 破棄されたDATAフレームの分はピアからWINDOW_UPDATEフレームが届かないため、ここで戻す。
+	// 破棄されるのは与えたフレームのみであるため、そのストリームのウィンドウサイズも戻す。
+	if si, ok := w.interceptor.(shapingInterceptor); ok {
+		if n := int64(si.discarded()); n > 0 {
+			w.streamsWindow[0] += n
+			w.streamsWindow[f.streamID] += n
+		}
+	}
+	return nil
+}
+
+// FrameInterceptorが返したフレームをバッファに書き出す
+func (w *writer) writeRaw(hf *h2frame.Frame) error {
+	if w.observe != nil {
+		w.observe(headerOf(hf))
+	}
+	w.tracer.trace(hf)
+	return w.framer.WriteRawFrame(hf.Type, hf.Flags, hf.StreamID, hf.Payload)
+}
+
+// FrameInterceptorが送信を保留しているフレームがあれば真を返す
+func (w *writer) holding() bool {
+	hi, ok := w.interceptor.(shapingInterceptor)
+	return ok && hi.holding()
 }
 
 // ペイロード長が最大フレームサイズを超過する場合に、
 // 等価な複数のフレームに分割する。
 func (w *writer) splitFrame(f *frame) []*frame {
+	if f.typ == dataFrame && w.adaptiveData {
+		return w.splitDataAdaptively(f)
+	}
+
 	// DATA、HEADERSフレームでないか、最大フレームサイズ以下の
 	// ペイロードなら何もしなくて良い。
 	if (f.typ != dataFrame && f.typ != headersFrame) ||
@@ -227,7 +915,50 @@ func (w *writer) splitFrame(f *frame) []*frame {
 		return []*frame{f}
 	}
 
-	payloads := splitPayload(f.payload, w.maxFrameSize)
+	return w.buildSplitFrames(f, splitPayload(f.payload, w.maxFrameSize))
+}
+
+// DATAフレームをストリーム毎に適応的なサイズで分割する。
+// ストリームの最初のDATAフレームは小さなサイズで送信し、以降送信する度に
+// サイズを倍加させて最大フレームサイズに近づける。
+// これにより、少量のレスポンスを返すストリームは小さなフレームで素早く送信され、
+// 大量のレスポンスを返すストリームは最大フレームサイズで効率よく送信される。
+func (w *writer) splitDataAdaptively(f *frame) []*frame {
+	size, ok := w.dataFrameSize[f.streamID]
+	if !ok {
+		size = initialDataFrameSize
+	}
+
+	var payloads [][]byte
+	for p := f.payload; len(p) > 0; {
+		if size > w.maxFrameSize {
+			size = w.maxFrameSize
+		}
+
+		n := size
+		if n > len(p) {
+			n = len(p)
+		}
+
+		payloads = append(payloads, p[:n])
+		p = p[n:]
+		size *= 2
+	}
+
+	if f.flags.eos() {
+		delete(w.dataFrameSize, f.streamID)
+	} else {
+		w.dataFrameSize[f.streamID] = size
+	}
+
+	if len(payloads) <= 1 {
+		return []*frame{f}
+	}
+	return w.buildSplitFrames(f, payloads)
+}
+
+// 分割したペイロードからフレームを生成する
+func (w *writer) buildSplitFrames(f *frame, payloads [][]byte) []*frame {
 	frames := make([]*frame, 0, len(payloads))
 
 	// HEADERSフレームの場合CONTINUATIONフレームで分割する
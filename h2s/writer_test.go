@@ -0,0 +1,101 @@
+package h2s
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+// 送信したフレームを peer に書き出すwriterを生成する。
+// ストリーム1のウィンドウサイズを window とし、runメソッドは起動しない
+func newTestWriter(window int64) (*writer, *bufferCloser) {
+	sv := NewServer(tls.Certificate{})
+	sv.init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	peer := &bufferCloser{}
+	w := newWriter(ctx, cancel, sv, sv.newLogger("test"), peer, "test")
+	w.streamsWindow[0] = w.initWindow
+	w.streamsWindow[1] = window
+	return w, peer
+}
+
+// 退避されたDATAフレームがあるストリームの後続のフレームは、
+// それ自体が送信可能であっても退避されたフレームを追い越さないこと
+func TestWriterKeepsStreamOrder(t *testing.T) {
+	w, peer := newTestWriter(0)
+
+	w.process(&frame{typ: dataFrame, streamID: 1, payload: []byte("hello")})
+	w.process(&frame{typ: dataFrame, streamID: 1, flags: eosBit})
+	w.flush()
+
+	if peer.Len() != 0 {
+		t.Fatalf("%d bytes were sent before the window was opened", peer.Len())
+	}
+	if len(w.pendingData) != 2 {
+		t.Fatalf("%d frames are pending, want 2", len(w.pendingData))
+	}
+
+	w.streamsWindow[1] = 5
+	w.flushPendingData()
+	w.flush()
+
+	if len(w.pendingData) != 0 {
+		t.Errorf("%d frames are still pending", len(w.pendingData))
+	}
+
+	fr := h2frame.NewFramer(nil, peer)
+	for i, want := range []string{"hello", ""} {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(f.Payload) != want || f.Flags.Has(h2frame.FlagEndStream) != (i == 1) {
+			t.Errorf("frame %d is %q(flags=%d), want %q", i, f.Payload, f.Flags, want)
+		}
+	}
+}
+
+// 観測値を記録するMetrics
+type recordingMetrics struct {
+	nopMetrics
+	observed map[string][]float64
+}
+
+func (m *recordingMetrics) Observe(name string, value float64, labels Labels) {
+	if m.observed == nil {
+		m.observed = make(map[string][]float64)
+	}
+	key := name
+	if scope, ok := labels["scope"]; ok {
+		key += "/" + scope
+	}
+	m.observed[key] = append(m.observed[key], value)
+}
+
+// ストリームレベルのウィンドウサイズは、DATAフレームの数に依らずストリームの終了時に1度だけ通知されること
+func TestWriterSamplesStreamWindowOnce(t *testing.T) {
+	w, _ := newTestWriter(100)
+	m := &recordingMetrics{}
+	w.metrics = m
+
+	w.process(&frame{typ: dataFrame, streamID: 1, payload: []byte("hello")})
+	w.process(&frame{typ: dataFrame, streamID: 1, payload: []byte("world")})
+	w.process(&frame{typ: dataFrame, streamID: 1, flags: eosBit})
+
+	got := m.observed["h2s_flow_control_window_bytes/stream"]
+	if len(got) != 1 || got[0] != 90 {
+		t.Errorf("stream windows observed are %v, want [90]", got)
+	}
+	if _, ok := w.streamsWindow[1]; ok {
+		t.Error("window of the finished stream is retained")
+	}
+}
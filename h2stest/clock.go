@@ -0,0 +1,134 @@
+package h2stest
+
+import (
+	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Advanceメソッドにより明示的に時刻を進めるh2s.Clockの実装。
+	// Server.Config.Clockに設定すると、タイムアウト等の時間に基づく処理を
+	// 実際に待機せず、決定的な順序でテストできる。
+	//
+	//	clock := h2stest.NewFakeClock(time.Unix(0, 0))
+	//	s := h2stest.NewUnstartedServer(handler)
+	//	s.Config.Clock = clock
+	//	s.Config.IdleTimeout = time.Minute
+	//	s.Start()
+	//	...
+	//	clock.Advance(time.Minute) // アイドル状態のコネクションが閉じられる
+	FakeClock struct {
+		mu     sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	fakeTimer struct {
+		clock *FakeClock
+		when  time.Time
+		c     chan time.Time
+		f     func()
+	}
+)
+
+var _ h2s.Clock = (*FakeClock)(nil)
+
+// 現在時刻を now としたFakeClockを生成する
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) h2s.Timer {
+	return c.addTimer(d, make(chan time.Time, 1), nil)
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) h2s.Timer {
+	return c.addTimer(d, nil, f)
+}
+
+// 時刻を d だけ進め、その間に発火するタイマーを発火時刻の順に発火させる。
+// AfterFuncにより生成したタイマーの関数は、time.AfterFuncと同様に別のゴルーチンで呼び出す。
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+
+	var fired []*fakeTimer
+	remain := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			remain = append(remain, t)
+		} else {
+			fired = append(fired, t)
+		}
+	}
+	c.timers = remain
+	c.mu.Unlock()
+
+	sort.SliceStable(fired, func(i, j int) bool {
+		return fired[i].when.Before(fired[j].when)
+	})
+	for _, t := range fired {
+		if t.f != nil {
+			go t.f()
+		} else {
+			t.c <- t.when
+		}
+	}
+}
+
+// 発火していないタイマーの数を返す。
+// 他のゴルーチンがタイマーを設定し終えたことを確認してから時刻を進めるために用いる。
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (c *FakeClock) addTimer(d time.Duration, ch chan time.Time, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: ch, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// タイマーが未発火であれば取り除き、真を返す
+func (c *FakeClock) removeTimer(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.removeTimer(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.clock.removeTimer(t)
+
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.when = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
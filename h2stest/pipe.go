@@ -0,0 +1,171 @@
+package h2stest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// 一方向のバイト列を保持するバッファ。
+	// net.Pipeとは異なり書き込みは読み込みを待たずに完了するため、
+	// 双方が同時に書き込みを行ってもデッドロックしない。
+	pipeBuffer struct {
+		mu     sync.Mutex
+		cond   *sync.Cond
+		buf    bytes.Buffer
+		closed bool
+	}
+
+	// メモリ上で完結するnet.Connの実装
+	memConn struct {
+		r, w   *pipeBuffer
+		local  memAddr
+		remote memAddr
+	}
+
+	memAddr string
+
+	// メモリ上で完結するnet.Listenerの実装。
+	// dialメソッドにより生成した接続の一端をAcceptメソッドにより返す。
+	memListener struct {
+		mu     sync.Mutex
+		conns  []*memConn // Closeメソッドで閉じるための、生成した全ての接続
+		dialed int
+
+		accept chan net.Conn
+		closed chan struct{}
+		once   sync.Once
+	}
+)
+
+var errListenerClosed = errors.New("h2stest: listener closed")
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	b.cond.Broadcast()
+	return b.buf.Write(p)
+}
+
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.r.read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return c.w.write(p) }
+
+// 双方向とも閉じる。以降は自身、相手ともに読み込みはEOFとなる。
+func (c *memConn) Close() error {
+	c.r.close()
+	c.w.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// タイムアウトは扱わない
+func (c *memConn) SetDeadline(time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (a memAddr) Network() string { return "h2stest" }
+func (a memAddr) String() string  { return string(a) }
+
+func newMemListener() *memListener {
+	return &memListener{
+		accept: make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+// リスナーを閉じ、これまでに生成した全ての接続も閉じる
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr("h2stest")
+}
+
+// 接続を生成し、その一端をAcceptメソッドに渡し、もう一端を返す
+func (l *memListener) dial() (net.Conn, error) {
+	l.mu.Lock()
+	l.dialed++
+	client := memAddr("h2stest-client:" + strconv.Itoa(l.dialed))
+	l.mu.Unlock()
+
+	up, down := newPipeBuffer(), newPipeBuffer()
+	serverConn := &memConn{r: up, w: down, local: "h2stest", remote: client}
+	clientConn := &memConn{r: down, w: up, local: client, remote: "h2stest"}
+
+	select {
+	case l.accept <- serverConn:
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+
+	// Acceptされた後にリスナーが閉じられていれば、接続もすぐに閉じる
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+		serverConn.Close()
+		return nil, errListenerClosed
+	default:
+	}
+
+	l.conns = append(l.conns, serverConn, clientConn)
+	return clientConn, nil
+}
@@ -0,0 +1,115 @@
+package h2stest
+
+import (
+	"errors"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"io"
+	"time"
+)
+
+// Replayメソッドがサーバーの処理の完了を確認するために送信するPINGフレームのペイロード
+var (
+	replayDispatched = [8]byte{'r', 'e', 'p', 'l', 'a', 'y', '-', '1'}
+	replayFinished   = [8]byte{'r', 'e', 'p', 'l', 'a', 'y', '-', '2'}
+)
+
+// h2s.Server.CaptureDirにより記録した受信側のバイト列(.recv)を、新たなコネクションから
+// そのまま送信し、それに対してサーバーが送信したフレームを順に返す。
+// クライアントとの相互運用性の問題を、決定的な回帰テストとして再現するために用いる。
+//
+// 記録の全てを送信した後、サーバーがそれらを処理し、起動した全てのリクエストハンドラーが
+// 終了してレスポンスを送信し終えるまで待ってからコネクションを閉じる。
+// 記録がリクエストボディの途中で終わっている等、終了しないリクエストハンドラーがあれば処理を返さない。
+// サーバーが先にコネクションを閉じた場合は、それまでに送信されたフレームを返す。
+// 完了の確認のために送信するPINGフレームへのACKは、返すフレームに含めない。
+// Startメソッドの呼び出し後に用いること。
+func (s *Server) Replay(capture io.Reader) ([]*h2frame.Frame, error) {
+	conn, err := s.listener.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var frames []*h2frame.Frame
+	var readErr error
+	acks := make(chan [8]byte, 2)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		framer := h2frame.NewFramer(nil, conn)
+		framer.SetMaxReadFrameSize(h2frame.MaxAllowedFrameSize)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+
+			if f.Type == h2frame.TypePing && f.Flags.Has(h2frame.FlagAck) && len(f.Payload) == 8 {
+				var payload [8]byte
+				copy(payload[:], f.Payload)
+				if payload == replayDispatched || payload == replayFinished {
+					acks <- payload
+					continue
+				}
+			}
+
+			f.Payload = append([]byte(nil), f.Payload...)
+			frames = append(frames, f)
+		}
+	}()
+
+	// PINGフレームを送信し、そのACKを受信するまで待つ。
+	// サーバーはフレームを受信した順に処理するため、ACKを受信した時点でそれ以前のフレームは処理済みとなる。
+	// また、レスポンスのフレームとACKは同じ順序で送信されるため、それまでに送信を指示したフレームも受信済みとなる。
+	ping := func(payload [8]byte) bool {
+		if err := h2frame.NewFramer(conn, nil).WritePing(false, payload); err != nil {
+			return false
+		}
+		select {
+		case <-acks:
+			return true
+		case <-closed:
+			return false
+		}
+	}
+
+	if _, err := io.Copy(conn, capture); err != nil {
+		return nil, err
+	}
+	if ping(replayDispatched) && s.waitHandlers(conn.LocalAddr().String(), closed) {
+		ping(replayFinished)
+	}
+
+	conn.Close()
+	<-closed
+	if readErr != nil && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+		return frames, readErr
+	}
+	return frames, nil
+}
+
+// リモートアドレスが remote のコネクションで、実行中のリクエストハンドラーが無くなるまで待つ。
+// その前にコネクションが閉じられれば偽を返す。
+func (s *Server) waitHandlers(remote string, closed <-chan struct{}) bool {
+	for {
+		running := -1
+		for _, stats := range s.Config.ConnStats() {
+			if stats.RemoteAddr == remote {
+				running = stats.RunningHandlers
+			}
+		}
+		if running <= 0 {
+			return running == 0
+		}
+
+		select {
+		case <-time.After(time.Millisecond):
+		case <-closed:
+			return false
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package h2stest_test
+
+import (
+	"bytes"
+	"github.com/murakmii/c99-minimal-h2s/h2frame"
+	"github.com/murakmii/c99-minimal-h2s/h2stest"
+	"github.com/murakmii/c99-minimal-h2s/hpack"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// GET / のリクエストヘッダーのヘッダーブロック
+var getRequestBlock = hpack.EncodeHeaderList(hpack.HeaderList{
+	hpack.NewHeaderField(":method", "GET"),
+	hpack.NewHeaderField(":scheme", "https"),
+	hpack.NewHeaderField(":authority", "h2stest.invalid"),
+	hpack.NewHeaderField(":path", "/"),
+})
+
+// END_HEADERSフラグの無いCONTINUATIONフレームを送り続けるクライアントは、
+// ヘッダーブロックの受信を終える前にENHANCE_YOUR_CALMにより切断されること
+func TestContinuationFlood(t *testing.T) {
+	s := h2stest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(h2frame.ClientPreface)
+	fr := h2frame.NewFramer(&capture, nil)
+	fr.WriteSettings()
+	fr.WriteHeaders(1, true, false, getRequestBlock)
+	chunk := make([]byte, h2frame.DefaultMaxFrameSize)
+	for i := 0; i < 128; i++ {
+		fr.WriteContinuation(1, false, chunk)
+	}
+
+	frames, err := s.Replay(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := frames[len(frames)-1]
+	_, code, _, err := last.GoAway()
+	if last.Type != h2frame.TypeGoAway || err != nil {
+		t.Fatalf("last frame is %v, want GOAWAY", last.Type)
+	}
+	if code != h2frame.ErrCodeEnhanceYourCalm {
+		t.Errorf("GOAWAY code is %v, want ENHANCE_YOUR_CALM", code)
+	}
+}
+
+// 初期ウィンドウサイズを0とし、ストリーム毎にWINDOW_UPDATEフレームで送信を許可するクライアントにも
+// レスポンスボディが届くこと
+func TestWindowUpdateBeforeResponse(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer s.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(h2frame.ClientPreface)
+	fr := h2frame.NewFramer(&capture, nil)
+	fr.WriteSettings(h2frame.Setting{ID: h2frame.SettingInitialWindowSize, Val: 0})
+	fr.WriteHeaders(1, true, true, getRequestBlock)
+	fr.WriteWindowUpdate(1, 1024)
+
+	frames, err := s.Replay(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	for _, f := range frames {
+		if f.Type == h2frame.TypeData && f.StreamID == 1 {
+			body = append(body, f.Payload...)
+		}
+	}
+	if string(body) != "hello" {
+		t.Errorf("body is %q, want %q", body, "hello")
+	}
+}
+
+// SETTINGS_INITIAL_WINDOW_SIZEの変更によりストリームのウィンドウサイズが上限を超える場合、
+// FLOW_CONTROL_ERRORにより切断されること
+func TestInitialWindowSizeOverflow(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+
+		// 切断されなければ、ウィンドウサイズの超過が検出されなかったとしてテストを失敗させる
+		select {
+		case <-r.Context().Done():
+		case <-time.After(testTimeout):
+		}
+	}))
+	defer s.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(h2frame.ClientPreface)
+	fr := h2frame.NewFramer(&capture, nil)
+	fr.WriteSettings(h2frame.Setting{ID: h2frame.SettingInitialWindowSize, Val: 0})
+	fr.WriteHeaders(1, true, true, getRequestBlock)
+	fr.WriteWindowUpdate(1, 1<<31-1)
+	fr.WriteSettings(h2frame.Setting{ID: h2frame.SettingInitialWindowSize, Val: 2})
+
+	frames, err := s.Replay(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := frames[len(frames)-1]
+	_, code, _, err := last.GoAway()
+	if last.Type != h2frame.TypeGoAway || err != nil {
+		t.Fatalf("last frame is %v, want GOAWAY", last.Type)
+	}
+	if code != h2frame.ErrCodeFlowControl {
+		t.Errorf("GOAWAY code is %v, want FLOW_CONTROL_ERROR", code)
+	}
+}
+
+// サーバーが早期のレスポンスによりストリームを閉じた後に届いたトレーラーは単に破棄され、
+// 同じコネクションの後続のリクエストには影響しないこと
+func TestTrailersAfterEarlyResponse(t *testing.T) {
+	s := h2stest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s.Config.Limits.MaxBodyBytes = 4
+	s.Start()
+	defer s.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(h2frame.ClientPreface)
+	fr := h2frame.NewFramer(&capture, nil)
+	fr.WriteSettings()
+	fr.WriteHeaders(1, false, true, getRequestBlock)
+	fr.WriteData(1, false, []byte("too large body"))
+	fr.WriteHeaders(1, true, true, hpack.EncodeHeaderList(hpack.HeaderList{
+		hpack.NewHeaderField("x-checksum", "abc"),
+	}))
+	fr.WriteHeaders(3, true, true, getRequestBlock)
+
+	frames, err := s.Replay(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	for _, f := range frames {
+		if f.Type == h2frame.TypeGoAway {
+			_, code, debug, _ := f.GoAway()
+			t.Fatalf("received GOAWAY with %v: %s", code, debug)
+		}
+		if f.Type == h2frame.TypeRSTStream && f.StreamID == 1 {
+			if code, _ := f.RSTStreamCode(); code != h2frame.ErrCodeNo {
+				t.Errorf("stream 1 reset with %v, want NO_ERROR", code)
+			}
+		}
+		if f.Type == h2frame.TypeData && f.StreamID == 3 {
+			body = append(body, f.Payload...)
+		}
+	}
+	if string(body) != "ok" {
+		t.Errorf("body of stream 3 is %q, want %q", body, "ok")
+	}
+}
+
+// ペイロード長に誤りのあるPRIORITYフレームを受信すると、FRAME_SIZE_ERRORによりストリームがリセットされ、
+// リクエストのコンテキストが終了すること
+func TestInvalidPriorityLength(t *testing.T) {
+	canceled := make(chan bool, 1)
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(testTimeout):
+			canceled <- false
+		}
+	}))
+	defer s.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(h2frame.ClientPreface)
+	fr := h2frame.NewFramer(&capture, nil)
+	fr.WriteSettings()
+	fr.WriteHeaders(1, true, true, getRequestBlock)
+	fr.WriteRawFrame(h2frame.TypePriority, 0, 1, make([]byte, 4))
+
+	frames, err := s.Replay(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !<-canceled {
+		t.Error("request context was not canceled")
+	}
+	for _, f := range frames {
+		if f.Type == h2frame.TypeRSTStream && f.StreamID == 1 {
+			if code, _ := f.RSTStreamCode(); code != h2frame.ErrCodeFrameSize {
+				t.Errorf("stream 1 reset with %v, want FRAME_SIZE_ERROR", code)
+			}
+			return
+		}
+	}
+	t.Error("stream 1 was not reset")
+}
@@ -0,0 +1,97 @@
+// net/http/httptestに相当する、HTTP/2のエンドツーエンドのテストのためのパッケージ。
+// サーバーとクライアントはメモリ上の接続により通信するため、
+// ソケットの使用や証明書の準備をせずにリクエストハンドラーをテストできる。
+// 接続はTLSを用いず、最初からHTTP/2を用いる。
+package h2stest
+
+import (
+	"crypto/tls"
+	"github.com/murakmii/c99-minimal-h2s/h2client"
+	"github.com/murakmii/c99-minimal-h2s/h2s"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// テスト用のHTTP/2サーバーを表す構造体
+type Server struct {
+	// リクエストの送信先のURL。ホスト名に意味は無く、
+	// Clientメソッドが返すクライアントは常にこのサーバーに接続する。
+	URL string
+
+	// サーバーの実体。NewUnstartedServer関数による生成後、
+	// Startメソッドの呼び出し前であれば各種オプションを設定できる。
+	Config *h2s.Server
+
+	handler   http.Handler
+	listener  *memListener
+	transport *h2client.Transport
+	client    *http.Client
+	wg        sync.WaitGroup
+}
+
+// リクエストハンドラーを指定してサーバーを生成し、開始する
+func NewServer(handler http.Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// リクエストハンドラーを指定してサーバーを生成する。
+// 開始するにはStartメソッドを呼び出す。
+func NewUnstartedServer(handler http.Handler) *Server {
+	s := &Server{
+		URL:      "https://h2stest.invalid",
+		Config:   h2s.NewServer(tls.Certificate{}),
+		handler:  handler,
+		listener: newMemListener(),
+	}
+
+	s.transport = &h2client.Transport{
+		DialConn: func(string) (net.Conn, error) { return s.listener.dial() },
+	}
+	s.client = &http.Client{Transport: s.transport}
+	return s
+}
+
+// 接続の受け入れを開始する
+func (s *Server) Start() {
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.Config.ServeConn(conn, s.handler)
+			}()
+		}
+	}()
+}
+
+// サーバーに接続するよう設定されたクライアントを返す
+func (s *Server) Client() *http.Client {
+	return s.client
+}
+
+// サーバーとの新たなコネクションを確立する。
+// Clientメソッドが返すクライアントとは独立したコネクションであり、
+// ストリームのキャンセル等、コネクション単位の振る舞いをテストするために用いる。
+func (s *Server) Dial() (*h2client.Conn, error) {
+	conn, err := s.listener.dial()
+	if err != nil {
+		return nil, err
+	}
+	return h2client.NewConn(conn)
+}
+
+// 全ての接続を閉じ、サーバーを終了する。
+// 実行中のリクエストハンドラーがあれば、それらが終了するまで待つ。
+func (s *Server) Close() {
+	s.transport.CloseIdleConnections()
+	s.listener.Close()
+	s.wg.Wait()
+}
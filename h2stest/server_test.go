@@ -0,0 +1,312 @@
+package h2stest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/murakmii/c99-minimal-h2s/h2client"
+	"github.com/murakmii/c99-minimal-h2s/h2stest"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 応答が無い場合にテストを失敗させるまでの時間
+const testTimeout = 10 * time.Second
+
+// サーバーにリクエストを送信し、レスポンスとそのボディを返す
+func get(t *testing.T, s *h2stest.Server, path string) (*http.Response, []byte) {
+	t.Helper()
+
+	res, body, err := fetch(s, path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return res, body
+}
+
+// テストのゴルーチン以外からも呼び出せるよう、失敗をエラーとして返すget
+func fetch(s *h2stest.Server, path string) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := s.Client().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	return res, body, err
+}
+
+// リクエストのメソッド、パス、ヘッダー、ボディがリクエストハンドラーに渡り、
+// そのレスポンスがクライアントに届くこと
+func TestRoundTrip(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Echo", r.Header.Get("X-Echo"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer s.Close()
+
+	// 初期ウィンドウサイズを超えるリクエストボディも、サーバーのWINDOW_UPDATEフレームにより全て届く
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/echo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Echo", "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	res, err := s.Client().Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("status is %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("protocol is %s, want HTTP/2.0", res.Proto)
+	}
+	for name, want := range map[string]string{"X-Method": "POST", "X-Path": "/echo", "X-Echo": "hello"} {
+		if got := res.Header.Get(name); got != want {
+			t.Errorf("%s is %q, want %q", name, got, want)
+		}
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("received %d bytes, want %d bytes", len(body), len(payload))
+	}
+}
+
+// レスポンスヘッダーで宣言したトレーラーと、http.TrailerPrefixによるトレーラーが届くこと
+func TestTrailers(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "def")
+	}))
+	defer s.Close()
+
+	res, body := get(t, s, "/")
+	if string(body) != "body" {
+		t.Errorf("body is %q, want %q", body, "body")
+	}
+	for name, want := range map[string]string{"X-Checksum": "abc", "X-Undeclared": "def"} {
+		if got := res.Trailer.Get(name); got != want {
+			t.Errorf("trailer %s is %q, want %q", name, got, want)
+		}
+	}
+}
+
+// ウィンドウサイズを超えるレスポンスボディの後にも、全てのボディを送信してからトレーラーが届くこと
+func TestTrailersAfterLargeBody(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 200000)
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write(payload)
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer s.Close()
+
+	res, body := get(t, s, "/")
+	if !bytes.Equal(body, payload) {
+		t.Errorf("received %d bytes, want %d bytes", len(body), len(payload))
+	}
+	if got := res.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer X-Checksum is %q, want %q", got, "abc")
+	}
+}
+
+// リクエストハンドラーの中断によりストリームがリセットされ、
+// 同じコネクションの後続のリクエストには影響しないこと
+func TestServerReset(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	_, _, err := fetch(s, "/abort")
+	var se *h2client.StreamError
+	if !errors.As(err, &se) {
+		t.Fatalf("error is %v, want stream reset", err)
+	}
+
+	if _, body := get(t, s, "/"); string(body) != "ok" {
+		t.Errorf("body is %q, want %q", body, "ok")
+	}
+}
+
+// クライアントがストリームをリセットすると、リクエストのコンテキストが終了すること
+func TestClientReset(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer s.Close()
+
+	conn, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.RoundTrip(req)
+		errc <- err
+	}()
+
+	<-started
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("error is %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(testTimeout):
+		t.Fatal("request context was not canceled by RST_STREAM")
+	}
+}
+
+// 初期ウィンドウサイズを超えるレスポンスボディも、
+// クライアントのWINDOW_UPDATEフレームにより全て送信されること
+func TestLargeResponse(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}))
+	defer s.Close()
+
+	for _, size := range []int{65535, 65536, 70000, 1 << 20} {
+		_, body := get(t, s, "/?size="+strconv.Itoa(size))
+		if len(body) != size {
+			t.Errorf("size=%d: received %d bytes", size, len(body))
+		}
+	}
+}
+
+// 初期ウィンドウサイズを超えるレスポンスを並行して返せること
+func TestConcurrentLargeResponses(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 70000)
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, body, err := fetch(s, "/"); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(body, payload) {
+				t.Errorf("received %d bytes", len(body))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// HEADリクエストのレスポンスのContentLengthは、content-lengthヘッダーの値となること
+func TestHeadContentLength(t *testing.T) {
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.ContentLength != 100 {
+		t.Errorf("ContentLength is %d, want 100", res.ContentLength)
+	}
+}
+
+// サーバーの終了を通知するGOAWAYフレームを受信しても、処理中のリクエストのレスポンスは届くこと
+func TestShutdownCompletesInFlightRequest(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := h2stest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer s.Close()
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, body, err := fetch(s, "/")
+		done <- result{body, err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Config.Shutdown(ctx) }()
+
+	// GOAWAYフレームがクライアントに届くまでの猶予
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if r := <-done; r.err != nil || string(r.body) != "done" {
+		t.Errorf("got %q, %v, want %q", r.body, r.err, "done")
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
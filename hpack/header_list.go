@@ -1,10 +1,60 @@
 package hpack
 
-import "strings"
+import (
+	"math/bits"
+	"strings"
+	"sync"
+)
 
 // ヘッダーフィールドの順序付けられたコレクションであるヘッダーリスト
 type HeaderList []*HeaderField
 
+const (
+	minPooledListCap = 8 // プールするヘッダーリストの最小の容量
+	listPoolClasses  = 8 // プールの数。容量8から1024までの2の冪毎に用意する
+)
+
+// デコードしたヘッダーリストの領域を再利用するためのプール。
+// i番目のプールは容量が minPooledListCap<<i 以上のヘッダーリストを保持する。
+var headerListPools [listPoolClasses]sync.Pool
+
+// 容量が少なくとも capacity のヘッダーリストをプールから取得する
+func newHeaderList(capacity int) HeaderList {
+	if capacity < minPooledListCap {
+		capacity = minPooledListCap
+	}
+
+	class := bits.Len(uint(capacity-1)) - bits.Len(minPooledListCap-1)
+	if class >= listPoolClasses {
+		return make(HeaderList, 0, capacity)
+	}
+
+	if v := headerListPools[class].Get(); v != nil {
+		return (*v.(*HeaderList))[:0]
+	}
+	return make(HeaderList, 0, minPooledListCap<<class)
+}
+
+// 不要となったヘッダーリストの領域をプールに返却する。
+// ヘッダーフィールド自体は返却後も利用できるが、ヘッダーリストは利用してはならない。
+func (hl HeaderList) Release() {
+	if cap(hl) < minPooledListCap {
+		return
+	}
+
+	class := bits.Len(uint(cap(hl))) - bits.Len(minPooledListCap)
+	if class >= listPoolClasses {
+		class = listPoolClasses - 1
+	}
+
+	hl = hl[:cap(hl)]
+	for i := range hl {
+		hl[i] = nil
+	}
+	hl = hl[:0]
+	headerListPools[class].Put(&hl)
+}
+
 // 名前が一致するヘッダーフィールドをヘッダーリストから取得する(ignore case)
 func (hl HeaderList) Get(name string) *HeaderField {
 	for _, hf := range hl {
@@ -18,10 +68,14 @@ func (hl HeaderList) Get(name string) *HeaderField {
 
 // ヘッダーブロックをデコードし、ヘッダーリストを得る。
 // デコードにはその最中に参照されるインデックステーブルが必要。
+// 得られたヘッダーリストはプールから確保されるため、
+// 不要となった時点でReleaseメソッドにより返却できる。
 func DecodeHeaderBlock(t *IndexTable, block []byte) (HeaderList, error) {
 	var err error
 	var hf *HeaderField
-	list := make([]*HeaderField, 0)
+
+	// ヘッダーフィールド1つあたり数バイト程度と見込んで容量を決める
+	list := newHeaderList(len(block) / 4)
 
 	// インデックスヘッダーフィールド、リテラルヘッダーフィールド
 	// 最大テーブルサイズ更新を判断し、それぞれに応じたデコードや
@@ -37,6 +91,7 @@ func DecodeHeaderBlock(t *IndexTable, block []byte) (HeaderList, error) {
 				return nil, err
 			}
 			list = append(list, hf)
+			t.indexed++
 
 		case block[0] >= 0x40:
 			// インデックス更新を伴うリテラルヘッダフィールド
@@ -46,11 +101,15 @@ func DecodeHeaderBlock(t *IndexTable, block []byte) (HeaderList, error) {
 			}
 			list = append(list, hf)
 			t.add(hf)
+			t.literal++
 
 		case block[0] >= 0x20:
 			// 最大テーブルサイズ更新
 			var newSize uint64
 			newSize, block, err = decodeInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
 			if err := t.updateMaxTableSize(int(newSize)); err != nil {
 				return nil, err
 			}
@@ -62,6 +121,7 @@ func DecodeHeaderBlock(t *IndexTable, block []byte) (HeaderList, error) {
 				return nil, err
 			}
 			list = append(list, hf)
+			t.literal++
 		}
 	}
 
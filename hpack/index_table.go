@@ -43,6 +43,22 @@ type IndexTable struct {
 	maxTableSize     int // 最大テーブルサイズ
 	tableSize        int // 現在のテーブルサイズ
 	dynamicTable     []*HeaderField
+
+	// 利用状況の計測のためのカウンター
+	evictions int // 動的テーブルから削除されたヘッダーフィールドの数
+	indexed   int // インデックスヘッダーフィールドとしてデコードした数
+	literal   int // リテラルヘッダーフィールドとしてデコードした数
+}
+
+// インデックステーブルの利用状況。
+// 各カウンターはインデックステーブル生成時からの累計値。
+type TableStats struct {
+	TableSize    int // 現在のテーブルサイズ
+	MaxTableSize int // 最大テーブルサイズ
+	Entries      int // 動的テーブルが保持するヘッダーフィールドの数
+	Evictions    int // 動的テーブルから削除されたヘッダーフィールドの数
+	Indexed      int // インデックスヘッダーフィールドとしてデコードした数
+	Literal      int // リテラルヘッダーフィールドとしてデコードした数
 }
 
 // 最大テーブルサイズを指定してインデックステーブルを生成
@@ -65,6 +81,18 @@ func (t *IndexTable) UpdateAllowedTableSize(size int) {
 	t.evict()
 }
 
+// インデックステーブルの利用状況を返す
+func (t *IndexTable) Stats() TableStats {
+	return TableStats{
+		TableSize:    t.tableSize,
+		MaxTableSize: t.maxTableSize,
+		Entries:      len(t.dynamicTable),
+		Evictions:    t.evictions,
+		Indexed:      t.indexed,
+		Literal:      t.literal,
+	}
+}
+
 // 最大テーブルサイズを更新
 func (t *IndexTable) updateMaxTableSize(size int) error {
 	if size > t.allowedTableSize {
@@ -122,6 +150,8 @@ func (t *IndexTable) evict() {
 	for i := 1; i <= drop; i++ {
 		t.dynamicTable[len(t.dynamicTable)-i] = nil
 	}
+	t.dynamicTable = t.dynamicTable[:len(t.dynamicTable)-drop]
+	t.evictions += drop
 }
 
 // プロセス起動時に静的テーブルを1度だけ構築。
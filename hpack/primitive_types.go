@@ -5,6 +5,10 @@ import "fmt"
 // ヘッダブロック block から prefix ビットプレフィックスの整数をデコードする。
 // 戻り値としてデコードして得られた整数と未処理のヘッダブロックを返す。
 func decodeInt(block []byte, prefix int) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, fmt.Errorf("truncated integer")
+	}
+
 	mask := uint64(1<<prefix - 1)
 	prefixed := uint64(block[0]) & mask
 
@@ -23,6 +27,10 @@ func decodeInt(block []byte, prefix int) (uint64, []byte, error) {
 			return 0, nil, fmt.Errorf("invalid integer")
 		}
 
+		if offset >= len(block) {
+			return 0, nil, fmt.Errorf("truncated integer")
+		}
+
 		b := block[offset]
 
 		// データの後続フラグである最上位1ビットは無視し、
@@ -62,11 +70,15 @@ func encodeInt(dst []byte, i uint64, prefix int) []byte {
 // ヘッダブロック block から文字列をデコードする。
 // 戻り値として得られた文字列と未処理のヘッダブロックを返す。
 func decodeStr(block []byte) (string, []byte, error) {
-	compressed := (block[0] & 0x80) > 0
 	strLen, remain, err := decodeInt(block, 7)
 	if err != nil {
 		return "", nil, err
 	}
+	compressed := (block[0] & 0x80) > 0
+
+	if strLen > uint64(len(remain)) {
+		return "", nil, fmt.Errorf("truncated string")
+	}
 
 	str := remain[0:strLen]
 	if compressed {